@@ -1,223 +1,1275 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/syslog"
+	"net"
+	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"os/user"
 	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
 )
 
 var l = log.New(os.Stdout, "", 0)
 var el = log.New(os.Stderr, "", 0)
 
-type executor func(string, ...string) error
-
-func lExec(s string, a ...string) error {
-	return exec.Command(s, a...).Run()
-}
-
 func loadConfig(configFile string) (*viper.Viper, error) {
 	config := viper.New()
 	config.SetConfigFile(configFile)
 
 	config.SetDefault("events.min", 1300)
 	config.SetDefault("events.max", 1399)
+	config.SetDefault("events.complete_after", COMPLETE_AFTER)
+	config.SetDefault("shutdown.timeout", time.Second*5)
+	config.SetDefault("kernel_status.interval", time.Second*10)
+	config.SetDefault("socket.mode", "unicast")
+	config.SetDefault("kernel_status.pid_stolen", "reclaim")
+	config.SetDefault("pipeline.parse_queue", 32)
+	config.SetDefault("pipeline.write_queue", 4096)
+	config.SetDefault("pipeline.output_queue", 4096)
+	config.SetDefault("pipeline.report_interval", time.Second*10)
 	config.SetDefault("message_tracking.enabled", true)
 	config.SetDefault("message_tracking.log_out_of_order", false)
 	config.SetDefault("message_tracking.max_out_of_order", 500)
 	config.SetDefault("output.syslog.enabled", false)
-	config.SetDefault("output.syslog.priority", int(syslog.LOG_LOCAL0|syslog.LOG_WARNING))
-	config.SetDefault("output.syslog.tag", "go-audit")
-	config.SetDefault("output.syslog.attempts", "3")
+	setOutputDefaults(config)
 	config.SetDefault("log.flags", 0)
+	config.SetDefault("parser.fields", false)
+	config.SetDefault("rule_management.keep_unknown", false)
 	config.SetDefault("statsd.type", "none")
+	config.SetDefault("statsd.syscall_names", false)
 
 	if err := config.ReadInConfig(); err != nil {
 		return nil, err
 	}
 
-	l.SetFlags(config.GetInt("log.flags"))
-	el.SetFlags(config.GetInt("log.flags"))
+	l.SetFlags(config.GetInt("log.flags"))
+	el.SetFlags(config.GetInt("log.flags"))
+
+	return config, nil
+}
+
+// Defaults for output settings, also used for entries in the outputs list
+func setOutputDefaults(config *viper.Viper) {
+	config.SetDefault("output.syslog.priority", int(syslog.LOG_LOCAL0|syslog.LOG_WARNING))
+	config.SetDefault("output.syslog.tag", "go-audit")
+	config.SetDefault("output.syslog.attempts", "3")
+	config.SetDefault("output.syslog.format", "bsd")
+}
+
+// Checks socket.mode and reports if we should be a passive multicast reader instead of the audit daemon
+func isMulticast(config *viper.Viper) (bool, error) {
+	switch mode := config.GetString("socket.mode"); mode {
+	case "unicast":
+		return false, nil
+	case "multicast":
+		return true, nil
+	default:
+		return false, fmt.Errorf("socket.mode must be unicast or multicast, `%s` provided", mode)
+	}
+}
+
+// How many batches of packets can wait to be parsed, how many events can wait to be handed to the outputs
+// and how many events can wait for each output
+func queueSizes(config *viper.Viper) (int, int, int, error) {
+	parse := config.GetInt("pipeline.parse_queue")
+	if parse <= 0 {
+		return 0, 0, 0, fmt.Errorf("pipeline.parse_queue must be greater than 0, %d provided", parse)
+	}
+
+	write := config.GetInt("pipeline.write_queue")
+	if write <= 0 {
+		return 0, 0, 0, fmt.Errorf("pipeline.write_queue must be greater than 0, %d provided", write)
+	}
+
+	output := config.GetInt("pipeline.output_queue")
+	if output <= 0 {
+		return 0, 0, 0, fmt.Errorf("pipeline.output_queue must be greater than 0, %d provided", output)
+	}
+
+	return parse, write, output, nil
+}
+
+// How often queue depths, drops and spool metrics are logged and sent to statsd
+func reportInterval(config *viper.Viper) (time.Duration, error) {
+	interval := config.GetDuration("pipeline.report_interval")
+	if interval <= 0 {
+		return 0, fmt.Errorf("pipeline.report_interval must be greater than 0, %s provided", interval)
+	}
+
+	return interval, nil
+}
+
+// What to do when another process takes the audit pid, checked every kernel_status.interval
+func pidStolenPolicy(config *viper.Viper) (string, error) {
+	switch policy := config.GetString("kernel_status.pid_stolen"); policy {
+	case "reclaim", "exit", "multicast":
+		return policy, nil
+	default:
+		return "", fmt.Errorf("kernel_status.pid_stolen must be one of reclaim, exit or multicast, `%s` provided", policy)
+	}
+}
+
+// Gives up the audit pid to whoever took it and returns a client reading the multicast group instead
+// Events already queued on the old socket go through the pipeline like any other read before it is closed,
+// so they stay in order with what is already queued
+func fallBackToMulticast(nlClient *NetlinkClient, p *pipeline, recvSize int) *NetlinkClient {
+	nlClient.Disown()
+	mcClient := NewNetlinkClient(recvSize, true)
+
+	for {
+		batch, err := nlClient.ReceiveBatch()
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			break
+		}
+
+		p.receive(batch)
+	}
+
+	if err := nlClient.Close(); err != nil {
+		el.Println("Failed to close the netlink socket:", err)
+	}
+
+	return mcClient
+}
+
+// Applies the audit settings and rules from the config
+// A multicast reader leaves both to the audit daemon that owns them
+func configureKernel(config *viper.Viper, c ruleClient, multicast bool) error {
+	if multicast {
+		l.Println("Reading events from the multicast group, audit settings and rules are left to the audit daemon")
+		return nil
+	}
+
+	undo, err := setAuditStatus(config, c)
+	if err != nil {
+		return err
+	}
+
+	if err := setRules(config, c); err != nil {
+		// setRules has put the old rules back, the settings go back too so nothing is left half changed
+		if undo != nil {
+			if uerr := c.Execute(AUDIT_SET, undo); uerr != nil {
+				return fmt.Errorf("%s. Failed to put the old audit settings back, they are still changed. Error: %s", err, uerr)
+			}
+
+			l.Println("Put the old audit settings back")
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// The configured rules compiled and grouped by what they ask the kernel to do
+type ruleSet struct {
+	wanted  []*auditRuleData
+	deletes []*auditRuleData
+	enables []*auditRule
+	ruleNum map[*auditRuleData]int // Position of each wanted rule in the config, for logging
+	flush   bool
+}
+
+// Compiles every configured rule so a typo is found before anything is changed
+func compileRules(config *viper.Viper) (*ruleSet, error) {
+	rules := config.GetStringSlice("rules")
+	if len(rules) == 0 {
+		return nil, errors.New("No audit rules found")
+	}
+
+	rs := &ruleSet{ruleNum: map[*auditRuleData]int{}}
+	for i, v := range rules {
+		// Skip rules with no content
+		if v == "" {
+			continue
+		}
+
+		r, err := parseRule(v)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse rule #%d. Error: %s", i+1, err)
+		}
+
+		switch r.kind {
+		case ruleAdd:
+			rs.wanted = append(rs.wanted, r.data)
+			rs.ruleNum[r.data] = i + 1
+		case ruleDelete:
+			rs.deletes = append(rs.deletes, r.data)
+		case ruleDeleteAll:
+			rs.flush = true
+		case ruleSetEnabled:
+			rs.enables = append(rs.enables, r)
+		}
+	}
+
+	return rs, nil
+}
+
+func setRules(config *viper.Viper, c ruleClient) error {
+	// Compile everything up front so a typo doesn't leave us with half a rule set
+	rs, err := compileRules(config)
+	if err != nil {
+		return err
+	}
+
+	status, err := c.GetStatus()
+	if err != nil {
+		return fmt.Errorf("Failed to get the audit status. Error: %s", err)
+	}
+
+	raw, err := c.ListRules()
+	if err != nil {
+		return fmt.Errorf("Failed to list existing audit rules. Error: %s", err)
+	}
+
+	current := make([]*auditRuleData, 0, len(raw))
+	for _, b := range raw {
+		r, err := parseAuditRuleData(b)
+		if err != nil {
+			return fmt.Errorf("Failed to parse existing audit rule. Error: %s", err)
+		}
+
+		current = append(current, r)
+	}
+
+	// A -D anywhere in the rules means nothing we didn't configure should survive
+	keepUnknown := config.GetBool("rule_management.keep_unknown") && !rs.flush
+	add, del, same := diffRules(current, rs.wanted, keepUnknown)
+
+	// Explicit deletes only matter for rules we would otherwise keep
+	for _, d := range rs.deletes {
+		for _, r := range current {
+			if r.key() == d.key() && !containsRule(del, r) {
+				del = append(del, r)
+			}
+		}
+	}
+
+	if status.Enabled == AUDIT_LOCKED {
+		if len(add) != 0 || len(del) != 0 {
+			return fmt.Errorf("Audit rules are locked (-e 2) and %d rules would need to change. A reboot is required to change the rules", len(add)+len(del))
+		}
+
+		l.Println("Audit rules are locked and already match the configuration")
+		return nil
+	}
+
+	// The kernel can still refuse a rule, like a watch on a path that can't exist, so what was changed is tracked
+	// and undone rather than leaving half the new rules in place
+	var deleted, added []*auditRuleData
+	fail := func(err error) error {
+		if uerr := undoRules(c, added, deleted); uerr != nil {
+			return fmt.Errorf("%s. Failed to put the old rules back, the kernel has only part of the new rules. Error: %s", err, uerr)
+		}
+
+		if len(added) > 0 || len(deleted) > 0 {
+			l.Printf("Put the old audit rules back, %d removed and %d restored\n", len(added), len(deleted))
+		}
+
+		return err
+	}
+
+	for _, r := range del {
+		if err := c.Execute(AUDIT_DEL_RULE, r.toWire()); err != nil {
+			return fail(fmt.Errorf("Failed to delete audit rule `%s`. Error: %s", r, err))
+		}
+
+		deleted = append(deleted, r)
+		l.Printf("Deleted audit rule `%s`\n", r)
+	}
+
+	for _, r := range add {
+		if err := c.Execute(AUDIT_ADD_RULE, r.toWire()); err != nil {
+			return fail(fmt.Errorf("Failed to add rule #%d. Error: %s", rs.ruleNum[r], err))
+		}
+
+		added = append(added, r)
+		l.Printf("Added audit rule #%d `%s`\n", rs.ruleNum[r], r)
+	}
+
+	l.Printf("Audit rules are in sync, %d added, %d deleted, %d unchanged\n", len(add), len(del), same)
+
+	for _, r := range rs.enables {
+		if err := c.Execute(AUDIT_SET, &AuditStatusPayload{Mask: AUDIT_STATUS_ENABLED, Enabled: r.enabled}); err != nil {
+			return fail(fmt.Errorf("Failed to set audit enabled to %d. Error: %s", r.enabled, err))
+		}
+
+		l.Printf("Set audit enabled to %d\n", r.enabled)
+	}
+
+	return nil
+}
+
+// Removes the rules that were added and adds back the ones that were deleted, newest change first
+func undoRules(c ruleClient, added []*auditRuleData, deleted []*auditRuleData) error {
+	for i := len(added) - 1; i >= 0; i-- {
+		if err := c.Execute(AUDIT_DEL_RULE, added[i].toWire()); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range deleted {
+		if err := c.Execute(AUDIT_ADD_RULE, r.toWire()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Audit failure modes as they are written in the config
+var auditFailureModes = map[string]uint32{
+	"silent": AUDIT_FAIL_SILENT,
+	"printk": AUDIT_FAIL_PRINTK,
+	"panic":  AUDIT_FAIL_PANIC,
+}
+
+// Builds the AUDIT_SET payload for the audit.* settings in the config, only the settings that are present are in the mask
+func auditSettings(config *viper.Viper) (*AuditStatusPayload, error) {
+	p := &AuditStatusPayload{}
+
+	if config.IsSet("audit.failure_mode") {
+		mode := config.GetString("audit.failure_mode")
+		failure, ok := auditFailureModes[mode]
+		if !ok {
+			return nil, fmt.Errorf("audit.failure_mode must be one of silent, printk or panic, `%s` provided", mode)
+		}
+
+		p.Mask |= AUDIT_STATUS_FAILURE
+		p.Failure = failure
+	}
+
+	limits := []struct {
+		key   string
+		mask  uint32
+		value *uint32
+	}{
+		{"audit.backlog_limit", AUDIT_STATUS_BACKLOG_LIMIT, &p.BacklogLimit},
+		{"audit.rate_limit", AUDIT_STATUS_RATE_LIMIT, &p.RateLimit},
+		{"audit.backlog_wait_time", AUDIT_STATUS_BACKLOG_WAIT_TIME, &p.BacklogWaitTime},
+	}
+
+	for _, lim := range limits {
+		if !config.IsSet(lim.key) {
+			continue
+		}
+
+		v, err := strconv.ParseUint(config.GetString(lim.key), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number 0 or greater, `%s` provided", lim.key, config.GetString(lim.key))
+		}
+
+		p.Mask |= lim.mask
+		*lim.value = uint32(v)
+	}
+
+	return p, nil
+}
+
+// Applies the audit.* settings from the config, settings that already have the configured value are left alone
+// The kernel refuses changes once the rules are locked so we only complain if something actually needs to change
+// Returns the AUDIT_SET payload that puts back what was changed, nil if nothing was
+func setAuditStatus(config *viper.Viper, c ruleClient) (*AuditStatusPayload, error) {
+	want, err := auditSettings(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if want.Mask == 0 {
+		return nil, nil
+	}
+
+	status, err := c.GetStatus()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the audit status. Error: %s", err)
+	}
+
+	settings := []struct {
+		name string
+		mask uint32
+		want uint32
+		have uint32
+	}{
+		{"failure_mode", AUDIT_STATUS_FAILURE, want.Failure, status.Failure},
+		{"backlog_limit", AUDIT_STATUS_BACKLOG_LIMIT, want.BacklogLimit, status.BacklogLimit},
+		{"rate_limit", AUDIT_STATUS_RATE_LIMIT, want.RateLimit, status.RateLimit},
+		{"backlog_wait_time", AUDIT_STATUS_BACKLOG_WAIT_TIME, want.BacklogWaitTime, status.BacklogWaitTime},
+	}
+
+	for _, s := range settings {
+		if want.Mask&s.mask == 0 || s.want == s.have {
+			want.Mask &^= s.mask
+			continue
+		}
+
+		if status.Enabled == AUDIT_LOCKED {
+			return nil, fmt.Errorf("Audit is locked (-e 2) and %s can not be changed from %d to %d. A reboot is required", s.name, s.have, s.want)
+		}
+	}
+
+	if want.Mask == 0 {
+		return nil, nil
+	}
+
+	if err := c.Execute(AUDIT_SET, want); err != nil {
+		return nil, fmt.Errorf("Failed to set the audit status. Error: %s", err)
+	}
+
+	undo := &AuditStatusPayload{
+		Mask:            want.Mask,
+		Failure:         status.Failure,
+		BacklogLimit:    status.BacklogLimit,
+		RateLimit:       status.RateLimit,
+		BacklogWaitTime: status.BacklogWaitTime,
+	}
+
+	for _, s := range settings {
+		if want.Mask&s.mask != 0 {
+			l.Printf("Set audit %s to %d, was %d\n", s.name, s.want, s.have)
+		}
+	}
+
+	return undo, nil
+}
+
+// Checks if a rule is in a list of rules
+func containsRule(rules []*auditRuleData, rule *auditRuleData) bool {
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The types of output, output.<type> keys are created in this order before the outputs list
+var outputTypes = []struct {
+	kind   string
+	create func(*viper.Viper) (*AuditWriter, error)
+}{
+	{"syslog", createSyslogOutput},
+	{"file", createFileOutput},
+	{"stdout", createStdOutOutput},
+	{"http", createHTTPOutput},
+	{"elasticsearch", createElasticsearchOutput},
+	{"splunk_hec", createSplunkOutput},
+	{"kafka", createKafkaOutput},
+}
+
+func createOutput(config *viper.Viper) (outputs []*AuditOutput, err error) {
+	// Don't leave anything open if a later output fails, we may be reloading with the old outputs still in use
+	defer func() {
+		if err != nil {
+			closeOutputs(outputs)
+			outputs = nil
+		}
+	}()
+
+	for _, t := range outputTypes {
+		if config.GetBool("output."+t.kind+".enabled") == true {
+			o, err := newOutput(config, t.kind, t.kind)
+			if err != nil {
+				return outputs, err
+			}
+
+			outputs = append(outputs, o)
+		}
+	}
+
+	list, err := outputList(config)
+	if err != nil {
+		return outputs, err
+	}
+
+	for _, e := range list {
+		// Spools and metrics tell outputs apart by name
+		for _, o := range outputs {
+			if o.name == e.name {
+				return outputs, fmt.Errorf("Output name `%s` is used more than once, give the outputs in the list a unique name", e.name)
+			}
+		}
+
+		o, err := newOutput(e.config, e.kind, e.name)
+		if err != nil {
+			return outputs, fmt.Errorf("Failed to create the %s output in outputs. Error: %s", e.name, err)
+		}
+
+		outputs = append(outputs, o)
+	}
+
+	if len(outputs) == 0 {
+		return nil, errors.New("No outputs were configured")
+	}
+
+	return outputs, nil
+}
+
+// Creates a kind of output from the output.<kind> keys, name is what the output is known by in logs, metrics and its spool
+func newOutput(config *viper.Viper, kind, name string) (*AuditOutput, error) {
+	for _, t := range outputTypes {
+		if t.kind != kind {
+			continue
+		}
+
+		writer, err := t.create(config)
+		if err != nil {
+			return nil, err
+		}
+
+		o, err := newOutputFromConfig(config, kind, name, writer)
+		if err != nil {
+			return nil, err
+		}
+
+		if kind == "file" {
+			go handleLogRotation(writer, o.done)
+		}
+
+		return o, nil
+	}
+
+	return nil, fmt.Errorf("Output type must be one of %s, `%s` provided", outputKinds(), kind)
+}
+
+func outputKinds() string {
+	kinds := []string{}
+	for _, t := range outputTypes {
+		kinds = append(kinds, t.kind)
+	}
+
+	return strings.Join(kinds, ", ")
+}
+
+// An entry in the outputs list with its settings moved under output.<kind> in a config of its own
+type listedOutput struct {
+	kind   string
+	name   string
+	config *viper.Viper
+}
+
+// Reads the outputs list, which allows more than one output of a type each with its own settings and filters
+// Entries take the same settings as output.<type> along with a type and a name, which defaults to the type
+// An entry is enabled unless it sets enabled to false
+func outputList(config *viper.Viper) ([]listedOutput, error) {
+	if !config.IsSet("outputs") {
+		return nil, nil
+	}
+
+	entries, ok := config.Get("outputs").([]interface{})
+	if !ok {
+		return nil, errors.New("outputs must be a list")
+	}
+
+	list := []listedOutput{}
+	for i, raw := range entries {
+		entry, err := cast.ToStringMapE(raw)
+		if err != nil {
+			return nil, fmt.Errorf("outputs entry %d must be a map of settings", i+1)
+		}
+
+		kind := cast.ToString(entry["type"])
+		name := kind
+		if n, ok := entry["name"]; ok {
+			name = cast.ToString(n)
+		}
+
+		if kind == "" || name == "" {
+			return nil, fmt.Errorf("outputs entry %d must have a type and the name can not be empty", i+1)
+		}
+
+		delete(entry, "type")
+		delete(entry, "name")
+
+		// Going through yaml gives the entry the same defaults, key handling and types as the output.<type> keys
+		b, err := yaml.Marshal(map[string]interface{}{"output": map[string]interface{}{kind: entry}})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read outputs entry %d. Error: %s", i+1, err)
+		}
+
+		c := viper.New()
+		setOutputDefaults(c)
+		c.SetConfigType("yaml")
+		if err := c.ReadConfig(bytes.NewReader(b)); err != nil {
+			return nil, fmt.Errorf("Failed to read outputs entry %d. Error: %s", i+1, err)
+		}
+
+		// Outputs that wait on close fit that wait in the shutdown timeout
+		c.Set("shutdown.timeout", config.GetDuration("shutdown.timeout"))
+
+		if c.IsSet("output."+kind+".enabled") && !c.GetBool("output."+kind+".enabled") {
+			continue
+		}
+
+		list = append(list, listedOutput{kind: kind, name: name, config: c})
+	}
+
+	return list, nil
+}
+
+// Wraps a writer in an output with the filters and spool configured for it, the writer is closed if either is bad
+// Settings are read from output.<kind> and the output is called name
+func newOutputFromConfig(config *viper.Viper, kind, name string, writer *AuditWriter) (*AuditOutput, error) {
+	filters, err := createFilters(config, "output."+kind+".filters")
+	if err != nil {
+		o := NewAuditOutput(name, writer, nil)
+		o.Close()
+		return nil, fmt.Errorf("Failed to parse the %s output filters. Error: %s", name, err)
+	}
+
+	o := NewAuditOutput(name, writer, filters)
+
+	sc, err := createSpoolConfig(config, kind)
+	if err == nil && sc != nil {
+		o.spool, err = openSpool(name, *sc, writer)
+	}
+
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Failed to set up the %s output spool. Error: %s", name, err)
+	}
+
+	return o, nil
+}
+
+// Reads output.<kind>.spool, nil is returned if the output doesn't spool
+func createSpoolConfig(config *viper.Viper, kind string) (*spoolConfig, error) {
+	key := "output." + kind + ".spool"
+	if !config.GetBool(key + ".enabled") {
+		return nil, nil
+	}
+
+	sc := &spoolConfig{
+		dir:           config.GetString(key + ".path"),
+		maxSize:       SPOOL_MAX_SIZE,
+		segmentSize:   SPOOL_SEGMENT_SIZE,
+		overflow:      SPOOL_DROP_OLDEST,
+		retryInterval: SPOOL_RETRY_INTERVAL,
+	}
+
+	if config.IsSet(key + ".max_size") {
+		sc.maxSize = config.GetInt64(key + ".max_size")
+	}
+
+	if config.IsSet(key + ".segment_size") {
+		sc.segmentSize = config.GetInt64(key + ".segment_size")
+	}
+
+	if config.IsSet(key + ".overflow") {
+		sc.overflow = config.GetString(key + ".overflow")
+	}
+
+	if config.IsSet(key + ".retry_interval") {
+		sc.retryInterval = config.GetDuration(key + ".retry_interval")
+	}
+
+	if sc.dir == "" {
+		return nil, fmt.Errorf("%s.path must be set when the spool is enabled", key)
+	}
+
+	if sc.maxSize <= 0 {
+		return nil, fmt.Errorf("%s.max_size must be greater than 0, %d provided", key, sc.maxSize)
+	}
+
+	if sc.segmentSize <= 0 || sc.segmentSize > sc.maxSize {
+		return nil, fmt.Errorf("%s.segment_size must be greater than 0 and no more than max_size, %d provided", key, sc.segmentSize)
+	}
+
+	switch sc.overflow {
+	case SPOOL_DROP_OLDEST, SPOOL_DROP_NEWEST, SPOOL_BLOCK:
+	default:
+		return nil, fmt.Errorf("%s.overflow must be one of drop_oldest, drop_newest or block, `%s` provided", key, sc.overflow)
+	}
+
+	if sc.retryInterval <= 0 {
+		return nil, fmt.Errorf("%s.retry_interval must be greater than 0, %s provided", key, sc.retryInterval)
+	}
+
+	return sc, nil
+}
+
+// Closes every output, logging any that fail
+func closeOutputs(outputs []*AuditOutput) {
+	for _, o := range outputs {
+		if err := o.Close(); err != nil {
+			el.Printf("Failed to close the %s output. Error: %s\n", o.name, err)
+		}
+	}
+}
+
+func createSyslogOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.syslog.attempts")
+	if attempts < 1 {
+		return nil, fmt.Errorf("Output attempts for syslog must be at least 1, %v provided", attempts)
+	}
+
+	switch format := config.GetString("output.syslog.format"); format {
+	case "", "bsd":
+	case "rfc5424":
+		return createRFC5424Output(config, attempts)
+	default:
+		return nil, fmt.Errorf("output.syslog.format must be bsd or rfc5424, `%s` provided", format)
+	}
+
+	syslogWriter, err := syslog.Dial(
+		config.GetString("output.syslog.network"),
+		config.GetString("output.syslog.address"),
+		syslog.Priority(config.GetInt("output.syslog.priority")),
+		config.GetString("output.syslog.tag"),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open syslog writer. Error: %v", err)
+	}
+
+	return NewAuditWriter(syslogWriter, attempts), nil
+}
+
+func createRFC5424Output(config *viper.Viper, attempts int) (*AuditWriter, error) {
+	c := rfc5424Config{
+		network:    config.GetString("output.syslog.network"),
+		address:    config.GetString("output.syslog.address"),
+		priority:   config.GetInt("output.syslog.priority"),
+		hostname:   config.GetString("output.syslog.hostname"),
+		appName:    config.GetString("output.syslog.tag"),
+		minBackoff: RFC5424_MIN_BACKOFF,
+		maxBackoff: RFC5424_MAX_BACKOFF,
+		timeout:    RFC5424_TIMEOUT,
+	}
+
+	if config.IsSet("output.syslog.timeout") {
+		c.timeout = config.GetDuration("output.syslog.timeout")
+	}
+
+	if config.IsSet("output.syslog.reconnect.min_backoff") {
+		c.minBackoff = config.GetDuration("output.syslog.reconnect.min_backoff")
+	}
+
+	if config.IsSet("output.syslog.reconnect.max_backoff") {
+		c.maxBackoff = config.GetDuration("output.syslog.reconnect.max_backoff")
+	}
+
+	if c.hostname == "" {
+		c.hostname, _ = os.Hostname()
+	}
+
+	if c.network == "tls" {
+		tc, err := newTLSConfig(
+			config.GetString("output.syslog.tls.ca"),
+			config.GetString("output.syslog.tls.cert"),
+			config.GetString("output.syslog.tls.key"),
+			config.GetString("output.syslog.tls.server_name"),
+		)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to configure syslog TLS. Error: %s", err)
+		}
+
+		c.tls = tc
+	}
+
+	w, err := newRFC5424Writer(c)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open syslog writer. Error: %v", err)
+	}
+
+	return NewAuditWriter(w, attempts), nil
+}
+
+func createFileOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.file.attempts")
+	if attempts < 1 {
+		return nil, fmt.Errorf("Output attempts for file must be at least 1, %v provided", attempts)
+	}
+
+	mode := os.FileMode(config.GetInt("output.file.mode"))
+	if mode < 1 {
+		return nil, errors.New("Output file mode should be greater than 0000")
+	}
+
+	f, err := os.OpenFile(
+		config.GetString("output.file.path"),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode,
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open output file. Error: %s", err)
+	}
+
+	if err := f.Chmod(mode); err != nil {
+		return nil, fmt.Errorf("Failed to set file permissions. Error: %s", err)
+	}
+
+	uname := config.GetString("output.file.user")
+	u, err := user.Lookup(uname)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find uid for user %s. Error: %s", uname, err)
+	}
+
+	gname := config.GetString("output.file.group")
+	g, err := user.LookupGroup(gname)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find gid for group %s. Error: %s", gname, err)
+	}
+
+	uid, err := strconv.ParseInt(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Found uid could not be parsed. Error: %s", err)
+	}
+
+	gid, err := strconv.ParseInt(g.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Found gid could not be parsed. Error: %s", err)
+	}
+
+	if err = f.Chown(int(uid), int(gid)); err != nil {
+		return nil, fmt.Errorf("Could not chown output file. Error: %s", err)
+	}
+
+	maxSize := config.GetInt64("output.file.rotate.max_size")
+	if maxSize < 0 {
+		f.Close()
+		return nil, fmt.Errorf("output.file.rotate.max_size must be 0 or more, %d provided", maxSize)
+	}
+
+	interval := config.GetDuration("output.file.rotate.interval")
+	if interval < 0 {
+		f.Close()
+		return nil, fmt.Errorf("output.file.rotate.interval must be 0 or more, %s provided", interval)
+	}
+
+	keep := config.GetInt("output.file.rotate.keep")
+	if keep < 0 {
+		f.Close()
+		return nil, fmt.Errorf("output.file.rotate.keep must be 0 or more, %d provided", keep)
+	}
+
+	rf, err := newRotatingFile(
+		f,
+		config.GetString("output.file.path"),
+		mode,
+		int(uid),
+		int(gid),
+		maxSize,
+		interval,
+		keep,
+		config.GetBool("output.file.rotate.compress"),
+	)
+
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to stat output file. Error: %s", err)
+	}
+
+	return NewAuditWriter(rf, attempts), nil
+}
+
+func handleLogRotation(writer *AuditWriter, done <-chan struct{}) {
+	// Re-open our log file. This is triggered by a USR1 signal and is meant to be used upon log rotation
+	// Stops when done is closed, which happens when the output is closed
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR1)
+	defer signal.Stop(sigc)
+
+	for {
+		select {
+		case <-sigc:
+		case <-done:
+			return
+		}
+
+		// The old file keeps being written to if the new one can't be opened
+		if err := writer.w.(*rotatingFile).Reopen(); err != nil {
+			el.Printf("Error re-opening log file, still writing to the old one. Error: %s\n", err)
+		}
+	}
+}
+
+func createHTTPOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.http.attempts")
+	if attempts < 1 {
+		return nil, fmt.Errorf("Output attempts for http must be at least 1, %v provided", attempts)
+	}
+
+	c, err := createHTTPConfig(config, "output.http")
+	if err != nil {
+		return nil, err
+	}
+
+	var format httpFormat
+	switch f := config.GetString("output.http.format"); f {
+	case "", "ndjson":
+		format = ndjsonFormat{}
+	case "array":
+		format = arrayFormat{}
+	default:
+		return nil, fmt.Errorf("output.http.format must be ndjson or array, `%s` provided", f)
+	}
+
+	w, err := newHTTPWriter(*c, format)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the http writer. Error: %s", err)
+	}
+
+	return NewAuditWriter(w, attempts), nil
+}
+
+func createElasticsearchOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.elasticsearch.attempts")
+	if attempts < 1 {
+		return nil, fmt.Errorf("Output attempts for elasticsearch must be at least 1, %v provided", attempts)
+	}
+
+	c, err := createHTTPConfig(config, "output.elasticsearch")
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimRight(c.url, "/")
+	if base == "" {
+		return nil, errors.New("output.elasticsearch.url must be set")
+	}
+
+	c.url = base + "/_bulk"
+	if pipeline := config.GetString("output.elasticsearch.pipeline"); pipeline != "" {
+		c.url += "?pipeline=" + url.QueryEscape(pipeline)
+	}
+
+	format := elasticsearchFormat{
+		index:   ES_DEFAULT_INDEX,
+		docType: config.GetString("output.elasticsearch.document_type"),
+	}
+
+	if config.IsSet("output.elasticsearch.index") {
+		format.index = config.GetString("output.elasticsearch.index")
+	}
+
+	if format.index == "" {
+		return nil, errors.New("output.elasticsearch.index can not be empty")
+	}
+
+	w, err := newHTTPWriter(*c, format)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the elasticsearch writer. Error: %s", err)
+	}
+
+	if config.GetBool("output.elasticsearch.template.install") {
+		name := config.GetString("output.elasticsearch.template.name")
+		if name == "" {
+			name = "go-audit"
+		}
+
+		path := config.GetString("output.elasticsearch.template.path")
+		if path == "" {
+			w.Close()
+			return nil, errors.New("output.elasticsearch.template.path must be set to install a template")
+		}
+
+		if err := installElasticsearchTemplate(w, base, name, path); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("Failed to install the elasticsearch template. Error: %s", err)
+		}
+
+		l.Printf("Installed the elasticsearch template %s\n", name)
+	}
+
+	return NewAuditWriter(w, attempts), nil
+}
+
+func createSplunkOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.splunk_hec.attempts")
+	if attempts < 1 {
+		return nil, fmt.Errorf("Output attempts for splunk_hec must be at least 1, %v provided", attempts)
+	}
+
+	c, err := createHTTPConfig(config, "output.splunk_hec")
+	if err != nil {
+		return nil, err
+	}
+
+	base := strings.TrimRight(c.url, "/")
+	if base == "" {
+		return nil, errors.New("output.splunk_hec.url must be set")
+	}
+
+	token := config.GetString("output.splunk_hec.token")
+	if token == "" {
+		return nil, errors.New("output.splunk_hec.token must be set")
+	}
+
+	c.url = base + "/services/collector/event"
+	c.headers["Authorization"] = "Splunk " + token
+
+	host := config.GetString("output.splunk_hec.host")
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+
+	source := "go-audit"
+	if config.IsSet("output.splunk_hec.source") {
+		source = config.GetString("output.splunk_hec.source")
+	}
+
+	sourcetype := "go-audit"
+	if config.IsSet("output.splunk_hec.sourcetype") {
+		sourcetype = config.GetString("output.splunk_hec.sourcetype")
+	}
+
+	format := newSplunkFormat(host, source, sourcetype, config.GetString("output.splunk_hec.index"))
+
+	if config.GetBool("output.splunk_hec.ack.enabled") {
+		timeout := SPLUNK_ACK_TIMEOUT
+		if config.IsSet("output.splunk_hec.ack.timeout") {
+			timeout = config.GetDuration("output.splunk_hec.ack.timeout")
+		}
+
+		maxPending := SPLUNK_ACK_MAX_PENDING
+		if config.IsSet("output.splunk_hec.ack.max_pending") {
+			maxPending = config.GetInt("output.splunk_hec.ack.max_pending")
+		}
+
+		interval := SPLUNK_ACK_INTERVAL
+		if config.IsSet("output.splunk_hec.ack.interval") {
+			interval = config.GetDuration("output.splunk_hec.ack.interval")
+		}
+
+		if timeout <= 0 || maxPending < 1 || interval <= 0 {
+			return nil, errors.New("output.splunk_hec.ack timeout, max_pending and interval must be greater than 0")
+		}
+
+		if err := format.enableAck(base, timeout, maxPending, interval); err != nil {
+			return nil, err
+		}
+
+		// Closing has to leave the rest of the shutdown time to drain the other outputs
+		if wait := config.GetDuration("shutdown.timeout") / 2; wait < format.closeWait {
+			format.closeWait = wait
+		}
+
+		c.headers["X-Splunk-Request-Channel"] = format.channel
+	}
+
+	w, err := newHTTPWriter(*c, format)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the splunk_hec writer. Error: %s", err)
+	}
+
+	return NewAuditWriter(w, attempts), nil
+}
+
+func createKafkaOutput(config *viper.Viper) (*AuditWriter, error) {
+	attempts := config.GetInt("output.kafka.attempts")
+	if attempts < 1 {
+		return nil, fmt.Errorf("Output attempts for kafka must be at least 1, %v provided", attempts)
+	}
+
+	c := kafkaConfig{
+		brokers:    config.GetStringSlice("output.kafka.brokers"),
+		topic:      config.GetString("output.kafka.topic"),
+		key:        KAFKA_KEY_NONE,
+		maxEvents:  KAFKA_MAX_EVENTS,
+		maxBytes:   KAFKA_MAX_BYTES,
+		interval:   KAFKA_FLUSH_INTERVAL,
+		maxRetries: KAFKA_MAX_RETRIES,
+		minBackoff: KAFKA_MIN_BACKOFF,
+		maxBackoff: KAFKA_MAX_BACKOFF,
+		timeout:    KAFKA_TIMEOUT,
+	}
+
+	if len(c.brokers) == 0 {
+		return nil, errors.New("output.kafka.brokers must be set")
+	}
+
+	if c.topic == "" {
+		return nil, errors.New("output.kafka.topic must be set")
+	}
+
+	if config.IsSet("output.kafka.key") {
+		c.key = config.GetString("output.kafka.key")
+	}
+
+	if c.key == KAFKA_KEY_HOSTNAME {
+		c.hostname, _ = os.Hostname()
+	}
+
+	if config.IsSet("output.kafka.timeout") {
+		c.timeout = config.GetDuration("output.kafka.timeout")
+	}
+
+	if config.IsSet("output.kafka.batch.max_events") {
+		c.maxEvents = config.GetInt("output.kafka.batch.max_events")
+	}
 
-	return config, nil
-}
+	if config.IsSet("output.kafka.batch.max_bytes") {
+		c.maxBytes = config.GetInt("output.kafka.batch.max_bytes")
+	}
 
-func setRules(config *viper.Viper, e executor) error {
-	// Clear existing rules
-	if err := e("auditctl", "-D"); err != nil {
-		return fmt.Errorf("Failed to flush existing audit rules. Error: %s", err)
+	if config.IsSet("output.kafka.batch.interval") {
+		c.interval = config.GetDuration("output.kafka.batch.interval")
 	}
 
-	l.Println("Flushed existing audit rules")
+	if config.IsSet("output.kafka.retry.max_retries") {
+		c.maxRetries = config.GetInt("output.kafka.retry.max_retries")
+	}
 
-	// Add ours in
-	if rules := config.GetStringSlice("rules"); len(rules) != 0 {
-		for i, v := range rules {
-			// Skip rules with no content
-			if v == "" {
-				continue
-			}
+	if config.IsSet("output.kafka.retry.min_backoff") {
+		c.minBackoff = config.GetDuration("output.kafka.retry.min_backoff")
+	}
 
-			if err := e("auditctl", strings.Fields(v)...); err != nil {
-				return fmt.Errorf("Failed to add rule #%d. Error: %s", i+1, err)
-			}
+	if config.IsSet("output.kafka.retry.max_backoff") {
+		c.maxBackoff = config.GetDuration("output.kafka.retry.max_backoff")
+	}
 
-			l.Printf("Added audit rule #%d\n", i+1)
-		}
-	} else {
-		return errors.New("No audit rules found")
+	if c.maxRetries < 0 || c.minBackoff <= 0 || c.maxBackoff < c.minBackoff {
+		return nil, errors.New("output.kafka.retry max_retries must be 0 or more and min_backoff must be greater than 0 and no more than max_backoff")
 	}
 
-	return nil
-}
+	acks := "all"
+	if config.IsSet("output.kafka.acks") {
+		acks = config.GetString("output.kafka.acks")
+	}
 
-func createOutput(config *viper.Viper) (*AuditWriter, error) {
-	var writer *AuditWriter
 	var err error
-	i := 0
+	if c.acks, err = kafkaRequiredAcks(acks); err != nil {
+		return nil, err
+	}
 
-	if config.GetBool("output.syslog.enabled") == true {
-		i++
-		writer, err = createSyslogOutput(config)
-		if err != nil {
-			return nil, err
-		}
+	if c.compression, err = kafkaCompression(config.GetString("output.kafka.compression")); err != nil {
+		return nil, err
+	}
+
+	c.clientID = "go-audit"
+	if config.IsSet("output.kafka.client_id") {
+		c.clientID = config.GetString("output.kafka.client_id")
 	}
 
-	if config.GetBool("output.file.enabled") == true {
-		i++
-		writer, err = createFileOutput(config)
+	if config.GetBool("output.kafka.tls.enabled") {
+		c.tls, err = newTLSConfig(
+			config.GetString("output.kafka.tls.ca"),
+			config.GetString("output.kafka.tls.cert"),
+			config.GetString("output.kafka.tls.key"),
+			config.GetString("output.kafka.tls.server_name"),
+		)
+
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Failed to configure output.kafka TLS. Error: %s", err)
 		}
 
-		go handleLogRotation(config, writer)
+		c.tls.InsecureSkipVerify = config.GetBool("output.kafka.tls.insecure_skip_verify")
 	}
 
-	if config.GetBool("output.stdout.enabled") == true {
-		i++
-		writer, err = createStdOutOutput(config)
-		if err != nil {
+	if mechanism := config.GetString("output.kafka.sasl.mechanism"); mechanism != "" {
+		if c.saslMechanism, err = kafkaSASLMechanism(mechanism); err != nil {
 			return nil, err
 		}
-	}
 
-	if i > 1 {
-		return nil, errors.New("Only one output can be enabled at a time")
+		c.saslUsername = config.GetString("output.kafka.sasl.username")
+		c.saslPassword = config.GetString("output.kafka.sasl.password")
 	}
 
-	if writer == nil {
-		return nil, errors.New("No outputs were configured")
+	w, err := newKafkaWriter(c, newKafkaClient(c))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the kafka writer. Error: %s", err)
 	}
 
-	return writer, nil
+	return NewAuditWriter(w, attempts), nil
 }
 
-func createSyslogOutput(config *viper.Viper) (*AuditWriter, error) {
-	attempts := config.GetInt("output.syslog.attempts")
-	if attempts < 1 {
-		return nil, fmt.Errorf("Output attempts for syslog must be at least 1, %v provided", attempts)
+// Reads the request, batching and retry settings under key that every http based output shares
+func createHTTPConfig(config *viper.Viper, key string) (*httpConfig, error) {
+	c := &httpConfig{
+		url:        config.GetString(key + ".url"),
+		gzip:       config.GetBool(key + ".gzip"),
+		headers:    config.GetStringMapString(key + ".headers"),
+		timeout:    HTTP_TIMEOUT,
+		maxEvents:  HTTP_MAX_EVENTS,
+		maxBytes:   HTTP_MAX_BYTES,
+		interval:   HTTP_FLUSH_INTERVAL,
+		maxRetries: HTTP_MAX_RETRIES,
+		minBackoff: HTTP_MIN_BACKOFF,
+		maxBackoff: HTTP_MAX_BACKOFF,
+
+		maxRetryAfter: HTTP_MAX_RETRY_AFTER,
 	}
 
-	syslogWriter, err := syslog.Dial(
-		config.GetString("output.syslog.network"),
-		config.GetString("output.syslog.address"),
-		syslog.Priority(config.GetInt("output.syslog.priority")),
-		config.GetString("output.syslog.tag"),
-	)
-
-	if err != nil {
-		return nil, fmt.Errorf("Failed to open syslog writer. Error: %v", err)
+	if config.IsSet(key + ".timeout") {
+		c.timeout = config.GetDuration(key + ".timeout")
 	}
 
-	return NewAuditWriter(syslogWriter, attempts), nil
-}
-
-func createFileOutput(config *viper.Viper) (*AuditWriter, error) {
-	attempts := config.GetInt("output.file.attempts")
-	if attempts < 1 {
-		return nil, fmt.Errorf("Output attempts for file must be at least 1, %v provided", attempts)
+	if config.IsSet(key + ".batch.max_events") {
+		c.maxEvents = config.GetInt(key + ".batch.max_events")
 	}
 
-	mode := os.FileMode(config.GetInt("output.file.mode"))
-	if mode < 1 {
-		return nil, errors.New("Output file mode should be greater than 0000")
+	if config.IsSet(key + ".batch.max_bytes") {
+		c.maxBytes = config.GetInt(key + ".batch.max_bytes")
 	}
 
-	f, err := os.OpenFile(
-		config.GetString("output.file.path"),
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode,
-	)
-
-	if err != nil {
-		return nil, fmt.Errorf("Failed to open output file. Error: %s", err)
+	if config.IsSet(key + ".batch.interval") {
+		c.interval = config.GetDuration(key + ".batch.interval")
 	}
 
-	if err := f.Chmod(mode); err != nil {
-		return nil, fmt.Errorf("Failed to set file permissions. Error: %s", err)
+	if config.IsSet(key + ".retry.max_retries") {
+		c.maxRetries = config.GetInt(key + ".retry.max_retries")
 	}
 
-	uname := config.GetString("output.file.user")
-	u, err := user.Lookup(uname)
-	if err != nil {
-		return nil, fmt.Errorf("Could not find uid for user %s. Error: %s", uname, err)
+	if config.IsSet(key + ".retry.min_backoff") {
+		c.minBackoff = config.GetDuration(key + ".retry.min_backoff")
 	}
 
-	gname := config.GetString("output.file.group")
-	g, err := user.LookupGroup(gname)
-	if err != nil {
-		return nil, fmt.Errorf("Could not find gid for group %s. Error: %s", gname, err)
+	if config.IsSet(key + ".retry.max_backoff") {
+		c.maxBackoff = config.GetDuration(key + ".retry.max_backoff")
 	}
 
-	uid, err := strconv.ParseInt(u.Uid, 10, 32)
-	if err != nil {
-		return nil, fmt.Errorf("Found uid could not be parsed. Error: %s", err)
+	if config.IsSet(key + ".retry.max_retry_after") {
+		c.maxRetryAfter = config.GetDuration(key + ".retry.max_retry_after")
 	}
 
-	gid, err := strconv.ParseInt(g.Gid, 10, 32)
-	if err != nil {
-		return nil, fmt.Errorf("Found gid could not be parsed. Error: %s", err)
+	token := config.GetString(key + ".auth.bearer_token")
+	username := config.GetString(key + ".auth.username")
+	if token != "" && username != "" {
+		return nil, fmt.Errorf("%s.auth can have a bearer_token or a username and password, not both", key)
 	}
 
-	if err = f.Chown(int(uid), int(gid)); err != nil {
-		return nil, fmt.Errorf("Could not chown output file. Error: %s", err)
+	if token != "" {
+		c.headers["Authorization"] = "Bearer " + token
+	} else if username != "" {
+		creds := username + ":" + config.GetString(key+".auth.password")
+		c.headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
 	}
 
-	return NewAuditWriter(f, attempts), nil
-}
-
-func handleLogRotation(config *viper.Viper, writer *AuditWriter) {
-	// Re-open our log file. This is triggered by a USR1 signal and is meant to be used upon log rotation
-
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGUSR1)
+	tc, err := newTLSConfig(
+		config.GetString(key+".tls.ca"),
+		config.GetString(key+".tls.cert"),
+		config.GetString(key+".tls.key"),
+		config.GetString(key+".tls.server_name"),
+	)
 
-	for range sigc {
-		newWriter, err := createFileOutput(config)
-		if err != nil {
-			el.Fatalln("Error re-opening log file. Exiting.")
-		}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to configure %s TLS. Error: %s", key, err)
+	}
 
-		oldFile := writer.w.(*os.File)
-		writer.w = newWriter.w
-		writer.e = newWriter.e
+	tc.InsecureSkipVerify = config.GetBool(key + ".tls.insecure_skip_verify")
+	c.tls = tc
 
-		err = oldFile.Close()
-		if err != nil {
-			el.Printf("Error closing old log file: %+v\n", err)
-		}
-	}
+	return c, nil
 }
 
 func createStdOutOutput(config *viper.Viper) (*AuditWriter, error) {
@@ -232,26 +1284,27 @@ func createStdOutOutput(config *viper.Viper) (*AuditWriter, error) {
 	return NewAuditWriter(os.Stdout, attempts), nil
 }
 
-func createFilters(config *viper.Viper) []AuditFilter {
+// Parses a list of filters found at key in the config
+func createFilters(config *viper.Viper, key string) ([]AuditFilter, error) {
 	var err error
 	var ok bool
 
-	fs := config.Get("filters")
+	fs := config.Get(key)
 	filters := []AuditFilter{}
 
 	if fs == nil {
-		return filters
+		return filters, nil
 	}
 
 	ft, ok := fs.([]interface{})
 	if !ok {
-		return filters
+		return filters, nil
 	}
 
 	for i, f := range ft {
 		f2, ok := f.(map[interface{}]interface{})
 		if !ok {
-			el.Fatal("Could not parse filter ", i+1, f)
+			return nil, fmt.Errorf("Could not parse filter %d %v", i+1, f)
 		}
 
 		af := AuditFilter{}
@@ -261,28 +1314,28 @@ func createFilters(config *viper.Viper) []AuditFilter {
 				if ev, ok := v.(string); ok {
 					fv, err := strconv.ParseUint(ev, 10, 64)
 					if err != nil {
-						el.Fatal("`message_type` in filter ", i+1, " could not be parsed ", v, " ", err)
+						return nil, fmt.Errorf("`message_type` in filter %d could not be parsed %v %s", i+1, v, err)
 					}
 					af.messageType = uint16(fv)
 
 				} else if ev, ok := v.(int); ok {
 					if !ok {
-						el.Fatal("`message_type` in filter ", i+1, " could not be parsed ", v)
+						return nil, fmt.Errorf("`message_type` in filter %d could not be parsed %v", i+1, v)
 					}
 					af.messageType = uint16(ev)
 
 				} else {
-					el.Fatal("`message_type` in filter ", i+1, " could not be parsed ", v)
+					return nil, fmt.Errorf("`message_type` in filter %d could not be parsed %v", i+1, v)
 				}
 
 			case "regex":
 				re, ok := v.(string)
 				if !ok {
-					el.Fatal("`regex` in filter ", i+1, " could not be parsed ", v)
+					return nil, fmt.Errorf("`regex` in filter %d could not be parsed %v", i+1, v)
 				}
 
 				if af.regex, err = regexp.Compile(re); err != nil {
-					el.Fatal("`regex` in filter ", i+1, " could not be parsed ", v, " ", err)
+					return nil, fmt.Errorf("`regex` in filter %d could not be parsed %v %s", i+1, v, err)
 				}
 
 			case "syscall":
@@ -291,23 +1344,96 @@ func createFilters(config *viper.Viper) []AuditFilter {
 				} else if ev, ok := v.(int); ok {
 					af.syscall = strconv.Itoa(ev)
 				} else {
-					el.Fatal("`syscall` in filter ", i+1, " could not be parsed ", v)
+					return nil, fmt.Errorf("`syscall` in filter %d could not be parsed %v", i+1, v)
+				}
+
+				if !validSyscall(af.syscall) {
+					return nil, fmt.Errorf("`syscall` in filter %d is not a known syscall name %v", i+1, v)
+				}
+
+			case "family":
+				if af.family, ok = v.(string); !ok {
+					return nil, fmt.Errorf("`family` in filter %d could not be parsed %v", i+1, v)
+				}
+
+				switch af.family {
+				case "inet", "inet6", "unix", "netlink":
+				default:
+					return nil, fmt.Errorf("`family` in filter %d must be one of inet, inet6, unix or netlink %v", i+1, v)
+				}
+
+			case "port":
+				if af.port, ok = v.(int); !ok || af.port < 1 || af.port > 65535 {
+					return nil, fmt.Errorf("`port` in filter %d could not be parsed %v", i+1, v)
+				}
+
+			case "cidr":
+				cidrs := []interface{}{v}
+				if cl, ok := v.([]interface{}); ok {
+					cidrs = cl
+				}
+
+				for _, c := range cidrs {
+					cidr, err := parseCIDR(c)
+					if err != nil {
+						return nil, fmt.Errorf("`cidr` in filter %d could not be parsed %v %s", i+1, c, err)
+					}
+					af.cidrs = append(af.cidrs, cidr)
 				}
 			}
 		}
 
+		if af.matchesSockaddr() {
+			// Addresses only ever come from SOCKADDR messages
+			if af.messageType == 0 {
+				af.messageType = 1306
+			}
+
+			l.Printf("Ignoring  syscall `%v` connecting to family `%v` cidr `%v` port `%v`\n", af.syscall, af.family, af.cidrs, af.port)
+		} else if af.regex == nil {
+			return nil, fmt.Errorf("Filter %d must have a `regex` or one of `family`, `cidr` or `port`", i+1)
+		}
+
+		if af.regex != nil {
+			l.Printf("Ignoring  syscall `%v` containing message type `%v` matching string `%s`\n", af.syscall, af.messageType, af.regex.String())
+		}
+
 		filters = append(filters, af)
-		l.Printf("Ignoring  syscall `%v` containing message type `%v` matching string `%s`\n", af.syscall, af.messageType, af.regex.String())
 	}
 
-	return filters
+	return filters, nil
+}
+
+// Parses a CIDR like 127.0.0.0/8, a single address like ::1 is treated as a CIDR of just that address
+func parseCIDR(v interface{}) (*net.IPNet, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("Not a string")
+	}
+
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid address %s", s)
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, cidr, err := net.ParseCIDR(s)
+	return cidr, err
 }
 
 func createStatsdConfig(config *viper.Viper) (StatsdConfig, error) {
 	sc := StatsdConfig{
-		kind: config.GetString("statsd.type"),
-		ip:   config.GetString("statsd.ip"),
-		port: config.GetString("statsd.port"),
+		kind:         config.GetString("statsd.type"),
+		ip:           config.GetString("statsd.ip"),
+		port:         config.GetString("statsd.port"),
+		syscallNames: config.GetBool("statsd.syscall_names"),
 	}
 	sc.tokens = make(map[uint16]map[string]string)
 	if sc.kind == "statsd" || sc.kind == "dogstatsd" {
@@ -348,6 +1474,142 @@ func createStatsdConfig(config *viper.Viper) (StatsdConfig, error) {
 	return sc, nil
 }
 
+// Builds a marshaller writing to outputs using the filters, statsd and event settings in the config
+func createMarshaller(config *viper.Viper, outputs []*AuditOutput) (*AuditMarshaller, error) {
+	sc, err := createStatsdConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, err := createFilters(config, "filters")
+	if err != nil {
+		return nil, err
+	}
+
+	completeAfter := config.GetDuration("events.complete_after")
+	if completeAfter < MIN_COMPLETE_AFTER {
+		return nil, fmt.Errorf("events.complete_after must be at least %s, %s provided", MIN_COMPLETE_AFTER, completeAfter)
+	}
+
+	return NewAuditMarshaller(
+		outputs,
+		uint16(config.GetInt("events.min")),
+		uint16(config.GetInt("events.max")),
+		config.GetBool("message_tracking.enabled"),
+		config.GetBool("message_tracking.log_out_of_order"),
+		config.GetInt("message_tracking.max_out_of_order"),
+		filters,
+		sc,
+		config.GetBool("parser.fields"),
+		completeAfter,
+	), nil
+}
+
+// Loads the config file again and applies it to the running marshaller and the kernel rules
+// Nothing is changed if the config can not be loaded, the outputs can not be created or the rules can not be applied
+// The netlink socket is kept so sequence tracking and pending events carry over
+func reload(configFile string, c ruleClient, marshaller *AuditMarshaller, multicast, fellBack bool) (*viper.Viper, error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket is kept so it can't switch between being the audit daemon and a multicast reader
+	if m, err := isMulticast(config); err != nil {
+		return nil, err
+	} else if m != multicast {
+		return nil, errors.New("socket.mode can not be changed without a restart")
+	}
+
+	if _, err := pidStolenPolicy(config); err != nil {
+		return nil, err
+	}
+
+	if _, err := reportInterval(config); err != nil {
+		return nil, err
+	}
+
+	// Check the rules and audit settings before anything is opened or changed
+	if !multicast {
+		if _, err := compileRules(config); err != nil {
+			return nil, err
+		}
+
+		if _, err := auditSettings(config); err != nil {
+			return nil, err
+		}
+	}
+
+	outputs, err := createOutput(config)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := createMarshaller(config, outputs)
+	if err != nil {
+		closeOutputs(outputs)
+		return nil, err
+	}
+
+	// After falling back to multicast the settings and rules belong to whoever took the audit pid
+	if err := configureKernel(config, c, multicast || fellBack); err != nil {
+		closeOutputs(outputs)
+		return nil, err
+	}
+
+	old := marshaller.Reload(n)
+
+	// Spools shared with the old outputs replay to the new ones now that they are in use
+	for _, o := range outputs {
+		if o.spool != nil {
+			o.spool.activate(o.writer)
+		}
+	}
+
+	closeOutputs(old)
+	return config, nil
+}
+
+// Stops the kernel from sending us events, writes everything that was already received and closes the outputs
+// An error is returned if that doesn't finish before timeout passes
+func shutdown(nlClient *NetlinkClient, marshaller *AuditMarshaller, p *pipeline, timeout time.Duration) error {
+	if err := nlClient.Release(); err != nil {
+		el.Println("Failed to release the audit pid:", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// Whatever is still queued is written first, the rest is written as it is read
+		p.stop()
+
+		// Pick up the events the kernel queued before it saw the release, Receive fails once the socket is quiet
+		for {
+			msg, err := nlClient.Receive()
+			if err != nil {
+				break
+			}
+
+			marshaller.Consume(msg)
+		}
+
+		if err := nlClient.Close(); err != nil {
+			el.Println("Failed to close the netlink socket:", err)
+		}
+
+		marshaller.Flush()
+		closeOutputs(marshaller.outputs)
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Timed out after %s waiting for events to be written and outputs to close", timeout)
+	}
+}
+
 func main() {
 	configFile := flag.String("config", "", "Config file location")
 
@@ -365,47 +1627,152 @@ func main() {
 	}
 
 	// output needs to be created before anything that write to stdout
-	writer, err := createOutput(config)
+	outputs, err := createOutput(config)
 	if err != nil {
 		el.Fatal(err)
 	}
 
-	if err := setRules(config, lExec); err != nil {
+	multicast, err := isMulticast(config)
+	if err != nil {
 		el.Fatal(err)
 	}
 
-	nlClient := NewNetlinkClient(config.GetInt("socket_buffer.receive"))
+	if _, err := pidStolenPolicy(config); err != nil {
+		el.Fatal(err)
+	}
 
-	sc, err := createStatsdConfig(config)
+	parseQueue, writeQueue, outputQueue, err := queueSizes(config)
 	if err != nil {
 		el.Fatal(err)
 	}
 
-	marshaller := NewAuditMarshaller(
-		writer,
-		uint16(config.GetInt("events.min")),
-		uint16(config.GetInt("events.max")),
-		config.GetBool("message_tracking.enabled"),
-		config.GetBool("message_tracking.log_out_of_order"),
-		config.GetInt("message_tracking.max_out_of_order"),
-		createFilters(config),
-		sc,
-	)
+	interval, err := reportInterval(config)
+	if err != nil {
+		el.Fatal(err)
+	}
+
+	nlClient := NewNetlinkClient(config.GetInt("socket_buffer.receive"), multicast)
+	fellBack := false
+
+	if err := configureKernel(config, nlClient, multicast); err != nil {
+		el.Fatal(err)
+	}
+
+	marshaller, err := createMarshaller(config, outputs)
+	if err != nil {
+		el.Fatal(err)
+	}
+
+	// Flush often enough that a group waiting for an EOE is written shortly after completeAfter passes
+	stopFlushing := make(chan struct{})
+	go marshaller.FlushEvery(marshaller.completeAfter/4, stopFlushing)
+
+	p := newPipeline(marshaller, parseQueue, writeQueue, outputQueue)
+
+	// Separate from the kernel status checks so the pipeline still reports when those are disabled
+	report := time.NewTicker(interval)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+
+	monitor := &statusMonitor{}
+	if !multicast {
+		monitor.pid = uint32(os.Getpid())
+	}
+	monitor.setInterval(config.GetDuration("kernel_status.interval"))
 
 	l.Printf("Started processing events in the range [%d, %d]\n", config.GetInt("events.min"), config.GetInt("events.max"))
 
 	//Main loop. Get data from netlink and send it to the json lib for processing
 	for {
-		msg, err := nlClient.Receive()
-		if err != nil {
-			el.Printf("Error during message receive: %+v\n", err)
-			continue
+		select {
+		case sig := <-sigc:
+			l.Printf("Received %s, shutting down\n", sig)
+			close(stopFlushing)
+
+			if err := shutdown(nlClient, marshaller, p, config.GetDuration("shutdown.timeout")); err != nil {
+				el.Fatal(err)
+			}
+
+			l.Println("Shutdown complete")
+			return
+
+		case <-hupc:
+			// Reloading happens here, between receives, since changing the rules needs to read from the socket too
+			l.Println("Received SIGHUP, reloading", *configFile)
+
+			newConfig, err := reload(*configFile, nlClient, marshaller, multicast, fellBack)
+			if err != nil {
+				el.Printf("Failed to reload the config. Error: %s\n", err)
+				continue
+			}
+
+			config = newConfig
+			close(stopFlushing)
+			stopFlushing = make(chan struct{})
+			go marshaller.FlushEvery(marshaller.completeAfter/4, stopFlushing)
+			monitor.setInterval(config.GetDuration("kernel_status.interval"))
+
+			report.Stop()
+			interval, _ = reportInterval(config)
+			report = time.NewTicker(interval)
+
+			l.Printf("Reloaded the config, processing events in the range [%d, %d]\n", config.GetInt("events.min"), config.GetInt("events.max"))
+
+		case <-report.C:
+			p.report(&marshaller.statsdConfigs)
+
+		case <-monitor.C:
+			// Also done here since the status reply has to be read from the socket
+			stolen, err := monitor.check(nlClient, &marshaller.statsdConfigs)
+			if err != nil {
+				el.Printf("Failed to get the kernel audit status. Error: %s\n", err)
+			}
+
+			if !stolen {
+				break
+			}
+
+			switch config.GetString("kernel_status.pid_stolen") {
+			case "exit":
+				el.Println("Shutting down since the audit pid was taken")
+				nlClient.Disown()
+				close(stopFlushing)
+
+				if err := shutdown(nlClient, marshaller, p, config.GetDuration("shutdown.timeout")); err != nil {
+					el.Fatal(err)
+				}
+
+				os.Exit(1)
+
+			case "multicast":
+				el.Println("Reading events from the multicast group since the audit pid was taken")
+				nlClient = fallBackToMulticast(nlClient, p, config.GetInt("socket_buffer.receive"))
+				fellBack = true
+				monitor.pid = 0
+
+			default:
+				el.Println("Reclaiming the audit pid")
+				nlClient.KeepConnection()
+			}
+
+		default:
 		}
 
-		if msg == nil {
+		batch, err := nlClient.ReceiveBatch()
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				// Nothing arrived before the receive timeout or a signal interrupted the wait, go around so we can check for signals
+				continue
+			}
+
+			el.Printf("Error during message receive: %+v\n", err)
 			continue
 		}
 
-		marshaller.Consume(msg)
+		p.receive(batch)
 	}
 }
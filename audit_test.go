@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"io/ioutil"
 	"log/syslog"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/user"
 	"path"
 	"strconv"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -25,6 +29,10 @@ func Test_loadConfig(t *testing.T) {
 	config, err := loadConfig(file)
 	assert.Equal(t, 1300, config.GetInt("events.min"), "events.min should default to 1300")
 	assert.Equal(t, 1399, config.GetInt("events.max"), "events.max should default to 1399")
+	assert.Equal(t, COMPLETE_AFTER, config.GetDuration("events.complete_after"), "events.complete_after should default to 2s")
+	assert.Equal(t, time.Second*10, config.GetDuration("kernel_status.interval"), "kernel_status.interval should default to 10s")
+	assert.Equal(t, time.Second*10, config.GetDuration("pipeline.report_interval"), "pipeline.report_interval should default to 10s")
+	assert.Equal(t, 4096, config.GetInt("pipeline.output_queue"), "pipeline.output_queue should default to 4096")
 	assert.Equal(t, true, config.GetBool("message_tracking.enabled"), "message_tracking.enabled should default to true")
 	assert.Equal(t, false, config.GetBool("message_tracking.log_out_of_order"), "message_tracking.log_out_of_order should default to false")
 	assert.Equal(t, 500, config.GetInt("message_tracking.max_out_of_order"), "message_tracking.max_out_of_order should default to 500")
@@ -32,7 +40,10 @@ func Test_loadConfig(t *testing.T) {
 	assert.Equal(t, 132, config.GetInt("output.syslog.priority"), "output.syslog.priority should default to 132")
 	assert.Equal(t, "go-audit", config.GetString("output.syslog.tag"), "output.syslog.tag should default to go-audit")
 	assert.Equal(t, 3, config.GetInt("output.syslog.attempts"), "output.syslog.attempts should default to 3")
+	assert.Equal(t, "bsd", config.GetString("output.syslog.format"), "output.syslog.format should default to bsd")
 	assert.Equal(t, 0, config.GetInt("log.flags"), "log.flags should default to 0")
+	assert.Equal(t, false, config.GetBool("parser.fields"), "parser.fields should default to false")
+	assert.Equal(t, false, config.GetBool("rule_management.keep_unknown"), "rule_management.keep_unknown should default to false")
 	assert.Equal(t, 0, l.Flags(), "stdout log flags was wrong")
 	assert.Equal(t, 0, el.Flags(), "stderr log flags was wrong")
 	assert.Equal(t, "none", config.GetString("statsd.type"), "stastd.type should default to none")
@@ -47,57 +58,124 @@ func Test_loadConfig(t *testing.T) {
 
 func Test_setRules(t *testing.T) {
 	defer resetLogger()
+	lb, _ := hookLogger()
 
-	// fail to flush rules
+	// fail on 0 rules
 	config := viper.New()
+	c := &fakeRuleClient{}
+	err := setRules(config, c)
+	assert.EqualError(t, err, "No audit rules found")
 
-	err := setRules(config, func(s string, a ...string) error {
-		if s == "auditctl" && a[0] == "-D" {
-			return errors.New("testing")
-		}
+	// fail to parse a rule, nothing should be touched
+	config.Set("rules", []string{"-a always,exit -S execve", "-a -3 -4"})
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Failed to parse rule #2. Error: Invalid list and action `-3`")
+	assert.Equal(t, 0, len(c.executed), "Should not have talked to the kernel")
 
-		return nil
-	})
+	// fail to get status or list rules
+	config.Set("rules", []string{"-a always,exit -F arch=b64 -S execve", "", "-w /etc/shadow -p wa", "-e 1"})
+	c = &fakeRuleClient{statusErr: errors.New("testing")}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Failed to get the audit status. Error: testing")
 
-	assert.EqualError(t, err, "Failed to flush existing audit rules. Error: testing")
-
-	// fail on 0 rules
-	err = setRules(config, func(s string, a ...string) error { return nil })
-	assert.EqualError(t, err, "No audit rules found")
+	c = &fakeRuleClient{listErr: errors.New("testing")}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Failed to list existing audit rules. Error: testing")
 
 	// failure to set rule
-	r := 0
-	config.Set("rules", []string{"-a -1 -2", "", "-a -3 -4"})
-	err = setRules(config, func(s string, a ...string) error {
-		if a[0] != "-D" {
-			return errors.New("testing rule")
-		}
+	c = &fakeRuleClient{execErr: map[uint16]error{AUDIT_ADD_RULE: errors.New("testing rule")}}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Failed to add rule #1. Error: testing rule")
 
-		r++
+	// a failure part way through puts the old rules back
+	lb.Reset()
+	old := mustParseRule(t, "-a always,exit -S connect -k old")
+	c = &fakeRuleClient{
+		rules:     [][]byte{old.toWire()},
+		execErr:   map[uint16]error{AUDIT_ADD_RULE: errors.New("testing rule")},
+		execErrAt: map[uint16]int{AUDIT_ADD_RULE: 2},
+	}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Failed to add rule #3. Error: testing rule")
+	assert.Equal(t, []uint16{AUDIT_DEL_RULE, AUDIT_ADD_RULE, AUDIT_DEL_RULE, AUDIT_ADD_RULE}, c.executed)
+	assert.Equal(t, c.payloads[1], c.payloads[2], "The added rule should have been removed")
+	assert.Equal(t, old.toWire(), c.payloads[3], "The deleted rule should have been added back")
+	assert.Contains(t, lb.String(), "Put the old audit rules back, 1 removed and 1 restored\n")
 
-		return nil
-	})
+	// even when the enabled flag is what fails
+	c = &fakeRuleClient{rules: [][]byte{old.toWire()}, execErr: map[uint16]error{AUDIT_SET: syscall.EPERM}}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Failed to set audit enabled to 1. Error: operation not permitted")
+	assert.Equal(t, []uint16{AUDIT_DEL_RULE, AUDIT_ADD_RULE, AUDIT_ADD_RULE, AUDIT_DEL_RULE, AUDIT_DEL_RULE, AUDIT_ADD_RULE}, c.executed)
 
-	assert.Equal(t, 1, r, "Wrong number of rule set attempts")
-	assert.EqualError(t, err, "Failed to add rule #1. Error: testing rule")
+	// which can fail too
+	c = &fakeRuleClient{rules: [][]byte{old.toWire()}, execErr: map[uint16]error{AUDIT_ADD_RULE: errors.New("testing rule")}}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Failed to add rule #1. Error: testing rule. Failed to put the old rules back, the kernel has only part of the new rules. Error: testing rule")
 
-	// properly set rules
-	r = 0
-	err = setRules(config, func(s string, a ...string) error {
-		// Skip the flush rules
-		if a[0] != "-a" {
-			return nil
-		}
+	// properly set rules from nothing
+	lb.Reset()
+	c = &fakeRuleClient{}
+	err = setRules(config, c)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{AUDIT_ADD_RULE, AUDIT_ADD_RULE, AUDIT_SET}, c.executed, "Wrong rule set attempts")
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_ENABLED, Enabled: 1}, c.payloads[2])
+	assert.Equal(
+		t,
+		"Added audit rule #1 `-a always,exit -F arch=b64 -S execve`\n"+
+			"Added audit rule #3 `-a always,exit -F path=/etc/shadow -F perm=wa`\n"+
+			"Audit rules are in sync, 2 added, 0 deleted, 0 unchanged\n"+
+			"Set audit enabled to 1\n",
+		lb.String(),
+	)
 
-		if (a[1] == "-1" && a[2] == "-2") || (a[1] == "-3" && a[2] == "-4") {
-			r++
-		}
+	// only the differences are applied, unknown rules are deleted
+	execve := mustParseRule(t, "-a always,exit -F arch=b64 -S execve")
+	shadow := mustParseRule(t, "-w /etc/shadow -p wa")
+	other := mustParseRule(t, "-a always,exit -S connect -k other")
 
-		return nil
-	})
+	c = &fakeRuleClient{rules: [][]byte{other.toWire(), execve.toWire()}}
+	err = setRules(config, c)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{AUDIT_DEL_RULE, AUDIT_ADD_RULE, AUDIT_SET}, c.executed, "Wrong rule set attempts")
+	assert.Equal(t, other.toWire(), c.payloads[0])
+	assert.Equal(t, shadow.toWire(), c.payloads[1])
+
+	// unknown rules can be kept
+	config.Set("rule_management.keep_unknown", true)
+	c = &fakeRuleClient{rules: [][]byte{other.toWire(), execve.toWire(), shadow.toWire()}}
+	err = setRules(config, c)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{AUDIT_SET}, c.executed, "Wrong rule set attempts")
+
+	// unless there is an explicit delete
+	config.Set("rules", []string{"-a always,exit -F arch=b64 -S execve", "-d always,exit -S connect -k other"})
+	c = &fakeRuleClient{rules: [][]byte{other.toWire(), execve.toWire()}}
+	err = setRules(config, c)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{AUDIT_DEL_RULE}, c.executed, "Wrong rule set attempts")
+	assert.Equal(t, other.toWire(), c.payloads[0])
 
-	assert.Equal(t, 2, r, "Wrong number of correct rule set attempts")
+	// or a delete all
+	config.Set("rules", []string{"-D", "-a always,exit -F arch=b64 -S execve"})
+	c = &fakeRuleClient{rules: [][]byte{other.toWire(), execve.toWire()}}
+	err = setRules(config, c)
 	assert.Nil(t, err)
+	assert.Equal(t, []uint16{AUDIT_DEL_RULE}, c.executed, "Wrong rule set attempts")
+
+	// locked rules that match are fine
+	lb.Reset()
+	c = &fakeRuleClient{rules: [][]byte{execve.toWire()}, status: AuditStatusPayload{Enabled: AUDIT_LOCKED}}
+	err = setRules(config, c)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(c.executed), "Should not have talked to the kernel")
+	assert.Equal(t, "Audit rules are locked and already match the configuration\n", lb.String())
+
+	// locked rules that need to change are an error
+	c = &fakeRuleClient{rules: [][]byte{other.toWire()}, status: AuditStatusPayload{Enabled: AUDIT_LOCKED}}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "Audit rules are locked (-e 2) and 2 rules would need to change. A reboot is required to change the rules")
+	assert.Equal(t, 0, len(c.executed), "Should not have talked to the kernel")
 }
 
 func Test_createFileOutput(t *testing.T) {
@@ -165,17 +243,44 @@ func Test_createFileOutput(t *testing.T) {
 	assert.EqualError(t, err, "Could not chown output file. Error: chown /tmp/go-audit.test.log: operation not permitted")
 	assert.Nil(t, w)
 
-	// All good
+	// rotate errors
 	c = viper.New()
 	c.Set("output.file.attempts", 1)
 	c.Set("output.file.path", path.Join(os.TempDir(), "go-audit.test.log"))
 	c.Set("output.file.mode", 0644)
 	c.Set("output.file.user", u.Username)
 	c.Set("output.file.group", g.Name)
+	c.Set("output.file.rotate.max_size", -1)
+	w, err = createFileOutput(c)
+	assert.EqualError(t, err, "output.file.rotate.max_size must be 0 or more, -1 provided")
+	assert.Nil(t, w)
+
+	c.Set("output.file.rotate.max_size", 1024)
+	c.Set("output.file.rotate.interval", "-1h")
+	w, err = createFileOutput(c)
+	assert.EqualError(t, err, "output.file.rotate.interval must be 0 or more, -1h0m0s provided")
+	assert.Nil(t, w)
+
+	c.Set("output.file.rotate.interval", "1h")
+	c.Set("output.file.rotate.keep", -1)
+	w, err = createFileOutput(c)
+	assert.EqualError(t, err, "output.file.rotate.keep must be 0 or more, -1 provided")
+	assert.Nil(t, w)
+
+	// All good
+	c.Set("output.file.rotate.keep", 5)
+	c.Set("output.file.rotate.compress", true)
 	w, err = createFileOutput(c)
 	assert.Nil(t, err)
 	assert.NotNil(t, w)
-	assert.IsType(t, &os.File{}, w.w)
+	assert.IsType(t, &rotatingFile{}, w.w)
+
+	rf := w.w.(*rotatingFile)
+	assert.Equal(t, int64(1024), rf.maxSize)
+	assert.Equal(t, time.Hour, rf.interval)
+	assert.Equal(t, 5, rf.keep)
+	assert.True(t, rf.compress)
+	rf.Close()
 }
 
 func Test_createSyslogOutput(t *testing.T) {
@@ -210,6 +315,43 @@ func Test_createSyslogOutput(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, w)
 	assert.IsType(t, &syslog.Writer{}, w.w)
+
+	// format error
+	c.Set("output.syslog.format", "json")
+	w, err = createSyslogOutput(c)
+	assert.EqualError(t, err, "output.syslog.format must be bsd or rfc5424, `json` provided")
+	assert.Nil(t, w)
+
+	// rfc5424 errors
+	c.Set("output.syslog.format", "rfc5424")
+	c.Set("output.syslog.network", "unixgram")
+	w, err = createSyslogOutput(c)
+	assert.EqualError(t, err, "Failed to open syslog writer. Error: RFC 5424 syslog network must be tcp or tls, `unixgram` provided")
+	assert.Nil(t, w)
+
+	c.Set("output.syslog.network", "tls")
+	c.Set("output.syslog.tls.ca", "/do/not/exist")
+	w, err = createSyslogOutput(c)
+	assert.EqualError(t, err, "Failed to configure syslog TLS. Error: Failed to read the CA bundle. Error: open /do/not/exist: no such file or directory")
+	assert.Nil(t, w)
+
+	// All good rfc5424
+	c.Set("output.syslog.network", "tcp")
+	c.Set("output.syslog.priority", 132)
+	c.Set("output.syslog.reconnect.min_backoff", "2s")
+	c.Set("output.syslog.timeout", "5s")
+	w, err = createSyslogOutput(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+	assert.IsType(t, &rfc5424Writer{}, w.w)
+
+	rw := w.w.(*rfc5424Writer)
+	assert.Equal(t, time.Second*2, rw.minBackoff)
+	assert.Equal(t, RFC5424_MAX_BACKOFF, rw.maxBackoff)
+	assert.Equal(t, time.Second*5, rw.timeout)
+	hostname, _ := os.Hostname()
+	assert.Equal(t, headerField(hostname, 255), rw.hostname)
+	rw.Close()
 }
 
 func Test_createStdOutOutput(t *testing.T) {
@@ -229,6 +371,352 @@ func Test_createStdOutOutput(t *testing.T) {
 	assert.IsType(t, &os.File{}, w.w)
 }
 
+func Test_createHTTPOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.http.attempts", 0)
+	w, err := createHTTPOutput(c)
+	assert.EqualError(t, err, "Output attempts for http must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// auth error
+	c.Set("output.http.attempts", 1)
+	c.Set("output.http.auth.bearer_token", "token")
+	c.Set("output.http.auth.username", "user")
+	w, err = createHTTPOutput(c)
+	assert.EqualError(t, err, "output.http.auth can have a bearer_token or a username and password, not both")
+	assert.Nil(t, w)
+
+	// tls error
+	c.Set("output.http.auth.username", "")
+	c.Set("output.http.tls.ca", "/do/not/exist")
+	w, err = createHTTPOutput(c)
+	assert.EqualError(t, err, "Failed to configure output.http TLS. Error: Failed to read the CA bundle. Error: open /do/not/exist: no such file or directory")
+	assert.Nil(t, w)
+
+	// format error
+	c.Set("output.http.tls.ca", "")
+	c.Set("output.http.format", "xml")
+	w, err = createHTTPOutput(c)
+	assert.EqualError(t, err, "output.http.format must be ndjson or array, `xml` provided")
+	assert.Nil(t, w)
+
+	// writer error
+	c.Set("output.http.format", "")
+	w, err = createHTTPOutput(c)
+	assert.EqualError(t, err, "Failed to create the http writer. Error: A url is required")
+	assert.Nil(t, w)
+
+	// All good
+	c.Set("output.http.url", "https://localhost/ingest")
+	c.Set("output.http.headers", map[string]string{"X-Source": "go-audit"})
+	c.Set("output.http.batch.max_events", 10)
+	c.Set("output.http.retry.max_backoff", "1m")
+	c.Set("output.http.retry.max_retry_after", "10m")
+	w, err = createHTTPOutput(c)
+	assert.Nil(t, err)
+	assert.IsType(t, &httpWriter{}, w.w)
+
+	hw := w.w.(*httpWriter)
+	assert.Equal(t, ndjsonFormat{}, hw.format)
+	assert.Equal(t, 10, hw.maxEvents)
+	assert.Equal(t, HTTP_MAX_BYTES, hw.maxBytes)
+	assert.Equal(t, time.Minute, hw.maxBackoff)
+	assert.Equal(t, time.Minute*10, hw.maxRetryAfter)
+	assert.Equal(t, map[string]string{"X-Source": "go-audit", "Authorization": "Bearer token"}, hw.headers)
+	hw.Close()
+
+	c.Set("output.http.auth.bearer_token", "")
+	c.Set("output.http.auth.username", "user")
+	c.Set("output.http.auth.password", "pass")
+	c.Set("output.http.format", "array")
+	w, err = createHTTPOutput(c)
+	assert.Nil(t, err)
+
+	hw = w.w.(*httpWriter)
+	assert.Equal(t, arrayFormat{}, hw.format)
+	assert.Equal(t, "Basic dXNlcjpwYXNz", hw.headers["Authorization"])
+	hw.Close()
+}
+
+func Test_createElasticsearchOutput(t *testing.T) {
+	lb, _ := hookLogger()
+	defer resetLogger()
+
+	// attempts error
+	c := viper.New()
+	c.Set("output.elasticsearch.attempts", 0)
+	w, err := createElasticsearchOutput(c)
+	assert.EqualError(t, err, "Output attempts for elasticsearch must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// url error
+	c.Set("output.elasticsearch.attempts", 1)
+	w, err = createElasticsearchOutput(c)
+	assert.EqualError(t, err, "output.elasticsearch.url must be set")
+	assert.Nil(t, w)
+
+	// index error
+	templates := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		templates++
+	}))
+	defer s.Close()
+
+	c.Set("output.elasticsearch.url", s.URL+"/")
+	c.Set("output.elasticsearch.index", "")
+	w, err = createElasticsearchOutput(c)
+	assert.EqualError(t, err, "output.elasticsearch.index can not be empty")
+	assert.Nil(t, w)
+
+	// template error
+	c.Set("output.elasticsearch.index", "audit-{2006}")
+	c.Set("output.elasticsearch.template.install", true)
+	w, err = createElasticsearchOutput(c)
+	assert.EqualError(t, err, "output.elasticsearch.template.path must be set to install a template")
+	assert.Nil(t, w)
+
+	c.Set("output.elasticsearch.template.path", "/do/not/exist")
+	w, err = createElasticsearchOutput(c)
+	assert.EqualError(t, err, "Failed to install the elasticsearch template. Error: open /do/not/exist: no such file or directory")
+	assert.Nil(t, w)
+
+	// All good
+	file := createTempFile(t, "template.json", "{}")
+	defer os.Remove(file)
+
+	c.Set("output.elasticsearch.template.path", file)
+	c.Set("output.elasticsearch.pipeline", "geo ip")
+	c.Set("output.elasticsearch.document_type", "event")
+	w, err = createElasticsearchOutput(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, templates)
+	assert.Equal(t, "Installed the elasticsearch template go-audit\n", lb.String())
+
+	hw := w.w.(*httpWriter)
+	assert.Equal(t, s.URL+"/_bulk?pipeline=geo+ip", hw.url)
+	assert.Equal(t, elasticsearchFormat{index: "audit-{2006}", docType: "event"}, hw.format)
+	hw.Close()
+}
+
+func Test_createSplunkOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.splunk_hec.attempts", 0)
+	w, err := createSplunkOutput(c)
+	assert.EqualError(t, err, "Output attempts for splunk_hec must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// url error
+	c.Set("output.splunk_hec.attempts", 1)
+	w, err = createSplunkOutput(c)
+	assert.EqualError(t, err, "output.splunk_hec.url must be set")
+	assert.Nil(t, w)
+
+	// token error
+	c.Set("output.splunk_hec.url", "https://splunk:8088/")
+	w, err = createSplunkOutput(c)
+	assert.EqualError(t, err, "output.splunk_hec.token must be set")
+	assert.Nil(t, w)
+
+	// ack error
+	c.Set("output.splunk_hec.token", "abc")
+	c.Set("output.splunk_hec.ack.enabled", true)
+	c.Set("output.splunk_hec.ack.max_pending", 0)
+	w, err = createSplunkOutput(c)
+	assert.EqualError(t, err, "output.splunk_hec.ack timeout, max_pending and interval must be greater than 0")
+	assert.Nil(t, w)
+
+	// Defaults
+	c.Set("output.splunk_hec.ack.enabled", false)
+	w, err = createSplunkOutput(c)
+	assert.Nil(t, err)
+
+	host, _ := os.Hostname()
+	hw := w.w.(*httpWriter)
+	assert.Equal(t, "https://splunk:8088/services/collector/event", hw.url)
+	assert.Equal(t, "Splunk abc", hw.headers["Authorization"])
+	assert.Equal(t, newSplunkFormat(host, "go-audit", "go-audit", ""), hw.format)
+	hw.Close()
+
+	// All good
+	c.Set("shutdown.timeout", "10s")
+	c.Set("output.splunk_hec.ack.enabled", true)
+	c.Set("output.splunk_hec.ack.max_pending", 10)
+	c.Set("output.splunk_hec.host", "host-1")
+	c.Set("output.splunk_hec.source", "audit")
+	c.Set("output.splunk_hec.sourcetype", "linux:audit")
+	c.Set("output.splunk_hec.index", "main")
+	w, err = createSplunkOutput(c)
+	assert.Nil(t, err)
+
+	hw = w.w.(*httpWriter)
+	f := hw.format.(*splunkFormat)
+	assert.Equal(t, "host-1", f.host)
+	assert.Equal(t, "audit", f.source)
+	assert.Equal(t, "linux:audit", f.sourcetype)
+	assert.Equal(t, "main", f.index)
+	assert.Equal(t, 10, f.maxPending)
+	assert.Equal(t, SPLUNK_ACK_TIMEOUT, f.ackTimeout)
+	assert.Equal(t, time.Second*5, f.closeWait, "Waiting for acks on close should take half the shutdown timeout")
+	assert.Equal(t, "https://splunk:8088/services/collector/ack?channel="+f.channel, f.ackURL)
+	assert.Equal(t, f.channel, hw.headers["X-Splunk-Request-Channel"])
+	hw.Close()
+}
+
+func Test_createKafkaOutput(t *testing.T) {
+	// attempts error
+	c := viper.New()
+	c.Set("output.kafka.attempts", 0)
+	w, err := createKafkaOutput(c)
+	assert.EqualError(t, err, "Output attempts for kafka must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	// brokers error
+	c.Set("output.kafka.attempts", 1)
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "output.kafka.brokers must be set")
+	assert.Nil(t, w)
+
+	// topic error
+	c.Set("output.kafka.brokers", []string{"kafka-1:9092", "kafka-2:9092"})
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "output.kafka.topic must be set")
+	assert.Nil(t, w)
+
+	// retry error
+	c.Set("output.kafka.topic", "audit")
+	c.Set("output.kafka.retry.max_retries", -1)
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "output.kafka.retry max_retries must be 0 or more and min_backoff must be greater than 0 and no more than max_backoff")
+	assert.Nil(t, w)
+
+	// acks error
+	c.Set("output.kafka.retry.max_retries", 2)
+	c.Set("output.kafka.acks", "some")
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "output.kafka.acks must be none, leader or all, `some` provided")
+	assert.Nil(t, w)
+
+	// compression error
+	c.Set("output.kafka.acks", "leader")
+	c.Set("output.kafka.compression", "snappy")
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "output.kafka.compression must be none or gzip, `snappy` provided")
+	assert.Nil(t, w)
+
+	// tls error
+	c.Set("output.kafka.compression", "gzip")
+	c.Set("output.kafka.tls.enabled", true)
+	c.Set("output.kafka.tls.ca", "/do/not/exist")
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "Failed to configure output.kafka TLS. Error: Failed to read the CA bundle. Error: open /do/not/exist: no such file or directory")
+	assert.Nil(t, w)
+
+	// sasl error
+	c.Set("output.kafka.tls.ca", "")
+	c.Set("output.kafka.sasl.mechanism", "gssapi")
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "output.kafka.sasl.mechanism must be plain, scram-sha-256 or scram-sha-512, `gssapi` provided")
+	assert.Nil(t, w)
+
+	// key error
+	c.Set("output.kafka.sasl.mechanism", "scram-sha-512")
+	c.Set("output.kafka.sasl.username", "audit")
+	c.Set("output.kafka.sasl.password", "secret")
+	c.Set("output.kafka.key", "pid")
+	w, err = createKafkaOutput(c)
+	assert.EqualError(t, err, "Failed to create the kafka writer. Error: Key must be one of none, hostname, auid or syscall, `pid` provided")
+	assert.Nil(t, w)
+
+	// All good
+	c.Set("output.kafka.key", "hostname")
+	c.Set("output.kafka.batch.max_events", 100)
+	w, err = createKafkaOutput(c)
+	assert.Nil(t, err)
+
+	host, _ := os.Hostname()
+	kw := w.w.(*kafkaWriter)
+	assert.Equal(t, host, kw.hostname)
+	assert.Equal(t, 100, kw.maxEvents)
+
+	assert.Equal(t, []string{"kafka-1:9092", "kafka-2:9092"}, kw.brokers)
+	assert.Equal(t, "audit", kw.topic)
+	assert.Equal(t, int16(1), kw.acks)
+	assert.Equal(t, KAFKA_COMPRESSION_GZIP, kw.compression)
+	assert.Equal(t, 2, kw.maxRetries)
+	assert.Equal(t, "go-audit", kw.clientID)
+	assert.NotNil(t, kw.tls)
+	assert.Equal(t, KAFKA_SASL_SCRAM_SHA_512, kw.saslMechanism)
+	assert.Equal(t, "audit", kw.saslUsername)
+	assert.Equal(t, "secret", kw.saslPassword)
+
+	// The client produces with the same settings
+	p := kw.producer.(*kafkaClient)
+	assert.Equal(t, kw.kafkaConfig, p.kafkaConfig)
+	kw.Close()
+}
+
+func Test_createFilters(t *testing.T) {
+	c := viper.New()
+	c.Set("filters", []interface{}{
+		map[interface{}]interface{}{"syscall": "connect", "cidr": []interface{}{"127.0.0.0/8", "::1"}},
+		map[interface{}]interface{}{"syscall": 49, "family": "inet6", "port": 443, "regex": "saddr="},
+	})
+
+	f, err := createFilters(c, "filters")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(f))
+	assert.Equal(t, "connect", f[0].syscall)
+	assert.Equal(t, uint16(1306), f[0].messageType, "Sockaddr filters should default to SOCKADDR messages")
+	assert.Equal(t, "127.0.0.0/8", f[0].cidrs[0].String())
+	assert.Equal(t, "::1/128", f[0].cidrs[1].String())
+	assert.Equal(t, "inet6", f[1].family)
+	assert.Equal(t, 443, f[1].port)
+	assert.Equal(t, "saddr=", f[1].regex.String())
+
+	// errors
+	var ts = []struct {
+		filter map[interface{}]interface{}
+		err    string
+	}{
+		{map[interface{}]interface{}{"syscall": "nope", "regex": "a"}, "`syscall` in filter 1 is not a known syscall name nope"},
+		{map[interface{}]interface{}{"syscall": 1.5, "regex": "a"}, "`syscall` in filter 1 could not be parsed 1.5"},
+		{map[interface{}]interface{}{"message_type": "abc", "regex": "a"}, "`message_type` in filter 1 could not be parsed abc strconv.ParseUint: parsing \"abc\": invalid syntax"},
+		{map[interface{}]interface{}{"regex": "("}, "`regex` in filter 1 could not be parsed ( error parsing regexp: missing closing ): `(`"},
+		{map[interface{}]interface{}{"family": "ipx"}, "`family` in filter 1 must be one of inet, inet6, unix or netlink ipx"},
+		{map[interface{}]interface{}{"port": 70000}, "`port` in filter 1 could not be parsed 70000"},
+		{map[interface{}]interface{}{"cidr": "10.0.0.0/99"}, "`cidr` in filter 1 could not be parsed 10.0.0.0/99 invalid CIDR address: 10.0.0.0/99"},
+		{map[interface{}]interface{}{"syscall": 49}, "Filter 1 must have a `regex` or one of `family`, `cidr` or `port`"},
+	}
+
+	for _, ta := range ts {
+		c.Set("filters", []interface{}{ta.filter})
+		f, err := createFilters(c, "filters")
+		assert.EqualError(t, err, ta.err)
+		assert.Nil(t, f)
+	}
+}
+
+func Test_parseCIDR(t *testing.T) {
+	cidr, err := parseCIDR("10.0.0.0/8")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.0/8", cidr.String())
+
+	cidr, err = parseCIDR("10.1.2.3")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.1.2.3/32", cidr.String())
+
+	_, err = parseCIDR("10.0.0.0/33")
+	assert.EqualError(t, err, "invalid CIDR address: 10.0.0.0/33")
+
+	_, err = parseCIDR("nope")
+	assert.EqualError(t, err, "Invalid address nope")
+
+	_, err = parseCIDR(10)
+	assert.EqualError(t, err, "Not a string")
+}
+
 func Test_createOutput(t *testing.T) {
 	// no outputs
 	c := viper.New()
@@ -267,9 +755,19 @@ func Test_createOutput(t *testing.T) {
 	c.Set("output.file.user", u.Username)
 	c.Set("output.file.group", g.Name)
 
+	c.Set("output.file.filters", []interface{}{
+		map[interface{}]interface{}{"syscall": 49, "message_type": 1306, "regex": "saddr=(10..|0A..)"},
+	})
+
 	w, err = createOutput(c)
-	assert.EqualError(t, err, "Only one output can be enabled at a time")
-	assert.Nil(t, w)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(w), "Expected both outputs")
+	assert.Equal(t, "syslog", w[0].name)
+	assert.IsType(t, &syslog.Writer{}, w[0].writer.w)
+	assert.Equal(t, 0, len(w[0].filters), "syslog should not have any filters")
+	assert.Equal(t, "file", w[1].name)
+	assert.IsType(t, &rotatingFile{}, w[1].writer.w)
+	assert.Equal(t, 1, len(w[1].filters["49"][1306]), "file should have its filter")
 
 	// syslog error
 	c = viper.New()
@@ -297,13 +795,14 @@ func Test_createOutput(t *testing.T) {
 
 	// All good syslog
 	c = viper.New()
+	c.Set("output.syslog.enabled", true)
 	c.Set("output.syslog.attempts", 1)
 	c.Set("output.syslog.network", "tcp")
 	c.Set("output.syslog.address", l.Addr().String())
-	w, err = createSyslogOutput(c)
+	w, err = createOutput(c)
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
-	assert.IsType(t, &syslog.Writer{}, w.w)
+	assert.Equal(t, 1, len(w))
+	assert.IsType(t, &syslog.Writer{}, w[0].writer.w)
 
 	// All good file
 	c = viper.New()
@@ -315,9 +814,9 @@ func Test_createOutput(t *testing.T) {
 	c.Set("output.file.group", g.Name)
 	w, err = createOutput(c)
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
-	assert.IsType(t, &AuditWriter{}, w)
-	assert.IsType(t, &os.File{}, w.w)
+	assert.Equal(t, 1, len(w))
+	assert.IsType(t, &AuditWriter{}, w[0].writer)
+	assert.IsType(t, &rotatingFile{}, w[0].writer.w)
 
 	// File rotation
 	os.Rename(path.Join(os.TempDir(), "go-audit.test.log"), path.Join(os.TempDir(), "go-audit.test.log.rotated"))
@@ -329,8 +828,68 @@ func Test_createOutput(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func Test_createOutput_list(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	conf := "output:\n  stdout:\n    enabled: true\n    attempts: 1\n" +
+		"outputs:\n" +
+		"  - type: syslog\n    network: tcp\n    address: \"" + l.Addr().String() + "\"\n" +
+		"  - type: stdout\n    name: stdout-execve\n    attempts: 2\n" +
+		"    filters:\n      - syscall: 59\n        message_type: 1300\n        regex: drop\n" +
+		"  - type: stdout\n    name: stdout-off\n    enabled: false\n    attempts: 1\n"
+
+	// The output.<type> keys come first, list entries get the same defaults and their own filters
+	c, err := loadConfig(createTempFile(t, "outputs.yaml", conf))
+	assert.Nil(t, err)
+	w, err := createOutput(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(w), "The disabled entry should be left out")
+	defer closeOutputs(w)
+
+	assert.Equal(t, "stdout", w[0].name)
+	assert.Equal(t, 1, w[0].writer.attempts)
+	assert.Equal(t, 0, len(w[0].filters))
+
+	assert.Equal(t, "syslog", w[1].name)
+	assert.IsType(t, &syslog.Writer{}, w[1].writer.w)
+	assert.Equal(t, 3, w[1].writer.attempts, "attempts should default like output.syslog.attempts")
+
+	assert.Equal(t, "stdout-execve", w[2].name)
+	assert.Equal(t, 2, w[2].writer.attempts)
+	assert.Equal(t, 1, len(w[2].filters["59"][1300]), "The entry should have its filter")
+
+	// Entries share the shutdown timeout so outputs that wait on close stay within it
+	list, err := outputList(c)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second*5, list[0].config.GetDuration("shutdown.timeout"))
+
+	var ts = []struct {
+		outputs string
+		err     string
+	}{
+		{"  - type: stdout\n    attempts: 1\n", "Output name `stdout` is used more than once, give the outputs in the list a unique name"},
+		{"  - type: pigeon\n", "Failed to create the pigeon output in outputs. Error: Output type must be one of syslog, file, stdout, http, elasticsearch, splunk_hec, kafka, `pigeon` provided"},
+		{"  - name: nameless\n", "outputs entry 1 must have a type and the name can not be empty"},
+		{"  - type: stdout\n    name: other\n    attempts: 0\n", "Failed to create the other output in outputs. Error: Output attempts for stdout must be at least 1, 0 provided"},
+		{"  - stdout\n", "outputs entry 1 must be a map of settings"},
+	}
+
+	for i, ta := range ts {
+		c, err := loadConfig(createTempFile(t, "outputs.yaml", "output:\n  stdout:\n    enabled: true\n    attempts: 1\noutputs:\n"+ta.outputs))
+		assert.Nil(t, err)
+		w, err := createOutput(c)
+		assert.EqualError(t, err, ta.err, "For test %d", i+1)
+		assert.Nil(t, w)
+	}
+}
+
 func Benchmark_MultiPacketMessage(b *testing.B) {
-	marshaller := NewAuditMarshaller(NewAuditWriter(&noopWriter{}, 1), uint16(1300), uint16(1399), false, false, 1, []AuditFilter{}, StatsdConfig{kind: "none"})
+	marshaller := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(&noopWriter{}, 1), nil)}, uint16(1300), uint16(1399), false, false, 1, []AuditFilter{}, StatsdConfig{kind: "none"}, false, COMPLETE_AFTER)
 
 	data := make([][]byte, 6)
 
@@ -370,6 +929,448 @@ func Benchmark_MultiPacketMessage(b *testing.B) {
 	}
 }
 
+func Benchmark_Receive(b *testing.B) {
+	benchmarkReceive(b, func(n *NetlinkClient) int {
+		if _, err := n.Receive(); err != nil {
+			b.Fatal("Failed to receive:", err)
+		}
+		return 1
+	})
+}
+
+func Benchmark_ReceiveBatch(b *testing.B) {
+	benchmarkReceive(b, func(n *NetlinkClient) int {
+		batch, err := n.ReceiveBatch()
+		if err != nil {
+			b.Fatal("Failed to receive:", err)
+		}
+
+		count := len(batch.Msgs)
+		batch.Free()
+		return count
+	})
+}
+
+// Sends b.N syscall records to a test socket while receive reads them, receive returns how many it read
+func benchmarkReceive(b *testing.B, receive func(n *NetlinkClient) int) {
+	n := makeNelinkClient(b)
+	defer syscall.Close(n.fd)
+
+	data := []byte(`audit(1459376866.885:1222763): arch=c000003e syscall=59 success=yes exit=0 a0=cc4e68 a1=d10bc8 a2=c69808 a3=7fff2a700900 items=2 ppid=11552 pid=11623 auid=1000 uid=1000 gid=1000 euid=1000 suid=1000 fsuid=1000 egid=1000 sgid=1000 fsgid=1000 tty=pts0 ses=35 comm="ls" exe="/bin/ls" key=(null)`)
+	packet := make([]byte, syscall.SizeofNlMsghdr+len(data))
+	Endianness.PutUint32(packet[0:4], uint32(len(packet)))
+	Endianness.PutUint16(packet[4:6], 1300)
+	copy(packet[syscall.SizeofNlMsghdr:], data)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Sending blocks while the socket is full so this runs alongside the receiving
+	go func() {
+		for i := 0; i < b.N; i++ {
+			syscall.Sendto(n.fd, packet, 0, n.address)
+		}
+	}()
+
+	for received := 0; received < b.N; {
+		received += receive(n)
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
+
+func Test_isMulticast(t *testing.T) {
+	c := viper.New()
+	c.SetDefault("socket.mode", "unicast")
+
+	m, err := isMulticast(c)
+	assert.Nil(t, err)
+	assert.False(t, m)
+
+	c.Set("socket.mode", "multicast")
+	m, err = isMulticast(c)
+	assert.Nil(t, err)
+	assert.True(t, m)
+
+	c.Set("socket.mode", "broadcast")
+	_, err = isMulticast(c)
+	assert.EqualError(t, err, "socket.mode must be unicast or multicast, `broadcast` provided")
+}
+
+func Test_createSpoolConfig(t *testing.T) {
+	c := viper.New()
+
+	sc, err := createSpoolConfig(c, "syslog")
+	assert.Nil(t, err)
+	assert.Nil(t, sc, "Spooling should be off by default")
+
+	c.Set("output.syslog.spool.enabled", true)
+	c.Set("output.syslog.spool.path", "/var/spool/go-audit")
+	sc, err = createSpoolConfig(c, "syslog")
+	assert.Nil(t, err)
+	assert.Equal(t, &spoolConfig{dir: "/var/spool/go-audit", maxSize: SPOOL_MAX_SIZE, segmentSize: SPOOL_SEGMENT_SIZE, overflow: SPOOL_DROP_OLDEST, retryInterval: SPOOL_RETRY_INTERVAL}, sc)
+
+	c.Set("output.syslog.spool.max_size", 2048)
+	c.Set("output.syslog.spool.segment_size", 1024)
+	c.Set("output.syslog.spool.overflow", "block")
+	c.Set("output.syslog.spool.retry_interval", "1s")
+	sc, err = createSpoolConfig(c, "syslog")
+	assert.Nil(t, err)
+	assert.Equal(t, &spoolConfig{dir: "/var/spool/go-audit", maxSize: 2048, segmentSize: 1024, overflow: SPOOL_BLOCK, retryInterval: time.Second}, sc)
+
+	var ts = []struct {
+		key   string
+		value interface{}
+		err   string
+	}{
+		{"path", "", "output.syslog.spool.path must be set when the spool is enabled"},
+		{"max_size", 0, "output.syslog.spool.max_size must be greater than 0, 0 provided"},
+		{"segment_size", 4096, "output.syslog.spool.segment_size must be greater than 0 and no more than max_size, 4096 provided"},
+		{"overflow", "wait", "output.syslog.spool.overflow must be one of drop_oldest, drop_newest or block, `wait` provided"},
+		{"retry_interval", "0s", "output.syslog.spool.retry_interval must be greater than 0, 0s provided"},
+	}
+
+	for _, tc := range ts {
+		old := c.Get("output.syslog.spool." + tc.key)
+		c.Set("output.syslog.spool."+tc.key, tc.value)
+		_, err := createSpoolConfig(c, "syslog")
+		assert.EqualError(t, err, tc.err)
+		c.Set("output.syslog.spool."+tc.key, old)
+	}
+}
+
+func Test_queueSizes(t *testing.T) {
+	c := viper.New()
+	c.Set("pipeline.parse_queue", 32)
+	c.Set("pipeline.write_queue", 4096)
+	c.Set("pipeline.output_queue", 1024)
+
+	parse, write, output, err := queueSizes(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, parse)
+	assert.Equal(t, 4096, write)
+	assert.Equal(t, 1024, output)
+
+	c.Set("pipeline.output_queue", 0)
+	_, _, _, err = queueSizes(c)
+	assert.EqualError(t, err, "pipeline.output_queue must be greater than 0, 0 provided")
+
+	c.Set("pipeline.write_queue", 0)
+	_, _, _, err = queueSizes(c)
+	assert.EqualError(t, err, "pipeline.write_queue must be greater than 0, 0 provided")
+
+	c.Set("pipeline.parse_queue", -1)
+	_, _, _, err = queueSizes(c)
+	assert.EqualError(t, err, "pipeline.parse_queue must be greater than 0, -1 provided")
+}
+
+func Test_reportInterval(t *testing.T) {
+	c := viper.New()
+	c.SetDefault("pipeline.report_interval", time.Second*10)
+
+	i, err := reportInterval(c)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second*10, i)
+
+	c.Set("pipeline.report_interval", "0s")
+	_, err = reportInterval(c)
+	assert.EqualError(t, err, "pipeline.report_interval must be greater than 0, 0s provided")
+}
+
+func Test_pidStolenPolicy(t *testing.T) {
+	c := viper.New()
+	c.SetDefault("kernel_status.pid_stolen", "reclaim")
+
+	p, err := pidStolenPolicy(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "reclaim", p)
+
+	for _, v := range []string{"exit", "multicast"} {
+		c.Set("kernel_status.pid_stolen", v)
+		p, err = pidStolenPolicy(c)
+		assert.Nil(t, err)
+		assert.Equal(t, v, p)
+	}
+
+	c.Set("kernel_status.pid_stolen", "ignore")
+	_, err = pidStolenPolicy(c)
+	assert.EqualError(t, err, "kernel_status.pid_stolen must be one of reclaim, exit or multicast, `ignore` provided")
+}
+
+func Test_configureKernel(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	c := &fakeRuleClient{}
+	config := viper.New()
+	config.Set("audit.backlog_limit", 100)
+	config.Set("rules", []string{"-a always,exit -S execve"})
+
+	// multicast readers leave the kernel alone
+	assert.Nil(t, configureKernel(config, c, true))
+	assert.Equal(t, 0, len(c.executed))
+	assert.Equal(t, "Reading events from the multicast group, audit settings and rules are left to the audit daemon\n", lb.String())
+
+	assert.Nil(t, configureKernel(config, c, false))
+	assert.Equal(t, []uint16{AUDIT_SET, AUDIT_ADD_RULE}, c.executed)
+	assert.Equal(t, "", elb.String())
+
+	// the settings are put back if the rules fail
+	lb.Reset()
+	c = &fakeRuleClient{status: AuditStatusPayload{BacklogLimit: 64}, execErr: map[uint16]error{AUDIT_ADD_RULE: errors.New("testing rule")}}
+	assert.EqualError(t, configureKernel(config, c, false), "Failed to add rule #1. Error: testing rule")
+	assert.Equal(t, []uint16{AUDIT_SET, AUDIT_SET}, c.executed)
+	assert.Equal(t, &AuditStatusPayload{Mask: AUDIT_STATUS_BACKLOG_LIMIT, BacklogLimit: 64}, c.payloads[1])
+	assert.Equal(t, "Set audit backlog_limit to 100, was 64\nPut the old audit settings back\n", lb.String())
+
+	// and said so when they can't be
+	c = &fakeRuleClient{
+		status:    AuditStatusPayload{BacklogLimit: 64},
+		execErr:   map[uint16]error{AUDIT_ADD_RULE: errors.New("testing rule"), AUDIT_SET: syscall.EPERM},
+		execErrAt: map[uint16]int{AUDIT_SET: 2},
+	}
+	assert.EqualError(t, configureKernel(config, c, false), "Failed to add rule #1. Error: testing rule. Failed to put the old audit settings back, they are still changed. Error: operation not permitted")
+}
+
+func Test_setAuditStatus(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	// nothing configured, nothing done
+	c := &fakeRuleClient{}
+	_, err := setAuditStatus(viper.New(), c)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(c.executed))
+
+	config := viper.New()
+	config.Set("audit.failure_mode", "panic")
+	config.Set("audit.backlog_limit", 8192)
+	config.Set("audit.rate_limit", 0)
+	config.Set("audit.backlog_wait_time", "60000")
+
+	// only the settings that differ are sent
+	c = &fakeRuleClient{status: AuditStatusPayload{Failure: AUDIT_FAIL_PRINTK, BacklogLimit: 64, BacklogWaitTime: 60000}}
+	undo, err := setAuditStatus(config, c)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{AUDIT_SET}, c.executed)
+	assert.Equal(
+		t,
+		&AuditStatusPayload{Mask: AUDIT_STATUS_FAILURE | AUDIT_STATUS_BACKLOG_LIMIT, Failure: AUDIT_FAIL_PANIC, BacklogLimit: 8192, BacklogWaitTime: 60000},
+		c.payloads[0],
+	)
+	assert.Equal(t, "Set audit failure_mode to 2, was 1\nSet audit backlog_limit to 8192, was 64\n", lb.String())
+
+	// what changed can be put back
+	assert.Equal(
+		t,
+		&AuditStatusPayload{Mask: AUDIT_STATUS_FAILURE | AUDIT_STATUS_BACKLOG_LIMIT, Failure: AUDIT_FAIL_PRINTK, BacklogLimit: 64, BacklogWaitTime: 60000},
+		undo,
+	)
+
+	// already in place, even when locked
+	lb.Reset()
+	c = &fakeRuleClient{status: AuditStatusPayload{Enabled: AUDIT_LOCKED, Failure: AUDIT_FAIL_PANIC, BacklogLimit: 8192, BacklogWaitTime: 60000}}
+	undo, err = setAuditStatus(config, c)
+	assert.Nil(t, err)
+	assert.Nil(t, undo)
+	assert.Equal(t, 0, len(c.executed))
+	assert.Equal(t, "", lb.String())
+
+	// locked and different
+	c = &fakeRuleClient{status: AuditStatusPayload{Enabled: AUDIT_LOCKED, Failure: AUDIT_FAIL_PANIC, BacklogLimit: 64, BacklogWaitTime: 60000}}
+	_, err = setAuditStatus(config, c)
+	assert.EqualError(t, err, "Audit is locked (-e 2) and backlog_limit can not be changed from 64 to 8192. A reboot is required")
+	assert.Equal(t, 0, len(c.executed))
+
+	// kernel errors
+	c = &fakeRuleClient{statusErr: errors.New("nope")}
+	_, err = setAuditStatus(config, c)
+	assert.EqualError(t, err, "Failed to get the audit status. Error: nope")
+
+	c = &fakeRuleClient{execErr: map[uint16]error{AUDIT_SET: syscall.EPERM}}
+	_, err = setAuditStatus(config, c)
+	assert.EqualError(t, err, "Failed to set the audit status. Error: operation not permitted")
+
+	// bad values
+	config.Set("audit.failure_mode", "loud")
+	_, err = setAuditStatus(config, c)
+	assert.EqualError(t, err, "audit.failure_mode must be one of silent, printk or panic, `loud` provided")
+
+	config.Set("audit.failure_mode", "silent")
+	config.Set("audit.rate_limit", -1)
+	_, err = setAuditStatus(config, c)
+	assert.EqualError(t, err, "audit.rate_limit must be a number 0 or greater, `-1` provided")
+	assert.Equal(t, "", elb.String())
+}
+
+// Records the requests setRules makes instead of sending them to the kernel
+type fakeRuleClient struct {
+	rules     [][]byte
+	listErr   error
+	status    AuditStatusPayload
+	statusErr error
+	execErr   map[uint16]error
+	execErrAt map[uint16]int // Only the nth request of a type gets execErr, every one does if unset
+	sent      map[uint16]int
+	executed  []uint16
+	payloads  []interface{}
+}
+
+func (f *fakeRuleClient) Execute(msgType uint16, payload interface{}) error {
+	if f.sent == nil {
+		f.sent = map[uint16]int{}
+	}
+	f.sent[msgType]++
+
+	if err, ok := f.execErr[msgType]; ok {
+		if at, ok := f.execErrAt[msgType]; !ok || at == f.sent[msgType] {
+			return err
+		}
+	}
+
+	f.executed = append(f.executed, msgType)
+	f.payloads = append(f.payloads, payload)
+	return nil
+}
+
+func (f *fakeRuleClient) ListRules() ([][]byte, error) {
+	return f.rules, f.listErr
+}
+
+func (f *fakeRuleClient) GetStatus() (*AuditStatusPayload, error) {
+	return &f.status, f.statusErr
+}
+
+func Test_shutdown(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	n := makeNelinkClient(t)
+	setReceiveTimeout(t, n, time.Millisecond*10)
+
+	w := &closeWriter{}
+	outputs := []*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}
+	m := NewAuditMarshaller(outputs, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, time.Hour)
+
+	// One group already received but waiting to be consumed and one still queued on the socket, neither has an EOE
+	p := newPipeline(m, 1, 1, 1)
+	p.receive(&Batch{Msgs: []*syscall.NetlinkMessage{{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:1): one")}}})
+	queueNetlinkMessage(t, n, 1300, 0, []byte("audit(10000001:2): two"))
+
+	assert.Nil(t, shutdown(n, m, p, time.Second))
+	assert.Contains(t, w.String(), "\"sequence\":1,")
+	assert.Contains(t, w.String(), "\"sequence\":2,")
+	assert.Equal(t, 2, strings.Count(w.String(), "\"completed_by\":\"shutdown\""))
+	assert.True(t, w.closed, "The output should have been closed")
+	assert.Equal(t, 0, len(m.msgs))
+	assert.Equal(t, "", lb.String())
+	assert.Equal(t, "", elb.String())
+
+	// outputs that take too long to close
+	n = makeNelinkClient(t)
+	setReceiveTimeout(t, n, time.Millisecond*10)
+
+	w = &closeWriter{block: make(chan struct{})}
+	defer close(w.block)
+	outputs = []*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}
+	m = NewAuditMarshaller(outputs, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, time.Hour)
+
+	assert.EqualError(t, shutdown(n, m, newPipeline(m, 1, 1, 1), time.Millisecond*100), "Timed out after 100ms waiting for events to be written and outputs to close")
+}
+
+func Test_reload(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	w := &closeWriter{}
+	m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}, uint16(1300), uint16(1399), true, false, 10, []AuditFilter{}, StatsdConfig{kind: "none"}, false, time.Hour)
+	m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:5): pending")})
+
+	good := "events:\n  max: 1310\n  complete_after: 1s\n" +
+		"output:\n  stdout:\n    enabled: true\n    attempts: 1\n" +
+		"filters:\n  - syscall: execve\n    message_type: 1300\n    regex: drop\n" +
+		"rules:\n  - -a always,exit -S execve\n"
+
+	// a good config replaces everything but the pending events and sequence tracking
+	c := &fakeRuleClient{}
+	config, err := reload(createTempFile(t, "reload.yaml", good), c, m, false, false)
+	assert.Nil(t, err)
+	assert.NotNil(t, config)
+	assert.True(t, w.closed, "The old output should have been closed")
+	assert.Equal(t, 1, len(m.outputs))
+	assert.Equal(t, "stdout", m.outputs[0].name)
+	assert.Equal(t, uint16(1310), m.eventMax)
+	assert.Equal(t, time.Second, m.completeAfter)
+	assert.Equal(t, 1, len(m.filters["execve"][1300]))
+	assert.Equal(t, []uint16{AUDIT_ADD_RULE}, c.executed)
+	assert.Equal(t, 1, len(m.msgs), "Pending message groups should be kept")
+	assert.Equal(t, 5, m.lastSeq, "Sequence tracking should be kept")
+
+	// bad configs leave everything alone
+	outputs := m.outputs
+	var ts = []struct {
+		config string
+		c      *fakeRuleClient
+		err    string
+	}{
+		{"events: [", &fakeRuleClient{}, "While parsing config: yaml: line 1: did not find expected node content"},
+		{strings.Replace(good, "-S execve", "-S nope", 1), &fakeRuleClient{}, "Failed to parse rule #1. Error: Unknown syscall `nope`"},
+		{strings.Replace(good, "regex: drop", "regex: (", 1), &fakeRuleClient{}, "`regex` in filter 1 could not be parsed ( error parsing regexp: missing closing ): `(`"},
+		{strings.Replace(good, "complete_after: 1s", "complete_after: 0s", 1), &fakeRuleClient{}, "events.complete_after must be at least 100ms, 0s provided"},
+		{strings.Replace(good, "complete_after: 1s", "complete_after: 2", 1), &fakeRuleClient{}, "events.complete_after must be at least 100ms, 2ns provided"},
+		{strings.Replace(good, "enabled: true", "enabled: false", 1), &fakeRuleClient{}, "No outputs were configured"},
+		{good + "kernel_status:\n  pid_stolen: fight\n", &fakeRuleClient{}, "kernel_status.pid_stolen must be one of reclaim, exit or multicast, `fight` provided"},
+		{good + "pipeline:\n  report_interval: 0s\n", &fakeRuleClient{}, "pipeline.report_interval must be greater than 0, 0s provided"},
+		{good, &fakeRuleClient{status: AuditStatusPayload{Enabled: AUDIT_LOCKED}}, "Audit rules are locked (-e 2) and 1 rules would need to change. A reboot is required to change the rules"},
+	}
+
+	for i, ta := range ts {
+		config, err := reload(createTempFile(t, "reload.yaml", ta.config), ta.c, m, false, false)
+		assert.EqualError(t, err, ta.err, "For test %d", i+1)
+		assert.Nil(t, config)
+		assert.Equal(t, outputs, m.outputs, "For test %d", i+1)
+		assert.Equal(t, 0, len(ta.c.executed), "For test %d", i+1)
+	}
+
+	_, err = reload("/does/not/exist.yaml", c, m, false, false)
+	assert.NotNil(t, err)
+
+	// the socket mode is fixed until a restart
+	_, err = reload(createTempFile(t, "reload.yaml", good), c, m, true, false)
+	assert.EqualError(t, err, "socket.mode can not be changed without a restart")
+
+	// multicast readers don't need or touch rules
+	c = &fakeRuleClient{}
+	config, err = reload(createTempFile(t, "reload.yaml", "socket:\n  mode: multicast\noutput:\n  stdout:\n    enabled: true\n    attempts: 1\n"), c, m, true, false)
+	assert.Nil(t, err)
+	assert.NotNil(t, config)
+	assert.Equal(t, 0, len(c.executed))
+	assert.Equal(t, "", elb.String())
+
+	// after falling back to multicast the config still says unicast but the kernel is left alone
+	c = &fakeRuleClient{}
+	config, err = reload(createTempFile(t, "reload.yaml", good), c, m, false, true)
+	assert.Nil(t, err)
+	assert.NotNil(t, config)
+	assert.Equal(t, 0, len(c.executed))
+}
+
+// A writer that records being closed and can block closing until told not to
+type closeWriter struct {
+	bytes.Buffer
+	closed bool
+	block  chan struct{}
+}
+
+func (c *closeWriter) Close() error {
+	if c.block != nil {
+		<-c.block
+	}
+
+	c.closed = true
+	return nil
+}
+
 type noopWriter struct{ t *testing.T }
 
 func (t *noopWriter) Write(a []byte) (int, error) {
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 // Endianness is an alias for what we assume is the current machine endianness
@@ -15,6 +18,41 @@ var Endianness = binary.LittleEndian
 const (
 	// MAX_AUDIT_MESSAGE_LENGTH see http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L398
 	MAX_AUDIT_MESSAGE_LENGTH = 8970
+
+	// ReceiveBatch reads at most this many packets with one recvmmsg call
+	RECEIVE_BATCH_SIZE = 64
+
+	// Receive gives up after this long so callers can notice they should stop, it returns EAGAIN when that happens
+	RECEIVE_TIMEOUT = time.Second
+
+	// Audit control message types, see http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L51
+	AUDIT_GET        = 1000 // Get status
+	AUDIT_SET        = 1001 // Set status (enable/disable/auditd)
+	AUDIT_ADD_RULE   = 1011 // Add syscall filtering rule
+	AUDIT_DEL_RULE   = 1012 // Delete syscall filtering rule
+	AUDIT_LIST_RULES = 1013 // List syscall filtering rules
+
+	// Messages of this type and above are events rather than replies to our requests
+	AUDIT_FIRST_USER_MSG = 1100
+
+	// Multicast group that gets a read only copy of every event, needs kernel 3.16+ and CAP_AUDIT_READ
+	AUDIT_NLGRP_READLOG = 1
+
+	// Bits of AuditStatusPayload.Mask that say which values the kernel should update
+	AUDIT_STATUS_ENABLED           = 0x0001
+	AUDIT_STATUS_FAILURE           = 0x0002
+	AUDIT_STATUS_PID               = 0x0004
+	AUDIT_STATUS_RATE_LIMIT        = 0x0008
+	AUDIT_STATUS_BACKLOG_LIMIT     = 0x0010
+	AUDIT_STATUS_BACKLOG_WAIT_TIME = 0x0020
+
+	// AuditStatusPayload.Failure values, what the kernel does when it can't deliver an event
+	AUDIT_FAIL_SILENT = 0
+	AUDIT_FAIL_PRINTK = 1
+	AUDIT_FAIL_PANIC  = 2
+
+	// AuditStatusPayload.Enabled value when the rules can not be changed until a reboot
+	AUDIT_LOCKED = 2
 )
 
 //TODO: this should live in a marshaller
@@ -35,26 +73,69 @@ type AuditStatusPayload struct {
 type NetlinkPacket syscall.NlMsghdr
 
 type NetlinkClient struct {
-	fd      int
-	address syscall.Sockaddr
-	seq     uint32
-	buf     []byte
+	fd        int
+	address   syscall.Sockaddr
+	multicast bool // Passively reading the multicast group instead of being the audit daemon
+	seq       uint32
+	buf       []byte
+	done      chan struct{}
+	release   sync.Once
+	held      []*syscall.NetlinkMessage // Events that arrived while waiting on a request, Receive returns them first
+	lock      sync.Mutex
+	pending   map[uint32]string // Requests sent without waiting for the ack, keyed by sequence number
+	pool      sync.Pool         // Receive buffers for ReceiveBatch, handed back by Batch.Free
+	mmsgs     []mmsghdr
+	iovs      []syscall.Iovec
+	bufs      []*[]byte // Buffer behind each of mmsgs, nil once it has been handed out in a Batch
+}
+
+// Mirrors the kernels struct mmsghdr used by recvmmsg
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// Batch is a set of events read by ReceiveBatch
+// Msgs point into pooled buffers so Free must be called once they have been consumed, and not before
+type Batch struct {
+	Msgs []*syscall.NetlinkMessage
+	bufs []*[]byte
+	pool *sync.Pool
+}
+
+// Free hands the buffers behind the messages back to the client for reuse
+func (b *Batch) Free() {
+	for _, buf := range b.bufs {
+		b.pool.Put(buf)
+	}
+
+	b.Msgs = nil
+	b.bufs = nil
 }
 
 // NewNetlinkClient creates a new NetLinkClient and optionally tries to modify the netlink recv buffer
-func NewNetlinkClient(recvSize int) *NetlinkClient {
+// A multicast client only listens to the read log group and never claims the audit pid, so it can run alongside auditd
+func NewNetlinkClient(recvSize int, multicast bool) *NetlinkClient {
 	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_AUDIT)
 	if err != nil {
 		el.Fatalln("Could not create a socket:", err)
 	}
 
 	n := &NetlinkClient{
-		fd:      fd,
-		address: &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 0, Pid: 0},
-		buf:     make([]byte, MAX_AUDIT_MESSAGE_LENGTH),
+		fd:        fd,
+		address:   &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 0, Pid: 0},
+		multicast: multicast,
+		buf:       make([]byte, MAX_AUDIT_MESSAGE_LENGTH),
+		done:      make(chan struct{}),
 	}
 
-	if err = syscall.Bind(fd, n.address); err != nil {
+	// Requests are always sent to the kernel directly, only the bind address joins the group
+	bindAddress := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 0, Pid: 0}
+	if multicast {
+		bindAddress.Groups = 1 << (AUDIT_NLGRP_READLOG - 1)
+	}
+
+	if err = syscall.Bind(fd, bindAddress); err != nil {
 		syscall.Close(fd)
 		el.Fatalln("Could not bind to netlink socket:", err)
 	}
@@ -71,10 +152,24 @@ func NewNetlinkClient(recvSize int) *NetlinkClient {
 		l.Println("Socket receive buffer size:", v)
 	}
 
+	tv := syscall.NsecToTimeval(RECEIVE_TIMEOUT.Nanoseconds())
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		el.Println("Failed to set receive timeout:", err)
+	}
+
+	if multicast {
+		return n
+	}
+
 	go func() {
 		for {
 			n.KeepConnection()
-			time.Sleep(time.Second * 5)
+
+			select {
+			case <-time.After(time.Second * 5):
+			case <-n.done:
+				return
+			}
 		}
 	}()
 
@@ -82,7 +177,8 @@ func NewNetlinkClient(recvSize int) *NetlinkClient {
 }
 
 // Send will send a packet and payload to the netlink socket without waiting for a response
-func (n *NetlinkClient) Send(np *NetlinkPacket, a *AuditStatusPayload) error {
+// The payload can be anything encoding/binary can write, like a fixed size struct or a []byte
+func (n *NetlinkClient) Send(np *NetlinkPacket, a interface{}) error {
 	//We need to get the length first. This is a bit wasteful, but requests are rare so yolo..
 	buf := new(bytes.Buffer)
 	var length int
@@ -108,8 +204,162 @@ func (n *NetlinkClient) Send(np *NetlinkPacket, a *AuditStatusPayload) error {
 	return nil
 }
 
-// Receive will receive a packet from a netlink socket
+// Receive will receive the next audit event from a netlink socket
+// Events that were read while waiting for the reply to a request are returned before anything new
+// Acks and other control messages are handled here and never returned
 func (n *NetlinkClient) Receive() (*syscall.NetlinkMessage, error) {
+	if len(n.held) > 0 {
+		msg := n.held[0]
+		n.held = n.held[1:]
+		return msg, nil
+	}
+
+	for {
+		msg, err := n.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Header.Type >= AUDIT_FIRST_USER_MSG {
+			return msg, nil
+		}
+
+		n.handleControl(msg)
+	}
+}
+
+// ReceiveBatch waits for at least one packet and then reads every packet that is already queued, up to
+// RECEIVE_BATCH_SIZE, with a single recvmmsg call. Like Receive only events are returned and held events come first
+func (n *NetlinkClient) ReceiveBatch() (*Batch, error) {
+	b := &Batch{pool: &n.pool}
+	if len(n.held) > 0 {
+		b.Msgs = n.held
+		n.held = nil
+		return b, nil
+	}
+
+	if n.mmsgs == nil {
+		n.pool.New = func() interface{} {
+			buf := make([]byte, MAX_AUDIT_MESSAGE_LENGTH)
+			return &buf
+		}
+
+		n.mmsgs = make([]mmsghdr, RECEIVE_BATCH_SIZE)
+		n.iovs = make([]syscall.Iovec, RECEIVE_BATCH_SIZE)
+		n.bufs = make([]*[]byte, RECEIVE_BATCH_SIZE)
+	}
+
+	// Only buffers handed out in the last batch need replacing
+	for i := range n.mmsgs {
+		if n.bufs[i] == nil {
+			n.bufs[i] = n.pool.Get().(*[]byte)
+			n.iovs[i].Base = &(*n.bufs[i])[0]
+			n.iovs[i].SetLen(len(*n.bufs[i]))
+		}
+
+		n.mmsgs[i].hdr.Iov = &n.iovs[i]
+		n.mmsgs[i].hdr.Iovlen = 1
+		n.mmsgs[i].len = 0
+	}
+
+	count, _, errno := syscall.Syscall6(
+		syscall.SYS_RECVMMSG,
+		uintptr(n.fd),
+		uintptr(unsafe.Pointer(&n.mmsgs[0])),
+		uintptr(len(n.mmsgs)),
+		syscall.MSG_WAITFORONE,
+		0,
+		0,
+	)
+
+	if errno != 0 {
+		return nil, errno
+	}
+
+	for i := 0; i < int(count); i++ {
+		nlen := int(n.mmsgs[i].len)
+		if nlen < syscall.SizeofNlMsghdr {
+			el.Printf("Dropped a %d byte packet, it is too short to be a netlink message\n", nlen)
+			continue
+		}
+
+		msg := parseNetlinkMessage((*n.bufs[i])[:nlen])
+		if msg.Header.Type < AUDIT_FIRST_USER_MSG {
+			// The buffer stays with us since nothing refers to it after this
+			n.handleControl(msg)
+			continue
+		}
+
+		b.Msgs = append(b.Msgs, msg)
+		b.bufs = append(b.bufs, n.bufs[i])
+		n.bufs[i] = nil
+	}
+
+	return b, nil
+}
+
+// Deals with a message that isn't the reply to the request being waited on
+// Events are copied so Receive can return them later, control messages are handled right away
+func (n *NetlinkClient) hold(msg *syscall.NetlinkMessage) {
+	if msg.Header.Type < AUDIT_FIRST_USER_MSG {
+		n.handleControl(msg)
+		return
+	}
+
+	n.held = append(n.held, &syscall.NetlinkMessage{Header: msg.Header, Data: append([]byte{}, msg.Data...)})
+}
+
+// Matches an ack to the request sendAsync sent and logs any error the kernel reported for it
+// Other replies are to requests that were given up on and are dropped
+func (n *NetlinkClient) handleControl(msg *syscall.NetlinkMessage) {
+	if msg.Header.Type != syscall.NLMSG_ERROR {
+		return
+	}
+
+	n.lock.Lock()
+	what, ok := n.pending[msg.Header.Seq]
+	delete(n.pending, msg.Header.Seq)
+	n.lock.Unlock()
+
+	err := netlinkError(msg)
+	if err == nil {
+		return
+	}
+
+	if ok {
+		el.Printf("Failed to %s. Error: %s\n", what, err)
+	} else {
+		el.Printf("Kernel reported an error for request %d. Error: %s\n", msg.Header.Seq, err)
+	}
+}
+
+// Sends a request without waiting for the ack, Receive logs the error if the kernel rejects it
+// what describes the request for the log line, like `claim the audit pid`
+func (n *NetlinkClient) sendAsync(msgType uint16, payload interface{}, what string) error {
+	packet := &NetlinkPacket{
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	// Held across the send so the ack can't be handled before we know to expect it
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if err := n.Send(packet, payload); err != nil {
+		return err
+	}
+
+	if n.pending == nil {
+		n.pending = make(map[uint32]string)
+	}
+
+	n.pending[packet.Seq] = what
+	return nil
+}
+
+// Reads the next packet from the socket, the returned data is only valid until the next read
+func (n *NetlinkClient) receive() (*syscall.NetlinkMessage, error) {
 	nlen, _, err := syscall.Recvfrom(n.fd, n.buf, 0)
 	if err != nil {
 		return nil, err
@@ -119,36 +369,206 @@ func (n *NetlinkClient) Receive() (*syscall.NetlinkMessage, error) {
 		return nil, errors.New("Got a 0 length packet")
 	}
 
-	msg := &syscall.NetlinkMessage{
+	return parseNetlinkMessage(n.buf[:nlen]), nil
+}
+
+// Splits a packet into the netlink header and its data, the data is not copied
+func parseNetlinkMessage(b []byte) *syscall.NetlinkMessage {
+	return &syscall.NetlinkMessage{
 		Header: syscall.NlMsghdr{
-			Len:   Endianness.Uint32(n.buf[0:4]),
-			Type:  Endianness.Uint16(n.buf[4:6]),
-			Flags: Endianness.Uint16(n.buf[6:8]),
-			Seq:   Endianness.Uint32(n.buf[8:12]),
-			Pid:   Endianness.Uint32(n.buf[12:16]),
+			Len:   Endianness.Uint32(b[0:4]),
+			Type:  Endianness.Uint16(b[4:6]),
+			Flags: Endianness.Uint16(b[6:8]),
+			Seq:   Endianness.Uint32(b[8:12]),
+			Pid:   Endianness.Uint32(b[12:16]),
 		},
-		Data: n.buf[syscall.SizeofNlMsghdr:nlen],
+		Data: b[syscall.SizeofNlMsghdr:],
+	}
+}
+
+// Execute sends a request to the kernel and waits for it to be acknowledged
+// Any error the kernel reports for the request is returned
+func (n *NetlinkClient) Execute(msgType uint16, payload interface{}) error {
+	packet := &NetlinkPacket{
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+		Pid:   uint32(syscall.Getpid()),
 	}
 
-	return msg, nil
+	if err := n.Send(packet, payload); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := n.receive()
+		if err != nil {
+			return err
+		}
+
+		// Skip anything that isn't the response to our request, like audit events or other acks
+		if msg.Header.Seq != packet.Seq || msg.Header.Type != syscall.NLMSG_ERROR {
+			n.hold(msg)
+			continue
+		}
+
+		return netlinkError(msg)
+	}
+}
+
+// ListRules asks the kernel for all of the currently loaded audit rules
+// Each rule is returned in the kernels struct audit_rule_data format
+func (n *NetlinkClient) ListRules() ([][]byte, error) {
+	packet := &NetlinkPacket{
+		Type:  AUDIT_LIST_RULES,
+		Flags: syscall.NLM_F_REQUEST,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	if err := n.Send(packet, []byte{}); err != nil {
+		return nil, err
+	}
+
+	rules := [][]byte{}
+	for {
+		msg, err := n.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Header.Seq != packet.Seq {
+			n.hold(msg)
+			continue
+		}
+
+		switch msg.Header.Type {
+		case syscall.NLMSG_DONE:
+			return rules, nil
+		case syscall.NLMSG_ERROR:
+			if err := netlinkError(msg); err != nil {
+				return nil, err
+			}
+		case AUDIT_LIST_RULES:
+			// Receive reuses its buffer so we need our own copy
+			rules = append(rules, append([]byte{}, msg.Data...))
+		}
+	}
+}
+
+// GetStatus asks the kernel for the current audit status
+func (n *NetlinkClient) GetStatus() (*AuditStatusPayload, error) {
+	packet := &NetlinkPacket{
+		Type:  AUDIT_GET,
+		Flags: syscall.NLM_F_REQUEST,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	if err := n.Send(packet, []byte{}); err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := n.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.Header.Seq != packet.Seq {
+			n.hold(msg)
+			continue
+		}
+
+		switch msg.Header.Type {
+		case syscall.NLMSG_ERROR:
+			if err := netlinkError(msg); err != nil {
+				return nil, err
+			}
+		case AUDIT_GET:
+			return parseAuditStatus(msg.Data)
+		}
+	}
+}
+
+// Decodes an audit_status struct, older kernels send fewer fields so missing ones are left as 0
+func parseAuditStatus(b []byte) (*AuditStatusPayload, error) {
+	if len(b) < 32 {
+		return nil, fmt.Errorf("Audit status is too short, %d bytes", len(b))
+	}
+
+	full := make([]byte, binary.Size(AuditStatusPayload{}))
+	copy(full, b)
+
+	status := &AuditStatusPayload{}
+	if err := binary.Read(bytes.NewReader(full), Endianness, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// Extracts the errno from a NLMSG_ERROR message, a 0 errno is an ack and results in a nil error
+func netlinkError(msg *syscall.NetlinkMessage) error {
+	if len(msg.Data) < 4 {
+		return errors.New("Got a truncated netlink error message")
+	}
+
+	if errno := int32(Endianness.Uint32(msg.Data[0:4])); errno != 0 {
+		return syscall.Errno(-errno)
+	}
+
+	return nil
+}
+
+// Release stops claiming the audit pid and tells the kernel to stop sending us events
+// Events the kernel already queued on the socket can still be received afterwards
+// Multicast clients never claimed the pid so there is nothing to release, the pid belongs to another daemon
+func (n *NetlinkClient) Release() error {
+	var err error
+	n.release.Do(func() {
+		if n.done != nil {
+			close(n.done)
+		}
+
+		if n.multicast {
+			return
+		}
+
+		// The ack is not waited for, events still queued in front of it can be drained with Receive
+		err = n.sendAsync(AUDIT_SET, &AuditStatusPayload{Mask: AUDIT_STATUS_PID, Pid: 0}, "release the audit pid")
+	})
+
+	return err
+}
+
+// Disown stops claiming the audit pid without releasing it, for when another process has taken it
+// Releasing would take the pid away from that process, Release does nothing afterwards
+func (n *NetlinkClient) Disown() {
+	n.release.Do(func() {
+		if n.done != nil {
+			close(n.done)
+		}
+	})
+}
+
+// Close releases the audit pid if it hasn't been already and closes the socket
+func (n *NetlinkClient) Close() error {
+	if err := n.Release(); err != nil {
+		el.Println("Failed to release the audit pid:", err)
+	}
+
+	return syscall.Close(n.fd)
 }
 
 // KeepConnection re-establishes our connection to the netlink socket
 func (n *NetlinkClient) KeepConnection() {
 	payload := &AuditStatusPayload{
-		Mask:    4,
+		Mask:    AUDIT_STATUS_PID,
 		Enabled: 1,
 		Pid:     uint32(syscall.Getpid()),
-		//TODO: Failure: http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L338
-	}
-
-	packet := &NetlinkPacket{
-		Type:  uint16(1001),
-		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
-		Pid:   uint32(syscall.Getpid()),
+		// Failure and the limits are set once at startup, see setAuditStatus
 	}
 
-	err := n.Send(packet, payload)
+	// The kernel refuses this if another audit daemon, like auditd, already owns the pid
+	err := n.sendAsync(AUDIT_SET, payload, "claim the audit pid, another audit daemon may own it")
 	if err != nil {
 		el.Println("Error occurred while trying to keep the connection:", err)
 	}
@@ -5,8 +5,10 @@ import (
 	"encoding/binary"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 )
 
 func TestNetlinkClient_KeepConnection(t *testing.T) {
@@ -14,7 +16,7 @@ func TestNetlinkClient_KeepConnection(t *testing.T) {
 	defer syscall.Close(n.fd)
 
 	n.KeepConnection()
-	msg, err := n.Receive()
+	msg, err := n.receive()
 	if err != nil {
 		t.Fatal("Did not expect an error", err)
 	}
@@ -91,11 +93,11 @@ func TestNewNetlinkClient(t *testing.T) {
 	lb, elb := hookLogger()
 	defer resetLogger()
 
-	n := NewNetlinkClient(1024)
+	n := NewNetlinkClient(1024, false)
 
 	assert.True(t, (n.fd > 0), "No file descriptor")
 	assert.True(t, (n.address != nil), "Address was nil")
-	assert.Equal(t, uint32(0), n.seq, "Seq should start at 0")
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&n.seq), "Seq should start at 0")
 	assert.True(t, MAX_AUDIT_MESSAGE_LENGTH >= len(n.buf), "Client buffer is too small")
 
 	assert.Equal(t, "Socket receive buffer size: ", lb.String()[:28], "Expected some nice log lines")
@@ -103,7 +105,7 @@ func TestNewNetlinkClient(t *testing.T) {
 }
 
 // Helper to make a client listening on a unix socket
-func makeNelinkClient(t *testing.T) *NetlinkClient {
+func makeNelinkClient(t testing.TB) *NetlinkClient {
 	os.Remove("go-audit.test.sock")
 	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_RAW, 0)
 	if err != nil {
@@ -131,7 +133,7 @@ func sendReceive(t *testing.T, n *NetlinkClient, packet *NetlinkPacket, payload
 		t.Fatal("Failed to send:", err)
 	}
 
-	msg, err := n.Receive()
+	msg, err := n.receive()
 	if err != nil {
 		t.Fatal("Failed to receive:", err)
 	}
@@ -154,3 +156,259 @@ func hookLogger() (lb *bytes.Buffer, elb *bytes.Buffer) {
 	el.SetOutput(elb)
 	return
 }
+
+func TestNetlinkClient_Execute(t *testing.T) {
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+
+	// Queue up an ack for the request we are about to make, the request itself will also come back and be skipped
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 1, []byte{0, 0, 0, 0})
+	assert.Nil(t, n.Execute(AUDIT_SET, &AuditStatusPayload{}))
+
+	// Errors from the kernel are returned
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 2, []byte{255, 255, 255, 255})
+	assert.Equal(t, syscall.EPERM, n.Execute(AUDIT_SET, &AuditStatusPayload{}))
+
+	// Acks for other requests don't end the wait, their errors are logged
+	lb, elb := hookLogger()
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 99, []byte{255, 255, 255, 255})
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 3, []byte{0, 0, 0, 0})
+	assert.Nil(t, n.Execute(AUDIT_SET, &AuditStatusPayload{}))
+	resetLogger()
+	assert.Equal(t, "", lb.String())
+	assert.Equal(t, "Kernel reported an error for request 99. Error: operation not permitted\n", elb.String())
+
+	// Events that arrive while waiting are kept for Receive, in order
+	queueNetlinkMessage(t, n, 1300, 0, []byte("audit(1:1): first"))
+	queueNetlinkMessage(t, n, 1320, 0, []byte("audit(1:1): "))
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 4, []byte{0, 0, 0, 0})
+	assert.Nil(t, n.Execute(AUDIT_SET, &AuditStatusPayload{}))
+
+	msg, err := n.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1300), msg.Header.Type)
+	assert.Equal(t, "audit(1:1): first", string(msg.Data))
+
+	msg, err = n.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1320), msg.Header.Type)
+	assert.Equal(t, 0, len(n.held))
+}
+
+func TestNetlinkClient_ListRules(t *testing.T) {
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+
+	queueNetlinkMessage(t, n, AUDIT_LIST_RULES, 1, []byte("rule 1"))
+	queueNetlinkMessage(t, n, AUDIT_LIST_RULES, 99, []byte("not ours"))
+	queueNetlinkMessage(t, n, AUDIT_LIST_RULES, 1, []byte("rule 2"))
+	queueNetlinkMessage(t, n, syscall.NLMSG_DONE, 1, []byte{})
+
+	rules, err := n.ListRules()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("rule 1"), []byte("rule 2")}, rules)
+
+	// Errors from the kernel are returned
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 2, []byte{255, 255, 255, 255})
+	_, err = n.ListRules()
+	assert.Equal(t, syscall.EPERM, err)
+}
+
+// Helper to put a raw netlink message on the test socket so it is received before anything sent after it
+func queueNetlinkMessage(t testing.TB, n *NetlinkClient, msgType uint16, seq uint32, data []byte) {
+	b := make([]byte, syscall.SizeofNlMsghdr+len(data))
+	Endianness.PutUint32(b[0:4], uint32(len(b)))
+	Endianness.PutUint16(b[4:6], msgType)
+	Endianness.PutUint32(b[8:12], seq)
+	copy(b[syscall.SizeofNlMsghdr:], data)
+
+	if err := syscall.Sendto(n.fd, b, 0, n.address); err != nil {
+		t.Fatal("Failed to queue message:", err)
+	}
+}
+
+func TestNetlinkClient_Release(t *testing.T) {
+	n := makeNelinkClient(t)
+	n.done = make(chan struct{})
+	defer syscall.Close(n.fd)
+
+	assert.Nil(t, n.Release())
+
+	msg, err := n.receive()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(AUDIT_SET), msg.Header.Type)
+	assert.Equal(t, uint16(syscall.NLM_F_REQUEST|syscall.NLM_F_ACK), msg.Header.Flags)
+	assert.Equal(t, uint32(AUDIT_STATUS_PID), Endianness.Uint32(msg.Data[0:4]), "Only the pid should be changed")
+	assert.Equal(t, uint32(0), Endianness.Uint32(msg.Data[12:16]), "The pid should be 0")
+
+	select {
+	case <-n.done:
+	default:
+		t.Error("The keep alive should have been stopped")
+	}
+
+	// Releasing again does nothing
+	assert.Nil(t, n.Release())
+	setReceiveTimeout(t, n, time.Millisecond*10)
+	_, err = n.Receive()
+	assert.Equal(t, syscall.EAGAIN, err)
+}
+
+func TestNetlinkClient_ReceiveControl(t *testing.T) {
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+	setReceiveTimeout(t, n, time.Millisecond*10)
+
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	// Acks and replies are not events and are never returned
+	assert.Nil(t, n.sendAsync(AUDIT_SET, &AuditStatusPayload{}, "do something"))
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 1, []byte{0, 0, 0, 0})
+	queueNetlinkMessage(t, n, AUDIT_GET, 50, make([]byte, 40))
+	queueNetlinkMessage(t, n, syscall.NLMSG_DONE, 51, []byte{})
+	queueNetlinkMessage(t, n, 1300, 0, []byte("audit(1:1): first"))
+
+	msg, err := n.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(1300), msg.Header.Type)
+	assert.Equal(t, 0, len(n.pending), "The ack should have been matched to the request")
+	assert.Equal(t, "", elb.String(), "A successful ack should not be logged")
+
+	// Errors for requests nobody waited on are logged with what the request was
+	assert.Nil(t, n.sendAsync(AUDIT_SET, &AuditStatusPayload{}, "claim the audit pid"))
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 2, []byte{255, 255, 255, 255})
+	_, err = n.Receive()
+	assert.Equal(t, syscall.EAGAIN, err)
+	assert.Equal(t, 0, len(n.pending))
+
+	assert.Equal(t, "", lb.String())
+	assert.Equal(t, "Failed to claim the audit pid. Error: operation not permitted\n", elb.String())
+}
+
+func TestNetlinkClient_ReceiveBatch(t *testing.T) {
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+	setReceiveTimeout(t, n, time.Millisecond*10)
+
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	// Everything queued comes back in one batch, without the control messages or packets too short to parse
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 99, []byte{0, 0, 0, 0})
+	queueNetlinkMessage(t, n, 1300, 0, []byte("audit(1:1): first"))
+	syscall.Sendto(n.fd, []byte{1, 2, 3, 4}, 0, n.address)
+	queueNetlinkMessage(t, n, 1320, 0, []byte("audit(1:1): "))
+	queueNetlinkMessage(t, n, AUDIT_GET, 50, make([]byte, 40))
+
+	b, err := n.ReceiveBatch()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(b.Msgs))
+	assert.Equal(t, uint16(1300), b.Msgs[0].Header.Type)
+	assert.Equal(t, "audit(1:1): first", string(b.Msgs[0].Data))
+	assert.Equal(t, uint16(1320), b.Msgs[1].Header.Type)
+	assert.Equal(t, "audit(1:1): ", string(b.Msgs[1].Data))
+	assert.Equal(t, "Dropped a 4 byte packet, it is too short to be a netlink message\n", elb.String())
+
+	// The buffers stay with the batch until it is freed
+	queueNetlinkMessage(t, n, 1300, 0, []byte("audit(1:2): second"))
+	b2, err := n.ReceiveBatch()
+	assert.Nil(t, err)
+	assert.Equal(t, "audit(1:2): second", string(b2.Msgs[0].Data))
+	assert.Equal(t, "audit(1:1): first", string(b.Msgs[0].Data), "The first batch should not have been overwritten")
+
+	b.Free()
+	b2.Free()
+	assert.Nil(t, b.Msgs)
+
+	// Nothing left
+	_, err = n.ReceiveBatch()
+	assert.Equal(t, syscall.EAGAIN, err)
+
+	// Events held while waiting on a request come first
+	n.held = []*syscall.NetlinkMessage{{Header: syscall.NlMsghdr{Type: 1305}, Data: []byte("held")}}
+	queueNetlinkMessage(t, n, 1300, 0, []byte("audit(1:3): third"))
+	b, err = n.ReceiveBatch()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(b.Msgs))
+	assert.Equal(t, "held", string(b.Msgs[0].Data))
+	assert.Equal(t, 0, len(n.held))
+	b.Free()
+
+	b, err = n.ReceiveBatch()
+	assert.Nil(t, err)
+	assert.Equal(t, "audit(1:3): third", string(b.Msgs[0].Data))
+	b.Free()
+
+	assert.Equal(t, "", lb.String())
+}
+
+func TestNetlinkClient_Disown(t *testing.T) {
+	n := makeNelinkClient(t)
+	n.done = make(chan struct{})
+	defer syscall.Close(n.fd)
+
+	n.Disown()
+
+	select {
+	case <-n.done:
+	default:
+		t.Error("The keep alive should have been stopped")
+	}
+
+	// The pid belongs to someone else now so releasing must not touch it
+	assert.Nil(t, n.Release())
+	setReceiveTimeout(t, n, time.Millisecond*10)
+	_, err := n.receive()
+	assert.Equal(t, syscall.EAGAIN, err)
+}
+
+// Makes Receive give up instead of blocking forever on the test socket
+func setReceiveTimeout(t testing.TB, n *NetlinkClient, d time.Duration) {
+	tv := syscall.NsecToTimeval(d.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatal("Failed to set receive timeout:", err)
+	}
+}
+
+func TestNetlinkClient_ReleaseMulticast(t *testing.T) {
+	n := makeNelinkClient(t)
+	n.multicast = true
+	defer syscall.Close(n.fd)
+
+	// The pid belongs to someone else so nothing should be sent
+	assert.Nil(t, n.Release())
+	setReceiveTimeout(t, n, time.Millisecond*10)
+	_, err := n.Receive()
+	assert.Equal(t, syscall.EAGAIN, err)
+}
+
+func TestNetlinkClient_GetStatus(t *testing.T) {
+	n := makeNelinkClient(t)
+	defer syscall.Close(n.fd)
+
+	data := make([]byte, 40)
+	Endianness.PutUint32(data[4:8], 2)
+	Endianness.PutUint32(data[12:16], 1006)
+	Endianness.PutUint32(data[24:28], 10)
+	queueNetlinkMessage(t, n, AUDIT_GET, 1, data)
+
+	status, err := n.GetStatus()
+	assert.Nil(t, err)
+	assert.Equal(t, &AuditStatusPayload{Enabled: 2, Pid: 1006, Lost: 10}, status)
+
+	// Older kernels send a shorter status
+	queueNetlinkMessage(t, n, AUDIT_GET, 2, data[:32])
+	status, err = n.GetStatus()
+	assert.Nil(t, err)
+	assert.Equal(t, &AuditStatusPayload{Enabled: 2, Pid: 1006, Lost: 10}, status)
+
+	queueNetlinkMessage(t, n, AUDIT_GET, 3, data[:8])
+	_, err = n.GetStatus()
+	assert.EqualError(t, err, "Audit status is too short, 8 bytes")
+
+	// Errors from the kernel are returned
+	queueNetlinkMessage(t, n, syscall.NLMSG_ERROR, 4, []byte{255, 255, 255, 255})
+	_, err = n.GetStatus()
+	assert.Equal(t, syscall.EPERM, err)
+}
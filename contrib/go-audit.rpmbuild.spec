@@ -22,8 +22,6 @@ Source0:          https://github.com/slackhq/go-audit/archive/%{commit}/go-audit
 # CentOS 7. Instead, the official release can be installed manually, however please ensure that it is in your PATH.
 #BuildRequires:    golang >= 1.7
 
-Requires:         /sbin/auditctl
-
 %if %{use_systemd}
 BuildRequires:    systemd
 Requires(post):   systemd
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ES_DEFAULT_INDEX = "go-audit-{2006.01.02}"
+
+// Finds the time layouts in an index name
+var esIndexLayoutRe = regexp.MustCompile(`\{([^}]+)\}`)
+
+// elasticsearchFormat sends events to the _bulk api and retries only the documents that were rejected for a reason
+// that can go away, like a full queue. Documents rejected for good, like a mapping conflict, are logged and dropped
+type elasticsearchFormat struct {
+	index   string // Index name, {...} is replaced by the event time formatted with the go time layout inside
+	docType string // Only needed before elasticsearch 7
+}
+
+func (elasticsearchFormat) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (f elasticsearchFormat) encode(buf *bytes.Buffer, lines [][]byte) {
+	for _, l := range lines {
+		buf.WriteString(`{"index":{"_index":`)
+		buf.WriteString(strconv.Quote(f.indexName(l)))
+		if f.docType != "" {
+			buf.WriteString(`,"_type":`)
+			buf.WriteString(strconv.Quote(f.docType))
+		}
+		buf.WriteString("}}\n")
+
+		buf.Write(l)
+		if len(l) > 0 && l[len(l)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+}
+
+// The index for an event, based on when it happened so replayed events land next to their neighbours
+func (f elasticsearchFormat) indexName(line []byte) string {
+	if !strings.Contains(f.index, "{") {
+		return f.index
+	}
+
+	t := time.Now().UTC()
+	if at := auditTime(line); at != "" {
+		if secs, err := strconv.ParseFloat(at, 64); err == nil {
+			t = time.Unix(0, int64(secs*float64(time.Second))).UTC()
+		}
+	}
+
+	return esIndexLayoutRe.ReplaceAllStringFunc(f.index, func(layout string) string {
+		return t.Format(layout[1 : len(layout)-1])
+	})
+}
+
+type esBulkResponse struct {
+	Errors bool                                `json:"errors"`
+	Items  []map[string]esBulkResponseItemBody `json:"items"`
+}
+
+type esBulkResponseItemBody struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func (elasticsearchFormat) accepted(_ *httpWriter, body []byte, lines [][]byte) ([][]byte, error) {
+	resp := &esBulkResponse{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, fmt.Errorf("Failed to decode the bulk response. Error: %s", err)
+	}
+
+	if !resp.Errors {
+		return nil, nil
+	}
+
+	if len(resp.Items) != len(lines) {
+		return nil, fmt.Errorf("Bulk response had %d items for %d events", len(resp.Items), len(lines))
+	}
+
+	retry := [][]byte{}
+	dropped := 0
+	var firstErr json.RawMessage
+
+	for i, item := range resp.Items {
+		for _, r := range item {
+			switch {
+			case r.Status >= 200 && r.Status < 300:
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				retry = append(retry, lines[i])
+			default:
+				dropped++
+				if firstErr == nil {
+					firstErr = r.Error
+				}
+			}
+		}
+	}
+
+	if dropped > 0 {
+		el.Printf("Elasticsearch rejected %d events, they will not be retried. First error: %s\n", dropped, firstErr)
+	}
+
+	return retry, nil
+}
+
+// Creates or replaces an index template with the contents of file
+func installElasticsearchTemplate(w *httpWriter, baseURL string, name string, file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", baseURL+"/_template/"+name, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		rb, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Server returned %s: %s", resp.Status, rb)
+	}
+
+	return nil
+}
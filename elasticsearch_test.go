@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_elasticsearchFormat(t *testing.T) {
+	f := elasticsearchFormat{index: "audit-{2006.01.02}-{15}", docType: "event"}
+
+	buf := &bytes.Buffer{}
+	f.encode(buf, [][]byte{
+		[]byte(`{"sequence":1,"timestamp":"1500000000.123","messages":[]}` + "\n"),
+		[]byte(`{"sequence":2,"timestamp":"1500086400.000","messages":[]}`),
+	})
+
+	assert.Equal(
+		t,
+		`{"index":{"_index":"audit-2017.07.14-02","_type":"event"}}`+"\n"+
+			`{"sequence":1,"timestamp":"1500000000.123","messages":[]}`+"\n"+
+			`{"index":{"_index":"audit-2017.07.15-02","_type":"event"}}`+"\n"+
+			`{"sequence":2,"timestamp":"1500086400.000","messages":[]}`+"\n",
+		buf.String(),
+	)
+
+	// No timestamp uses the current time
+	f = elasticsearchFormat{index: "audit-{2006}"}
+	assert.Equal(t, "audit-"+time.Now().UTC().Format("2006"), f.indexName([]byte(`{"sequence":1}`)))
+
+	// A fixed index
+	f = elasticsearchFormat{index: "audit"}
+	assert.Equal(t, "audit", f.indexName([]byte(`{"sequence":1,"timestamp":"1500000000.123"}`)))
+}
+
+func Test_elasticsearchFormat_accepted(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	f := elasticsearchFormat{index: "audit"}
+	lines := [][]byte{[]byte("1\n"), []byte("2\n"), []byte("3\n"), []byte("4\n")}
+
+	retry, err := f.accepted(nil, []byte(`{"errors":false,"items":[]}`), lines)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(retry))
+
+	_, err = f.accepted(nil, []byte(`nope`), lines)
+	assert.EqualError(t, err, "Failed to decode the bulk response. Error: invalid character 'o' in literal null (expecting 'u')")
+
+	_, err = f.accepted(nil, []byte(`{"errors":true,"items":[]}`), lines)
+	assert.EqualError(t, err, "Bulk response had 0 items for 4 events")
+
+	// Only the items that can succeed later are retried
+	retry, err = f.accepted(nil, []byte(`{"errors":true,"items":[
+		{"index":{"status":201}},
+		{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},
+		{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}},
+		{"index":{"status":503,"error":{"type":"unavailable_shards_exception"}}}
+	]}`), lines)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("2\n"), []byte("4\n")}, retry)
+	assert.Equal(t, "Elasticsearch rejected 1 events, they will not be retried. First error: {\"type\":\"mapper_parsing_exception\"}\n", elb.String())
+}
+
+func Test_elasticsearchWriter(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	es := newFakeElasticsearch()
+	defer es.Close()
+
+	w := newTestHTTPWriter(t, es.URL+"/_bulk?pipeline=audit", elasticsearchFormat{index: "audit"}, func(c *httpConfig) {
+		c.maxEvents = 3
+		c.maxRetries = 1
+	})
+	defer w.Close()
+
+	// The second document is rejected once, only it is sent again
+	es.reject(2, 1)
+	w.Write([]byte(`{"sequence":1}` + "\n"))
+	w.Write([]byte(`{"sequence":2}` + "\n"))
+	_, err := w.Write([]byte(`{"sequence":3}` + "\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3, 2}, es.sequences())
+	assert.Equal(t, "pipeline=audit", es.query)
+	assert.Equal(t, 0, len(w.lines))
+
+	// Running out of retries keeps the rejected document
+	es.reject(5, 4)
+	w.Write([]byte(`{"sequence":4}` + "\n"))
+	w.Write([]byte(`{"sequence":5}` + "\n"))
+	w.Write([]byte(`{"sequence":6}` + "\n"))
+	assert.Equal(t, 1, len(w.lines))
+
+	_, err = w.Write([]byte(`{"sequence":7}` + "\n"))
+	assert.EqualError(t, err, "Failed to send 1 events to "+es.URL+"/_bulk?pipeline=audit. Error: 1 events were not accepted")
+
+	_, err = w.Write([]byte(`{"sequence":7}` + "\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3, 2, 4, 5, 6, 5, 5}, es.sequences()[:9])
+}
+
+func Test_installElasticsearchTemplate(t *testing.T) {
+	var got string
+	var method string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got, method = r.URL.Path+" "+string(b), r.Method
+		if strings.HasSuffix(r.URL.Path, "/bad") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"bad template"}`))
+		}
+	}))
+	defer s.Close()
+
+	w := newTestHTTPWriter(t, s.URL, elasticsearchFormat{index: "audit"}, func(c *httpConfig) {})
+	defer w.Close()
+
+	file := createTempFile(t, "template.json", `{"template":"go-audit-*"}`)
+	defer os.Remove(file)
+
+	assert.Nil(t, installElasticsearchTemplate(w, s.URL, "go-audit", file))
+	assert.Equal(t, "PUT", method)
+	assert.Equal(t, `/_template/go-audit {"template":"go-audit-*"}`, got)
+
+	assert.EqualError(t, installElasticsearchTemplate(w, s.URL, "bad", file), `Server returned 400 Bad Request: {"error":"bad template"}`)
+	assert.EqualError(t, installElasticsearchTemplate(w, s.URL, "go-audit", "/do/not/exist"), "open /do/not/exist: no such file or directory")
+}
+
+// A _bulk endpoint that records the sequence of every document it is sent and can reject some of them
+type fakeElasticsearch struct {
+	*httptest.Server
+	lock     sync.Mutex
+	seqs     []int
+	query    string
+	rejected map[int]int // { sequence: times left to reject it }
+}
+
+func newFakeElasticsearch() *fakeElasticsearch {
+	f := &fakeElasticsearch{rejected: map[int]int{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeElasticsearch) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.query = r.URL.RawQuery
+	items := []string{}
+	errors := false
+
+	s := bufio.NewScanner(r.Body)
+	for s.Scan() {
+		// Skip the action line
+		if !s.Scan() {
+			break
+		}
+
+		doc := struct {
+			Seq int `json:"sequence"`
+		}{}
+		json.Unmarshal(s.Bytes(), &doc)
+		f.seqs = append(f.seqs, doc.Seq)
+
+		if f.rejected[doc.Seq] > 0 {
+			f.rejected[doc.Seq]--
+			errors = true
+			items = append(items, `{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}}`)
+		} else {
+			items = append(items, `{"index":{"status":201}}`)
+		}
+	}
+
+	fmt.Fprintf(w, `{"took":1,"errors":%v,"items":[%s]}`, errors, strings.Join(items, ","))
+}
+
+// Rejects the document with seq the next n times it is sent
+func (f *fakeElasticsearch) reject(seq int, n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.rejected[seq] = n
+}
+
+func (f *fakeElasticsearch) sequences() []int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]int{}, f.seqs...)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HTTP_MAX_EVENTS      = 500
+	HTTP_MAX_BYTES       = 1 << 20 // 1MB
+	HTTP_FLUSH_INTERVAL  = time.Second
+	HTTP_MAX_RETRIES     = 5
+	HTTP_MIN_BACKOFF     = time.Millisecond * 500
+	HTTP_MAX_BACKOFF     = time.Second * 30
+	HTTP_MAX_RETRY_AFTER = time.Minute * 2
+	HTTP_TIMEOUT         = time.Second * 10
+
+	// Most of a response body that is read, formats that check the response need it all
+	HTTP_MAX_RESPONSE = 64 << 20
+)
+
+type httpConfig struct {
+	url        string
+	gzip       bool
+	headers    map[string]string
+	tls        *tls.Config
+	timeout    time.Duration
+	maxEvents  int
+	maxBytes   int
+	interval   time.Duration
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	maxRetryAfter time.Duration // Longest a Retry-After from the server is waited for
+}
+
+// httpFormat turns a batch of lines into a request body and decides which lines the server accepted
+type httpFormat interface {
+	contentType() string
+	encode(buf *bytes.Buffer, lines [][]byte)
+
+	// Called with the body of a 2xx response, returns the lines that need to be sent again
+	accepted(w *httpWriter, body []byte, lines [][]byte) ([][]byte, error)
+}
+
+// One event per line
+type ndjsonFormat struct{}
+
+func (ndjsonFormat) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (ndjsonFormat) encode(buf *bytes.Buffer, lines [][]byte) {
+	for _, l := range lines {
+		buf.Write(l)
+	}
+}
+
+func (ndjsonFormat) accepted(*httpWriter, []byte, [][]byte) ([][]byte, error) {
+	return nil, nil
+}
+
+// A JSON array of events
+type arrayFormat struct {
+	ndjsonFormat
+}
+
+func (arrayFormat) contentType() string {
+	return "application/json"
+}
+
+func (arrayFormat) encode(buf *bytes.Buffer, lines [][]byte) {
+	buf.WriteByte('[')
+	for i, l := range lines {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(l)
+	}
+	buf.WriteByte(']')
+}
+
+// httpWriter POSTs lines to a url in batches, a batch is sent once it is full or interval has passed
+// A batch that fails to send is kept and sent again before anything else is added to it, until then every write
+// fails so the output can retry or spool like any other
+type httpWriter struct {
+	httpConfig
+	lock   sync.Mutex
+	client *http.Client
+	format httpFormat
+
+	lines [][]byte
+	size  int
+	err   error // Why the current batch failed to send, nil if it hasn't been tried
+
+	done    chan struct{}
+	flushed chan struct{}
+}
+
+func newHTTPWriter(c httpConfig, format httpFormat) (*httpWriter, error) {
+	if c.url == "" {
+		return nil, errors.New("A url is required")
+	}
+
+	if c.maxEvents < 1 || c.maxBytes < 1 || c.interval <= 0 {
+		return nil, errors.New("Batch max_events, max_bytes and interval must be greater than 0")
+	}
+
+	if c.maxRetries < 0 || c.minBackoff <= 0 || c.maxBackoff < c.minBackoff {
+		return nil, errors.New("Retry max_retries must be 0 or more and min_backoff must be greater than 0 and no more than max_backoff")
+	}
+
+	if c.maxRetryAfter <= 0 {
+		return nil, errors.New("Retry max_retry_after must be greater than 0")
+	}
+
+	w := &httpWriter{
+		httpConfig: c,
+		client: &http.Client{
+			Timeout:   c.timeout,
+			Transport: &http.Transport{TLSClientConfig: c.tls, Proxy: http.ProxyFromEnvironment},
+		},
+		format:  format,
+		done:    make(chan struct{}),
+		flushed: make(chan struct{}),
+	}
+
+	go w.flushEvery()
+	return w, nil
+}
+
+// Write adds one line to the batch, sending the batch first if the line doesn't fit
+func (w *httpWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.lines) > 0 && (w.err != nil || len(w.lines)+1 > w.maxEvents || w.size+len(b) > w.maxBytes) {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	// The encoder reuses b for the next line
+	w.lines = append(w.lines, append([]byte(nil), b...))
+	w.size += len(b)
+
+	if len(w.lines) >= w.maxEvents || w.size >= w.maxBytes {
+		// A failure is returned by the next write, which tries the batch again
+		w.flush()
+	}
+
+	return len(b), nil
+}
+
+// Sends the batch if there is one every interval, until Close
+func (w *httpWriter) flushEvery() {
+	defer close(w.flushed)
+
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-w.done:
+			return
+		}
+
+		w.lock.Lock()
+		if len(w.lines) > 0 {
+			if err := w.flush(); err != nil {
+				el.Println(err)
+			}
+		}
+		w.lock.Unlock()
+	}
+}
+
+// Sends the batch, retrying with backoff, until every line in it was accepted
+func (w *httpWriter) flush() error {
+	backoff := w.minBackoff
+	for i := 0; ; i++ {
+		body, err := w.body()
+		if err != nil {
+			return err
+		}
+
+		var retryAfter time.Duration
+		retryAfter, w.err = w.send(body)
+		if w.err == nil {
+			w.lines = nil
+			w.size = 0
+			return nil
+		}
+
+		if retryAfter < 0 {
+			// The server will never take this batch, keeping it would fail every write after it
+			el.Printf("Dropping %d events %s will not accept. Error: %s\n", len(w.lines), w.url, w.err)
+			w.lines = nil
+			w.size = 0
+			w.err = nil
+			return nil
+		}
+
+		if i == w.maxRetries {
+			break
+		}
+
+		// The server knows best how long it needs, max_backoff only caps our own backoff
+		// max_retry_after stops a server from holding up the output for as long as it likes
+		wait := backoff
+		if wait > w.maxBackoff {
+			wait = w.maxBackoff
+		}
+
+		if retryAfter > w.maxRetryAfter {
+			retryAfter = w.maxRetryAfter
+		}
+
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+
+		// Closing doesn't wait out the backoff
+		select {
+		case <-time.After(wait):
+		case <-w.done:
+			return w.failed()
+		}
+
+		backoff *= 2
+	}
+
+	return w.failed()
+}
+
+func (w *httpWriter) failed() error {
+	return fmt.Errorf("Failed to send %d events to %s. Error: %s", len(w.lines), w.url, w.err)
+}
+
+// The request body for the batch, gzipped if configured
+func (w *httpWriter) body() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w.format.encode(buf, w.lines)
+
+	if !w.gzip {
+		return buf.Bytes(), nil
+	}
+
+	gzBuf := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzBuf)
+	if _, err := gz.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return gzBuf.Bytes(), nil
+}
+
+// Makes one request, a negative retry after means trying again won't help
+// Lines the server accepted are removed from the batch, even if it didn't accept all of them
+func (w *httpWriter) send(body []byte) (time.Duration, error) {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+
+	req.Header.Set("Content-Type", w.format.contentType())
+	if w.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	// Reading the body lets the connection be reused
+	rb, err := ioutil.ReadAll(io.LimitReader(resp.Body, HTTP_MAX_RESPONSE))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if err != nil {
+			return 0, fmt.Errorf("Failed to read the response. Error: %s", err)
+		}
+
+		retry, err := w.format.accepted(w, rb, w.lines)
+		if err != nil {
+			return 0, err
+		}
+
+		w.lines = retry
+		w.size = 0
+		for _, l := range retry {
+			w.size += len(l)
+		}
+
+		if len(retry) > 0 {
+			return 0, fmt.Errorf("%d events were not accepted", len(retry))
+		}
+
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		return retryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("Server returned %s", resp.Status)
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge ||
+		resp.StatusCode == http.StatusUnprocessableEntity:
+		// The server didn't like the events, sending them again won't change its mind
+		return -1, fmt.Errorf("Server returned %s", resp.Status)
+	default:
+		// Everything else can pass, like an expired token or a wrong url once the config is fixed, so the events are
+		// kept for the attempts and the spool
+		return 0, fmt.Errorf("Server returned %s", resp.Status)
+	}
+}
+
+// Formats that hold on to events after they were sent, like for acks, implement this to wrap up on Close
+type httpFormatCloser interface {
+	close(w *httpWriter) error
+}
+
+// Close sends whatever is left in the batch
+func (w *httpWriter) Close() error {
+	close(w.done)
+	<-w.flushed
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var err error
+	if len(w.lines) > 0 {
+		err = w.flush()
+	}
+
+	if c, ok := w.format.(httpFormatCloser); ok {
+		if cerr := c.close(w); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Finds the audit time near the start of an encoded message group, it is the second field
+var auditTimeRe = regexp.MustCompile(`"timestamp":"(\d+\.\d+)"`)
+
+// The audit time of an encoded message group as seconds since the epoch, empty if it can't be found
+func auditTime(line []byte) string {
+	if len(line) > 128 {
+		line = line[:128]
+	}
+
+	if m := auditTimeRe.FindSubmatch(line); m != nil {
+		return string(m[1])
+	}
+
+	return ""
+}
+
+// Parses a Retry-After header, which is either a number of seconds or a date
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_httpWriter(t *testing.T) {
+	s := newFakeCollector()
+	defer s.Close()
+
+	w := newTestHTTPWriter(t, s.URL, ndjsonFormat{}, func(c *httpConfig) {
+		c.maxEvents = 2
+		c.headers = map[string]string{"X-Token": "secret"}
+	})
+
+	// Nothing is sent until the batch is full
+	w.Write([]byte("1\n"))
+	assert.Equal(t, 0, len(s.bodies()))
+
+	w.Write([]byte("2\n"))
+	assert.Equal(t, []string{"1\n2\n"}, s.bodies())
+	assert.Equal(t, "application/x-ndjson", s.last().Get("Content-Type"))
+	assert.Equal(t, "secret", s.last().Get("X-Token"))
+
+	// Or it is too big
+	w.maxBytes = 4
+	w.Write([]byte("3\n"))
+	w.Write([]byte("44\n"))
+	assert.Equal(t, []string{"1\n2\n", "3\n"}, s.bodies())
+
+	// Close sends whatever is left
+	assert.Nil(t, w.Close())
+	assert.Equal(t, []string{"1\n2\n", "3\n", "44\n"}, s.bodies())
+}
+
+func Test_httpWriter_array(t *testing.T) {
+	s := newFakeCollector()
+	defer s.Close()
+
+	w := newTestHTTPWriter(t, s.URL, arrayFormat{}, func(c *httpConfig) {
+		c.gzip = true
+		c.interval = time.Millisecond * 10
+	})
+	defer w.Close()
+
+	w.Write([]byte("{\"seq\":1}\n"))
+	w.Write([]byte("{\"seq\":2}\n"))
+
+	// The interval sends the batch before it fills
+	for i := 0; i < 100 && len(s.bodies()) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	assert.Equal(t, 1, len(s.bodies()))
+	assert.Equal(t, "gzip", s.last().Get("Content-Encoding"))
+	assert.Equal(t, "application/json", s.last().Get("Content-Type"))
+
+	msgs := []map[string]int{}
+	assert.Nil(t, json.Unmarshal([]byte(s.bodies()[0]), &msgs))
+	assert.Equal(t, []map[string]int{{"seq": 1}, {"seq": 2}}, msgs)
+}
+
+func Test_httpWriter_retry(t *testing.T) {
+	s := newFakeCollector()
+	defer s.Close()
+
+	w := newTestHTTPWriter(t, s.URL, ndjsonFormat{}, func(c *httpConfig) {
+		c.maxEvents = 1
+		c.maxRetries = 2
+	})
+	defer w.Close()
+
+	// Retried with backoff until it works
+	s.fail(http.StatusInternalServerError, "", 2)
+	_, err := w.Write([]byte("1\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, s.requests())
+	assert.Equal(t, []string{"1\n"}, s.bodies())
+
+	// Retry-After is waited for even when it is longer than max_backoff
+	s.fail(http.StatusTooManyRequests, "1", 1)
+	start := time.Now()
+	w.Write([]byte("2\n"))
+	assert.True(t, time.Since(start) >= time.Second, "Should have waited for Retry-After")
+	assert.Equal(t, []string{"1\n", "2\n"}, s.bodies())
+
+	// Running out of retries keeps the batch and fails the next write
+	s.fail(http.StatusServiceUnavailable, "", 6)
+	_, err = w.Write([]byte("3\n"))
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("4\n"))
+	assert.EqualError(t, err, "Failed to send 1 events to "+s.URL+". Error: Server returned 503 Service Unavailable")
+
+	// Which sends it again first
+	_, err = w.Write([]byte("4\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1\n", "2\n", "3\n", "4\n"}, s.bodies())
+
+	// Client errors aren't retried, the batch is dropped so it doesn't block the ones after it
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	s.fail(http.StatusBadRequest, "", 1)
+	before := s.requests()
+	_, err = w.Write([]byte("5\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, before+1, s.requests())
+	assert.Equal(t, 0, len(w.lines))
+	assert.Equal(t, "Dropping 1 events "+s.URL+" will not accept. Error: Server returned 400 Bad Request\n", elb.String())
+
+	_, err = w.Write([]byte("6\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1\n", "2\n", "3\n", "4\n", "6\n"}, s.bodies())
+
+	// Auth and routing errors go away once fixed, the batch is kept until then
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		elb.Reset()
+		s.fail(status, "", 3)
+		before = s.requests()
+		_, err = w.Write([]byte(strconv.Itoa(status) + "\n"))
+		assert.Nil(t, err)
+		assert.Equal(t, before+3, s.requests(), "%d should be retried", status)
+		assert.Equal(t, 1, len(w.lines), "%d should keep the batch", status)
+		assert.Equal(t, "", elb.String())
+
+		_, err = w.Write([]byte("next\n"))
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(w.lines))
+	}
+
+	bodies := s.bodies()
+	assert.Equal(t, []string{"401\n", "next\n", "403\n", "next\n", "404\n", "next\n"}, bodies[len(bodies)-6:])
+
+	// A Retry-After longer than max_retry_after waits max_retry_after
+	w.maxRetryAfter = time.Millisecond * 100
+	s.fail(http.StatusServiceUnavailable, "86400", 1)
+	start = time.Now()
+	_, err = w.Write([]byte("7\n"))
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= time.Millisecond*100, "Should have waited for max_retry_after")
+	assert.True(t, time.Since(start) < time.Second*5, "Should not have waited for Retry-After")
+	assert.Equal(t, "7\n", s.bodies()[len(s.bodies())-1])
+}
+
+func Test_newHTTPWriter(t *testing.T) {
+	c := httpConfig{}
+	_, err := newHTTPWriter(c, ndjsonFormat{})
+	assert.EqualError(t, err, "A url is required")
+
+	c.url = "http://localhost"
+	_, err = newHTTPWriter(c, ndjsonFormat{})
+	assert.EqualError(t, err, "Batch max_events, max_bytes and interval must be greater than 0")
+
+	c.maxEvents, c.maxBytes, c.interval = 1, 1, time.Second
+	c.minBackoff, c.maxBackoff = time.Second, time.Millisecond
+	_, err = newHTTPWriter(c, ndjsonFormat{})
+	assert.EqualError(t, err, "Retry max_retries must be 0 or more and min_backoff must be greater than 0 and no more than max_backoff")
+
+	c.maxBackoff = time.Second
+	_, err = newHTTPWriter(c, ndjsonFormat{})
+	assert.EqualError(t, err, "Retry max_retry_after must be greater than 0")
+
+	assert.Equal(t, time.Duration(0), retryAfter(""))
+	assert.Equal(t, time.Duration(0), retryAfter("soon"))
+	assert.Equal(t, time.Second*3, retryAfter("3"))
+	d := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, d > time.Second*58 && d <= time.Minute, "A date should be turned into a wait")
+}
+
+func newTestHTTPWriter(t *testing.T, url string, format httpFormat, configure func(*httpConfig)) *httpWriter {
+	c := httpConfig{
+		url:        url,
+		timeout:    time.Second,
+		maxEvents:  100,
+		maxBytes:   1 << 20,
+		interval:   time.Hour,
+		maxRetries: 0,
+		minBackoff: time.Millisecond,
+		maxBackoff: time.Millisecond * 50,
+
+		maxRetryAfter: time.Second * 5,
+	}
+
+	configure(&c)
+
+	w, err := newHTTPWriter(c, format)
+	if err != nil {
+		t.Fatal("Failed to create the http writer:", err)
+	}
+
+	return w
+}
+
+// An http server that records every request body it accepts and can be told to fail
+type fakeCollector struct {
+	*httptest.Server
+	lock       sync.Mutex
+	accepted   []string
+	headers    []http.Header
+	count      int
+	failStatus int
+	failAfter  string
+	failures   int
+}
+
+func newFakeCollector() *fakeCollector {
+	f := &fakeCollector{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeCollector) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.count++
+	if f.failures > 0 {
+		f.failures--
+		if f.failAfter != "" {
+			w.Header().Set("Retry-After", f.failAfter)
+		}
+		w.WriteHeader(f.failStatus)
+		return
+	}
+
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+
+	b, _ := ioutil.ReadAll(body)
+	f.accepted = append(f.accepted, string(b))
+	f.headers = append(f.headers, r.Header)
+}
+
+// Fails the next n requests with status, setting Retry-After if after isn't empty
+func (f *fakeCollector) fail(status int, after string, n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.failStatus, f.failAfter, f.failures = status, after, n
+}
+
+func (f *fakeCollector) bodies() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]string{}, f.accepted...)
+}
+
+func (f *fakeCollector) last() http.Header {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.headers[len(f.headers)-1]
+}
+
+func (f *fakeCollector) requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.count
+}
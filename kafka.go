@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KAFKA_MAX_EVENTS     = 500
+	KAFKA_MAX_BYTES      = 1 << 20 // 1MB
+	KAFKA_FLUSH_INTERVAL = time.Second
+	KAFKA_MAX_RETRIES    = 5
+	KAFKA_MIN_BACKOFF    = time.Millisecond * 500
+	KAFKA_MAX_BACKOFF    = time.Second * 30
+	KAFKA_TIMEOUT        = time.Second * 10
+
+	KAFKA_KEY_NONE     = "none"
+	KAFKA_KEY_HOSTNAME = "hostname"
+	KAFKA_KEY_AUID     = "auid"
+	KAFKA_KEY_SYSCALL  = "syscall"
+)
+
+// Finds the fields a partition key can come from in the raw message data of an encoded message group
+var (
+	kafkaAuidRe    = regexp.MustCompile(`\bauid=(\d+)`)
+	kafkaSyscallRe = regexp.MustCompile(`\bsyscall=(\d+)`)
+)
+
+// What kafkaWriter produces batches with, a kafkaClient outside of tests
+// A failure for only some of the messages is returned as kafkaWriteErrors
+type kafkaProducer interface {
+	Produce(ctx context.Context, msgs []kafkaMessage) error
+	Close() error
+}
+
+type kafkaConfig struct {
+	brokers     []string
+	topic       string
+	key         string
+	hostname    string
+	clientID    string
+	acks        int16
+	compression int8
+	tls         *tls.Config
+	maxEvents   int
+	maxBytes    int
+	interval    time.Duration
+	maxRetries  int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	timeout     time.Duration
+
+	saslMechanism string // Empty if the brokers don't need SASL
+	saslUsername  string
+	saslPassword  string
+}
+
+// kafkaWriter produces lines to a topic in batches, a batch is produced once it is full or interval has passed
+// Messages kafka failed to take are kept and produced again before anything else is added to the batch, until
+// then every write fails so the output can retry or spool like any other. Messages kafka will never take are dropped
+type kafkaWriter struct {
+	kafkaConfig
+	lock     sync.Mutex
+	producer kafkaProducer
+
+	msgs []kafkaMessage
+	size int
+	err  error // Why the current batch failed to produce, nil if it hasn't been tried
+
+	done    chan struct{}
+	flushed chan struct{}
+}
+
+func newKafkaWriter(c kafkaConfig, producer kafkaProducer) (*kafkaWriter, error) {
+	if len(c.brokers) == 0 || c.topic == "" {
+		return nil, errors.New("Brokers and a topic are required")
+	}
+
+	switch c.key {
+	case KAFKA_KEY_NONE, KAFKA_KEY_HOSTNAME, KAFKA_KEY_AUID, KAFKA_KEY_SYSCALL:
+	default:
+		return nil, fmt.Errorf("Key must be one of none, hostname, auid or syscall, `%s` provided", c.key)
+	}
+
+	if c.maxEvents < 1 || c.maxBytes < 1 || c.interval <= 0 {
+		return nil, errors.New("Batch max_events, max_bytes and interval must be greater than 0")
+	}
+
+	w := &kafkaWriter{
+		kafkaConfig: c,
+		producer:    producer,
+		done:        make(chan struct{}),
+		flushed:     make(chan struct{}),
+	}
+
+	go w.flushEvery()
+	return w, nil
+}
+
+// Write adds one line to the batch, producing the batch first if the line doesn't fit
+func (w *kafkaWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.msgs) > 0 && (w.err != nil || len(w.msgs)+1 > w.maxEvents || w.size+len(b) > w.maxBytes) {
+		if err := w.flushUntilClosed(); err != nil {
+			return 0, err
+		}
+	}
+
+	// The encoder reuses b for the next line, kafka doesn't need the newline
+	v := append([]byte(nil), b...)
+	if len(v) > 0 && v[len(v)-1] == '\n' {
+		v = v[:len(v)-1]
+	}
+
+	w.msgs = append(w.msgs, kafkaMessage{Key: w.partitionKey(v), Value: v})
+	w.size += len(b)
+
+	if len(w.msgs) >= w.maxEvents || w.size >= w.maxBytes {
+		// A failure is returned by the next write, which tries the batch again
+		w.flushUntilClosed()
+	}
+
+	return len(b), nil
+}
+
+// The key kafka hashes to pick a partition, nil leaves it to round robin
+func (w *kafkaWriter) partitionKey(line []byte) []byte {
+	var re *regexp.Regexp
+
+	switch w.key {
+	case KAFKA_KEY_HOSTNAME:
+		return []byte(w.hostname)
+	case KAFKA_KEY_AUID:
+		re = kafkaAuidRe
+	case KAFKA_KEY_SYSCALL:
+		re = kafkaSyscallRe
+	default:
+		return nil
+	}
+
+	if m := re.FindSubmatch(line); m != nil {
+		return m[1]
+	}
+
+	return nil
+}
+
+// Produces the batch if there is one every interval, until Close
+func (w *kafkaWriter) flushEvery() {
+	defer close(w.flushed)
+
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-w.done:
+			return
+		}
+
+		w.lock.Lock()
+		if len(w.msgs) > 0 {
+			if err := w.flushUntilClosed(); err != nil {
+				el.Println(err)
+			}
+		}
+		w.lock.Unlock()
+	}
+}
+
+// Produces the batch, giving up once Close is called so closing doesn't wait out the producer's backoff
+func (w *kafkaWriter) flushUntilClosed() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return w.flush(ctx)
+}
+
+// Produces the batch, the producer does its own retries so a failure here is final until the next write
+// Messages kafka took are removed from the batch, even if it didn't take all of them
+func (w *kafkaWriter) flush(ctx context.Context) error {
+	w.err = w.producer.Produce(ctx, w.msgs)
+	if w.err == nil {
+		w.msgs = nil
+		w.size = 0
+		return nil
+	}
+
+	if werrs, ok := w.err.(kafkaWriteErrors); ok && len(werrs) == len(w.msgs) {
+		failed := w.msgs[:0]
+		dropped := 0
+		var reason error
+		for i, m := range w.msgs {
+			switch {
+			case werrs[i] == nil:
+			case !kafkaRetriable(werrs[i]):
+				// Trying again would only hold up the messages behind them
+				dropped++
+				reason = werrs[i]
+			default:
+				failed = append(failed, m)
+			}
+		}
+
+		if dropped > 0 {
+			el.Printf("Dropping %d events %s will not accept. Error: %s\n", dropped, w.topic, reason)
+		}
+
+		w.msgs = failed
+		w.size = 0
+		for _, m := range failed {
+			w.size += len(m.Value) + 1
+		}
+
+		if len(w.msgs) == 0 {
+			w.err = nil
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Failed to produce %d events to %s. Error: %s", len(w.msgs), w.topic, w.err)
+}
+
+// Close produces whatever is left in the batch
+func (w *kafkaWriter) Close() error {
+	close(w.done)
+	<-w.flushed
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// done is closed by now, the last batch gets its own deadline so it still has its retries
+	var err error
+	if len(w.msgs) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+		err = w.flush(ctx)
+		cancel()
+	}
+
+	if cerr := w.producer.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Parses output.kafka.acks into the number of acks a produce request asks for, -1 is all in sync replicas
+func kafkaRequiredAcks(acks string) (int16, error) {
+	switch strings.ToLower(acks) {
+	case "none", "0":
+		return 0, nil
+	case "leader", "1":
+		return 1, nil
+	case "all", "-1":
+		return -1, nil
+	}
+
+	return 0, fmt.Errorf("output.kafka.acks must be none, leader or all, `%s` provided", acks)
+}
+
+// Parses output.kafka.compression
+func kafkaCompression(compression string) (int8, error) {
+	switch strings.ToLower(compression) {
+	case "", "none":
+		return KAFKA_COMPRESSION_NONE, nil
+	case "gzip":
+		return KAFKA_COMPRESSION_GZIP, nil
+	}
+
+	return 0, fmt.Errorf("output.kafka.compression must be none or gzip, `%s` provided", compression)
+}
@@ -0,0 +1,839 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	KAFKA_API_PRODUCE           int16 = 0
+	KAFKA_API_METADATA          int16 = 3
+	KAFKA_API_SASL_HANDSHAKE    int16 = 17
+	KAFKA_API_SASL_AUTHENTICATE int16 = 36
+
+	// Partitions can be added to a topic, the metadata is fetched again after this long even if nothing failed
+	KAFKA_METADATA_MAX_AGE = time.Minute * 5
+
+	// A response bigger than this means we have lost our place in the stream
+	KAFKA_MAX_RESPONSE = 1 << 26 // 64MB
+
+	// Values of the compression bits in a record batch's attributes
+	KAFKA_COMPRESSION_NONE int8 = 0
+	KAFKA_COMPRESSION_GZIP int8 = 1
+)
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// An error code from a broker
+type kafkaError int16
+
+var kafkaErrorNames = map[kafkaError]string{
+	-1: "UNKNOWN_SERVER_ERROR",
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	8:  "BROKER_NOT_AVAILABLE",
+	10: "MESSAGE_TOO_LARGE",
+	13: "NETWORK_EXCEPTION",
+	17: "INVALID_TOPIC_EXCEPTION",
+	18: "RECORD_LIST_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	21: "INVALID_REQUIRED_ACKS",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	35: "UNSUPPORTED_VERSION",
+	56: "KAFKA_STORAGE_ERROR",
+	58: "SASL_AUTHENTICATION_FAILED",
+	76: "UNSUPPORTED_COMPRESSION_TYPE",
+	87: "INVALID_RECORD",
+}
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return fmt.Sprintf("Kafka error %d %s", int16(e), name)
+	}
+
+	return fmt.Sprintf("Kafka error %d", int16(e))
+}
+
+// Errors that can go away once the cluster settles or the metadata is fetched again
+func (e kafkaError) retriable() bool {
+	switch e {
+	case 2, 3, 5, 6, 7, 8, 13, 19, 20, 56:
+		return true
+	}
+
+	return false
+}
+
+// Anything that isn't an error code from a broker is a connection problem and worth trying again
+func kafkaRetriable(err error) bool {
+	if ke, ok := err.(kafkaError); ok {
+		return ke.retriable()
+	}
+
+	return true
+}
+
+// A message to produce, a nil key leaves the partition to round robin
+type kafkaMessage struct {
+	Key   []byte
+	Value []byte
+}
+
+// Returned when some messages weren't produced, one entry per message with nil for the ones kafka took
+type kafkaWriteErrors []error
+
+func (e kafkaWriteErrors) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+
+	if failed == len(e) {
+		return first.Error()
+	}
+
+	return fmt.Sprintf("%d of %d messages failed, %s", failed, len(e), first)
+}
+
+// kafkaClient produces to one topic over the kafka protocol, it finds partition leaders from the metadata of the
+// bootstrap brokers and keeps a connection to each leader. Connections are opened when first needed and dropped,
+// along with the metadata, on any error. It is only used under the kafkaWriter lock so it isn't safe for concurrent use
+type kafkaClient struct {
+	kafkaConfig
+
+	nodes   map[int32]string // Broker addresses by node id
+	leaders []int32          // The leader of each partition by partition id, -1 if it has none, nil to fetch them again
+	fetched time.Time
+	conns   map[int32]*kafkaConn
+	next    int // Partition the next message without a key goes to
+}
+
+func newKafkaClient(c kafkaConfig) *kafkaClient {
+	return &kafkaClient{
+		kafkaConfig: c,
+		conns:       map[int32]*kafkaConn{},
+	}
+}
+
+// Produce writes msgs to the topic, retrying with backoff whatever failed for a reason that may go away
+// Cancelling ctx stops waiting out the backoff, the last failures are returned
+func (c *kafkaClient) Produce(ctx context.Context, msgs []kafkaMessage) error {
+	errs := make(kafkaWriteErrors, len(msgs))
+	pending := make([]int, len(msgs))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	backoff := c.minBackoff
+	for attempt := 0; ; attempt++ {
+		pending = c.produce(msgs, pending, errs)
+		if len(pending) == 0 || attempt >= c.maxRetries {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errs
+		}
+
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+
+	return nil
+}
+
+// Makes one attempt at producing the pending messages, errs is updated for each of them
+// Returns the messages that should be tried again
+func (c *kafkaClient) produce(msgs []kafkaMessage, pending []int, errs kafkaWriteErrors) []int {
+	if c.leaders == nil || time.Since(c.fetched) > KAFKA_METADATA_MAX_AGE {
+		if err := c.refresh(); err != nil {
+			for _, i := range pending {
+				errs[i] = err
+			}
+
+			if !kafkaRetriable(err) {
+				return nil
+			}
+
+			return pending
+		}
+	}
+
+	retry := []int{}
+	fail := func(i int, err error) {
+		errs[i] = err
+		if kafkaRetriable(err) {
+			retry = append(retry, i)
+		}
+	}
+
+	// Messages grouped by leader and then partition, so there is one request per broker
+	requests := map[int32]map[int32][]int{}
+	for _, i := range pending {
+		p := c.partition(msgs[i].Key)
+		if p < 0 || c.leaders[p] < 0 {
+			fail(i, kafkaError(5))
+			continue
+		}
+
+		leader := c.leaders[p]
+		if requests[leader] == nil {
+			requests[leader] = map[int32][]int{}
+		}
+		requests[leader][p] = append(requests[leader][p], i)
+	}
+
+	for leader, partitions := range requests {
+		results, err := c.send(leader, msgs, partitions)
+		for p, idxs := range partitions {
+			perr := err
+			if perr == nil {
+				perr = results[p]
+			}
+
+			for _, i := range idxs {
+				if perr == nil {
+					errs[i] = nil
+					continue
+				}
+
+				fail(i, perr)
+			}
+
+			// Leadership may have moved
+			if perr != nil {
+				c.leaders = nil
+			}
+		}
+	}
+
+	return retry
+}
+
+// Picks the partition for a message, messages with the same key always go to the same partition
+// -1 is returned if no partition has a leader
+func (c *kafkaClient) partition(key []byte) int32 {
+	if key != nil {
+		// The same as the java client, so keys land where every other producer puts them
+		return int32(kafkaMurmur2(key)&0x7fffffff) % int32(len(c.leaders))
+	}
+
+	for range c.leaders {
+		p := c.next % len(c.leaders)
+		c.next++
+		if c.leaders[p] >= 0 {
+			return int32(p)
+		}
+	}
+
+	return -1
+}
+
+// The murmur2 variant kafka's default partitioner hashes keys with
+func kafkaMurmur2(key []byte) uint32 {
+	const m = 0x5bd1e995
+
+	h := uint32(0x9747b28c) ^ uint32(len(key))
+	n := len(key) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(key[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	switch len(key) & 3 {
+	case 3:
+		h ^= uint32(key[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(key[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(key[n])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// Produces the messages in partitions to their leader, returning the error for each partition, nil if it took them
+func (c *kafkaClient) send(leader int32, msgs []kafkaMessage, partitions map[int32][]int) (map[int32]error, error) {
+	conn, err := c.conn(leader)
+	if err != nil {
+		return nil, err
+	}
+
+	var e kafkaEncoder
+	e.int16(-1) // No transactional id
+	e.int16(c.acks)
+	e.int32(int32(c.timeout / time.Millisecond))
+	e.int32(1)
+	e.string(c.topic)
+	e.int32(int32(len(partitions)))
+
+	now := time.Now()
+	for p, idxs := range partitions {
+		batch, err := kafkaRecordBatch(msgs, idxs, c.compression, now)
+		if err != nil {
+			return nil, err
+		}
+
+		e.int32(p)
+		e.bytes(batch)
+	}
+
+	// Nothing comes back when no acks are required
+	resp, err := conn.request(KAFKA_API_PRODUCE, 3, e.Bytes(), c.acks != 0)
+	if err != nil {
+		c.drop(leader)
+		return nil, err
+	}
+
+	results := map[int32]error{}
+	for p := range partitions {
+		if c.acks == 0 {
+			results[p] = nil
+		} else {
+			results[p] = fmt.Errorf("Broker %d did not answer for partition %d", leader, p)
+		}
+	}
+
+	if c.acks == 0 {
+		return results, nil
+	}
+
+	d := &kafkaDecoder{b: resp}
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		topic := d.string()
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			p, code := d.int32(), kafkaError(d.int16())
+			d.int64() // Base offset
+			d.int64() // Log append time
+
+			if _, ok := results[p]; !ok || topic != c.topic {
+				continue
+			}
+
+			if code != 0 {
+				results[p] = code
+			} else {
+				results[p] = nil
+			}
+		}
+	}
+
+	if d.err != nil {
+		c.drop(leader)
+		return nil, fmt.Errorf("Failed to read the produce response from broker %d. Error: %s", leader, d.err)
+	}
+
+	return results, nil
+}
+
+// Fetches the brokers and the partition leaders for the topic from the first bootstrap broker that answers
+func (c *kafkaClient) refresh() error {
+	var err error
+	for _, addr := range c.brokers {
+		var conn *kafkaConn
+		if conn, err = c.dial(addr); err != nil {
+			continue
+		}
+
+		err = c.metadata(conn)
+		conn.Close()
+		if err == nil || !kafkaRetriable(err) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("Failed to get metadata from any broker. Error: %s", err)
+}
+
+func (c *kafkaClient) metadata(conn *kafkaConn) error {
+	var e kafkaEncoder
+	e.int32(1)
+	e.string(c.topic)
+	e.int8(1) // Let the broker create the topic if it is set up to
+
+	resp, err := conn.request(KAFKA_API_METADATA, 4, e.Bytes(), true)
+	if err != nil {
+		return err
+	}
+
+	d := &kafkaDecoder{b: resp}
+	d.int32() // Throttle time
+
+	nodes := map[int32]string{}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string() // Rack
+		nodes[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+
+	d.string() // Cluster id
+	d.int32()  // Controller id
+
+	var leaders []int32
+	var topicErr error
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code, name := kafkaError(d.int16()), d.string()
+		d.int8() // Is internal
+
+		partitions := d.int32()
+		if name == c.topic {
+			if code != 0 {
+				topicErr = code
+			}
+			leaders = make([]int32, 0, partitions)
+		}
+
+		for ; partitions > 0 && d.err == nil; partitions-- {
+			d.int16() // Partition error, the leader is what matters
+			p, leader := d.int32(), d.int32()
+			d.int32s() // Replicas
+			d.int32s() // In sync replicas
+
+			if name != c.topic {
+				continue
+			}
+
+			for int(p) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			leaders[p] = leader
+		}
+	}
+
+	if d.err != nil {
+		return fmt.Errorf("Failed to read the metadata response. Error: %s", d.err)
+	}
+
+	if topicErr != nil {
+		return topicErr
+	}
+
+	if len(leaders) == 0 {
+		// Usually a topic that is still being created
+		return kafkaError(3)
+	}
+
+	// Connections to brokers that moved are no good
+	for id, conn := range c.conns {
+		if nodes[id] != conn.addr {
+			c.drop(id)
+		}
+	}
+
+	c.nodes = nodes
+	c.leaders = leaders
+	c.fetched = time.Now()
+	return nil
+}
+
+// Returns the connection to a broker, connecting if there isn't one
+func (c *kafkaClient) conn(id int32) (*kafkaConn, error) {
+	if conn, ok := c.conns[id]; ok {
+		return conn, nil
+	}
+
+	addr, ok := c.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("Broker %d is not in the metadata", id)
+	}
+
+	conn, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.conns[id] = conn
+	return conn, nil
+}
+
+func (c *kafkaClient) drop(id int32) {
+	if conn, ok := c.conns[id]; ok {
+		conn.Close()
+		delete(c.conns, id)
+	}
+}
+
+// Connects to a broker, with TLS and SASL if they are configured
+func (c *kafkaClient) dial(addr string) (*kafkaConn, error) {
+	d := &net.Dialer{Timeout: c.timeout}
+
+	var nc net.Conn
+	var err error
+	if c.tls != nil {
+		nc, err = tls.DialWithDialer(d, "tcp", addr, c.tls)
+	} else {
+		nc, err = d.Dial("tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &kafkaConn{Conn: nc, addr: addr, clientID: c.clientID, timeout: c.timeout}
+	if c.saslMechanism == "" {
+		return conn, nil
+	}
+
+	if err := conn.authenticate(c.saslMechanism, c.saslUsername, c.saslPassword); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("Failed to authenticate with %s. Error: %s", addr, err)
+	}
+
+	return conn, nil
+}
+
+// Close closes every broker connection
+func (c *kafkaClient) Close() error {
+	for id := range c.conns {
+		c.drop(id)
+	}
+
+	return nil
+}
+
+// A connection to one broker
+type kafkaConn struct {
+	net.Conn
+	addr        string
+	clientID    string
+	timeout     time.Duration
+	correlation int32
+}
+
+// Sends a request and, if wait is set, reads the response body
+func (k *kafkaConn) request(api, version int16, body []byte, wait bool) ([]byte, error) {
+	k.correlation++
+
+	var e kafkaEncoder
+	e.int32(0) // Size, filled in below
+	e.int16(api)
+	e.int16(version)
+	e.int32(k.correlation)
+	e.string(k.clientID)
+	e.Write(body)
+
+	req := e.Bytes()
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+
+	k.SetDeadline(time.Now().Add(k.timeout))
+	if _, err := k.Write(req); err != nil {
+		return nil, err
+	}
+
+	if !wait {
+		return nil, nil
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(k, size[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > KAFKA_MAX_RESPONSE {
+		return nil, fmt.Errorf("Broker sent a %d byte response", n)
+	}
+
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(k, resp); err != nil {
+		return nil, err
+	}
+
+	if c := int32(binary.BigEndian.Uint32(resp)); c != k.correlation {
+		return nil, fmt.Errorf("Broker answered request %d instead of %d", c, k.correlation)
+	}
+
+	return resp[4:], nil
+}
+
+func (k *kafkaConn) authenticate(mechanism, username, password string) error {
+	var e kafkaEncoder
+	e.string(mechanism)
+
+	resp, err := k.request(KAFKA_API_SASL_HANDSHAKE, 1, e.Bytes(), true)
+	if err != nil {
+		return err
+	}
+
+	d := &kafkaDecoder{b: resp}
+	code := kafkaError(d.int16())
+	enabled := []string{}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		enabled = append(enabled, d.string())
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("%s, the broker accepts %v", code, enabled)
+	}
+
+	return kafkaSASL(mechanism, username, password, func(msg []byte) ([]byte, error) {
+		var e kafkaEncoder
+		e.bytes(msg)
+
+		resp, err := k.request(KAFKA_API_SASL_AUTHENTICATE, 0, e.Bytes(), true)
+		if err != nil {
+			return nil, err
+		}
+
+		d := &kafkaDecoder{b: resp}
+		code, message, reply := kafkaError(d.int16()), d.string(), d.bytes()
+		if d.err != nil {
+			return nil, d.err
+		}
+
+		if code != 0 {
+			return nil, fmt.Errorf("%s %s", code, message)
+		}
+
+		return reply, nil
+	})
+}
+
+// Encodes the messages at idxs as a v2 record batch, the records are compressed with codec
+func kafkaRecordBatch(msgs []kafkaMessage, idxs []int, codec int8, now time.Time) ([]byte, error) {
+	var records kafkaEncoder
+	for delta, i := range idxs {
+		var r kafkaEncoder
+		r.int8(0)   // Attributes
+		r.varint(0) // Timestamp delta
+		r.varint(int64(delta))
+
+		if msgs[i].Key == nil {
+			r.varint(-1)
+		} else {
+			r.varint(int64(len(msgs[i].Key)))
+			r.Write(msgs[i].Key)
+		}
+
+		r.varint(int64(len(msgs[i].Value)))
+		r.Write(msgs[i].Value)
+		r.varint(0) // Headers
+
+		records.varint(int64(r.Len()))
+		records.Write(r.Bytes())
+	}
+
+	compressed, err := kafkaCompress(codec, records.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	ts := now.UnixNano() / int64(time.Millisecond)
+
+	var b kafkaEncoder
+	b.int64(0)  // Base offset, the broker assigns offsets
+	b.int32(0)  // Length, filled in below
+	b.int32(-1) // Partition leader epoch
+	b.int8(2)   // Magic
+	b.int32(0)  // CRC, filled in below
+	b.int16(int16(codec))
+	b.int32(int32(len(idxs) - 1)) // Last offset delta
+	b.int64(ts)
+	b.int64(ts)
+	b.int64(-1) // Producer id, epoch and base sequence, we aren't idempotent
+	b.int16(-1)
+	b.int32(-1)
+	b.int32(int32(len(idxs)))
+	b.Write(compressed)
+
+	batch := b.Bytes()
+	binary.BigEndian.PutUint32(batch[8:], uint32(len(batch)-12))
+	binary.BigEndian.PutUint32(batch[17:], crc32.Checksum(batch[21:], kafkaCRCTable))
+	return batch, nil
+}
+
+// Compresses the records of a batch with codec
+func kafkaCompress(codec int8, b []byte) ([]byte, error) {
+	switch codec {
+	case KAFKA_COMPRESSION_NONE:
+		return b, nil
+	case KAFKA_COMPRESSION_GZIP:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(b); err != nil {
+			return nil, err
+		}
+
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown compression codec %d", codec)
+}
+
+// Writes the big endian integers, length prefixed strings and zigzag varints of the kafka protocol
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// Reads what kafkaEncoder writes, err is set by the first read past the end and later reads return zeros
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(d.b) < n {
+		d.err = errors.New("Response is too short")
+		return nil
+	}
+
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errors.New("Bad varint")
+		return 0
+	}
+
+	d.b = d.b[n:]
+	return v
+}
+
+// A length of -1 is a null string, which is read as empty
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *kafkaDecoder) int32s() []int32 {
+	var v []int32
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		v = append(v, d.int32())
+	}
+	return v
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_kafkaClient(t *testing.T) {
+	b := newFakeBroker(t, 1)
+	defer b.Close()
+	b.lead(1, 1, 1)
+
+	for _, codec := range []int8{KAFKA_COMPRESSION_NONE, KAFKA_COMPRESSION_GZIP} {
+		b.reset()
+		c := newTestKafkaClient(b.Addr().String())
+		c.compression = codec
+
+		err := c.Produce(context.Background(), []kafkaMessage{
+			{Value: []byte("1")},
+			{Value: []byte("2")},
+			{Value: []byte("3")},
+			{Key: []byte("1000"), Value: []byte("4")},
+			{Key: []byte("1000"), Value: []byte("5")},
+		})
+		assert.Nil(t, err)
+
+		// Messages without a key go round robin, ones with the same key go to the same partition in order
+		expected := map[int32][]string{0: {"1"}, 1: {"2"}, 2: {"3"}}
+		p := c.partition([]byte("1000"))
+		expected[p] = append(expected[p], "4", "5")
+		assert.Equal(t, expected, b.values(), "codec %d", codec)
+		assert.Equal(t, []byte("1000"), b.received[p][len(b.received[p])-1].Key)
+		assert.Nil(t, b.received[0][0].Key)
+
+		assert.Equal(t, codec, b.codec)
+		assert.Equal(t, "go-audit-test", b.clientID)
+		assert.Equal(t, 1, b.count(KAFKA_API_METADATA))
+		assert.Equal(t, 1, b.count(KAFKA_API_PRODUCE), "One request should carry every partition")
+		c.Close()
+	}
+}
+
+func Test_kafkaClient_retry(t *testing.T) {
+	b := newFakeBroker(t, 1)
+	defer b.Close()
+	b.lead(1, 1)
+
+	c := newTestKafkaClient(b.Addr().String())
+	defer c.Close()
+
+	// A leader that moved is found again from the metadata
+	b.failNext(0, 6)
+	assert.Nil(t, c.Produce(context.Background(), []kafkaMessage{{Value: []byte("1")}, {Value: []byte("2")}}))
+	assert.Equal(t, map[int32][]string{0: {"1"}, 1: {"2"}}, b.values())
+	assert.Equal(t, 2, b.count(KAFKA_API_METADATA))
+	assert.Equal(t, 2, b.count(KAFKA_API_PRODUCE))
+
+	// Errors that won't go away aren't retried and only the messages they hit fail
+	c.next = 0
+	b.failNext(1, 10)
+	err := c.Produce(context.Background(), []kafkaMessage{{Value: []byte("3")}, {Value: []byte("4")}})
+	assert.EqualError(t, err, "1 of 2 messages failed, Kafka error 10 MESSAGE_TOO_LARGE")
+	assert.Equal(t, kafkaWriteErrors{nil, kafkaError(10)}, err)
+	assert.Equal(t, 3, b.count(KAFKA_API_PRODUCE))
+
+	// Running out of retries returns the last error
+	b.failNext(0, 6, 6, 6)
+	b.failNext(1, 6, 6, 6)
+	err = c.Produce(context.Background(), []kafkaMessage{{Value: []byte("5")}})
+	assert.EqualError(t, err, "Kafka error 6 NOT_LEADER_OR_FOLLOWER")
+	assert.Equal(t, 6, b.count(KAFKA_API_PRODUCE))
+}
+
+func Test_kafkaClient_leaders(t *testing.T) {
+	b1 := newFakeBroker(t, 1)
+	defer b1.Close()
+	b2 := newFakeBroker(t, 2)
+	defer b2.Close()
+
+	// Each partition is produced to its own leader, partitions without one are skipped over
+	b1.nodes[2] = b2.Addr().String()
+	b1.lead(1, 2, -1)
+
+	c := newTestKafkaClient(b1.Addr().String())
+	defer c.Close()
+
+	assert.Nil(t, c.Produce(context.Background(), []kafkaMessage{{Value: []byte("1")}, {Value: []byte("2")}, {Value: []byte("3")}}))
+	assert.Equal(t, map[int32][]string{0: {"1", "3"}}, b1.values())
+	assert.Equal(t, map[int32][]string{1: {"2"}}, b2.values())
+	assert.Equal(t, 0, b2.count(KAFKA_API_METADATA))
+
+	// A key for a partition without a leader fails once the retries run out
+	key := []byte{}
+	for i := 0; c.partition(key) != 2; i++ {
+		key = []byte(strconv.Itoa(i))
+	}
+
+	err := c.Produce(context.Background(), []kafkaMessage{{Key: key, Value: []byte("4")}})
+	assert.EqualError(t, err, "Kafka error 5 LEADER_NOT_AVAILABLE")
+
+	// Not knowing the topic is retried too
+	b1.lead()
+	c.leaders = nil
+	err = c.Produce(context.Background(), []kafkaMessage{{Value: []byte("5")}})
+	assert.EqualError(t, err, "Failed to get metadata from any broker. Error: Kafka error 3 UNKNOWN_TOPIC_OR_PARTITION")
+	assert.Equal(t, 4, b1.count(KAFKA_API_METADATA))
+}
+
+func Test_kafkaClient_acks(t *testing.T) {
+	b := newFakeBroker(t, 1)
+	defer b.Close()
+	b.lead(1)
+
+	// Nothing comes back when no acks are required
+	c := newTestKafkaClient(b.Addr().String())
+	c.acks = 0
+	defer c.Close()
+
+	assert.Nil(t, c.Produce(context.Background(), []kafkaMessage{{Value: []byte("1")}}))
+	for i := 0; i < 100 && b.count(KAFKA_API_PRODUCE) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	assert.Equal(t, map[int32][]string{0: {"1"}}, b.values())
+	assert.Equal(t, int16(0), b.acks)
+}
+
+func Test_kafkaClient_sasl(t *testing.T) {
+	for _, mechanism := range []string{KAFKA_SASL_PLAIN, KAFKA_SASL_SCRAM_SHA_256} {
+		b := newFakeBroker(t, 1)
+		b.lead(1)
+		b.lock.Lock()
+		b.sasl, b.username, b.password = mechanism, "audit", "secret"
+		b.lock.Unlock()
+
+		c := newTestKafkaClient(b.Addr().String())
+		c.saslMechanism, c.saslUsername, c.saslPassword = mechanism, "audit", "secret"
+		assert.Nil(t, c.Produce(context.Background(), []kafkaMessage{{Value: []byte("1")}}), mechanism)
+		assert.Equal(t, map[int32][]string{0: {"1"}}, b.values())
+		c.Close()
+
+		c = newTestKafkaClient(b.Addr().String())
+		c.maxRetries = 0
+		c.saslMechanism, c.saslUsername, c.saslPassword = mechanism, "audit", "wrong"
+		err := c.Produce(context.Background(), []kafkaMessage{{Value: []byte("2")}})
+		assert.EqualError(t, err, "Failed to get metadata from any broker. Error: Failed to authenticate with "+b.Addr().String()+". Error: Kafka error 58 SASL_AUTHENTICATION_FAILED Authentication failed", mechanism)
+		c.Close()
+
+		// The broker lists what it accepts when the mechanism is wrong
+		c = newTestKafkaClient(b.Addr().String())
+		c.maxRetries = 0
+		c.saslMechanism = KAFKA_SASL_SCRAM_SHA_512
+		err = c.Produce(context.Background(), []kafkaMessage{{Value: []byte("2")}})
+		assert.EqualError(t, err, "Failed to get metadata from any broker. Error: Failed to authenticate with "+b.Addr().String()+". Error: Kafka error 33 UNSUPPORTED_SASL_MECHANISM, the broker accepts ["+mechanism+"]")
+		c.Close()
+
+		b.Close()
+	}
+}
+
+func Test_kafkaClient_down(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := newTestKafkaClient(addr)
+	c.maxRetries = 1
+	err = c.Produce(context.Background(), []kafkaMessage{{Value: []byte("1")}})
+	assert.Contains(t, err.Error(), "Failed to get metadata from any broker. Error: dial tcp "+addr)
+
+	// Cancelling stops the backoff
+	c.maxRetries = 100
+	c.minBackoff, c.maxBackoff = time.Hour, time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*10, cancel)
+
+	start := time.Now()
+	assert.NotNil(t, c.Produce(ctx, []kafkaMessage{{Value: []byte("1")}}))
+	assert.True(t, time.Since(start) < time.Second, "Produce should have stopped once cancelled")
+}
+
+func Test_kafkaRecordBatch(t *testing.T) {
+	msgs := []kafkaMessage{{Value: []byte("skipped")}, {Key: []byte("k"), Value: []byte("v")}, {Value: []byte("")}}
+	batch, err := kafkaRecordBatch(msgs, []int{1, 2}, KAFKA_COMPRESSION_NONE, time.Unix(1500000000, 0))
+	assert.Nil(t, err)
+
+	decoded, codec, err := decodeRecordBatch(batch)
+	assert.Nil(t, err)
+	assert.Equal(t, KAFKA_COMPRESSION_NONE, codec)
+	assert.Equal(t, []kafkaMessage{{Key: []byte("k"), Value: []byte("v")}, {Value: []byte{}}}, decoded)
+
+	// Magic 2 and the timestamps in milliseconds
+	assert.Equal(t, byte(2), batch[16])
+	assert.Equal(t, uint64(1500000000000), binary.BigEndian.Uint64(batch[27:]))
+
+	batch[len(batch)-1]++
+	_, _, err = decodeRecordBatch(batch)
+	assert.EqualError(t, err, "bad crc")
+}
+
+func Test_kafkaCompress(t *testing.T) {
+	line := []byte(`{"sequence":1,"timestamp":"1500000000.123","messages":[{"type":1300,"data":"arch=c000003e syscall=59 success=yes exit=0 ppid=1 pid=2 auid=1000 uid=0"}]}` + "\n")
+	events := bytes.Repeat(line, 3000)
+
+	c, err := kafkaCompress(KAFKA_COMPRESSION_NONE, events)
+	assert.Nil(t, err)
+	assert.Equal(t, events, c)
+
+	// Repetitive audit events should shrink a lot
+	c, err = kafkaCompress(KAFKA_COMPRESSION_GZIP, events)
+	assert.Nil(t, err)
+	assert.True(t, len(c) < len(events)/10, "compressed to %d", len(c))
+
+	out, err := kafkaDecompress(KAFKA_COMPRESSION_GZIP, c)
+	assert.Nil(t, err)
+	assert.Equal(t, events, out)
+
+	_, err = kafkaCompress(2, line)
+	assert.EqualError(t, err, "Unknown compression codec 2")
+}
+
+func Test_kafkaMurmur2(t *testing.T) {
+	// The cases kafka's own tests check its murmur2 against
+	var ts = []struct {
+		key      string
+		expected int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+
+	for _, ta := range ts {
+		assert.Equal(t, ta.expected, int32(kafkaMurmur2([]byte(ta.key))), ta.key)
+	}
+
+	// The sign bit is masked off before taking the partition, like toPositive in the java client
+	c := &kafkaClient{leaders: make([]int32, 7)}
+	assert.Equal(t, int32((-973932308&0x7fffffff)%7), c.partition([]byte("21")))
+	assert.Equal(t, int32(479470107%7), c.partition([]byte("abc")))
+}
+
+func newTestKafkaClient(brokers ...string) *kafkaClient {
+	return newKafkaClient(kafkaConfig{
+		brokers:    brokers,
+		topic:      "audit",
+		clientID:   "go-audit-test",
+		acks:       -1,
+		timeout:    time.Second,
+		maxRetries: 2,
+		minBackoff: time.Millisecond,
+		maxBackoff: time.Millisecond * 10,
+	})
+}
+
+// A broker that speaks just enough of the protocol for kafkaClient and records what is produced to it
+type fakeBroker struct {
+	net.Listener
+	id int32
+
+	lock     sync.Mutex
+	nodes    map[int32]string // Returned in the metadata
+	leaders  []int32          // Leader of each partition of the topic, nil if the topic doesn't exist
+	failures map[int32][]int16
+	received map[int32][]kafkaMessage
+	requests map[int16]int
+	clientID string
+	acks     int16
+	codec    int8
+
+	sasl     string // Mechanism to require, empty for none
+	username string
+	password string
+}
+
+func newFakeBroker(t *testing.T, id int32) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBroker{Listener: l, id: id, nodes: map[int32]string{id: l.Addr().String()}}
+	b.reset()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+
+	return b
+}
+
+func (b *fakeBroker) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures = map[int32][]int16{}
+	b.received = map[int32][]kafkaMessage{}
+	b.requests = map[int16]int{}
+}
+
+// Sets the leader of each partition, no leaders removes the topic
+func (b *fakeBroker) lead(leaders ...int32) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.leaders = leaders
+}
+
+// Answers the next produces to a partition with codes
+func (b *fakeBroker) failNext(p int32, codes ...int16) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures[p] = append(b.failures[p], codes...)
+}
+
+func (b *fakeBroker) values() map[int32][]string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	v := map[int32][]string{}
+	for p, msgs := range b.received {
+		for _, m := range msgs {
+			v[p] = append(v[p], string(m.Value))
+		}
+	}
+
+	return v
+}
+
+func (b *fakeBroker) count(api int16) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.requests[api]
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+
+	b.lock.Lock()
+	authenticated := b.sasl == ""
+	b.lock.Unlock()
+
+	var scram []string // The client first and server first messages of a SCRAM exchange
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+
+		d := &kafkaDecoder{b: req}
+		api := d.int16()
+		d.int16() // Version
+		correlation := d.int32()
+		clientID := d.string()
+
+		b.lock.Lock()
+		b.requests[api]++
+		b.clientID = clientID
+		b.lock.Unlock()
+
+		var e kafkaEncoder
+		answer := true
+		switch {
+		case api == KAFKA_API_SASL_HANDSHAKE:
+			if d.string() == b.sasl {
+				e.int16(0)
+			} else {
+				e.int16(33)
+			}
+			e.int32(1)
+			e.string(b.sasl)
+		case api == KAFKA_API_SASL_AUTHENTICATE:
+			reply, ok := b.authenticate(d.bytes(), &scram)
+			if ok {
+				e.int16(0)
+				e.int16(-1)
+				authenticated = len(scram) == 0
+			} else {
+				e.int16(58)
+				e.string("Authentication failed")
+			}
+			e.bytes(reply)
+		case !authenticated:
+			return
+		case api == KAFKA_API_METADATA:
+			b.metadata(&e)
+		case api == KAFKA_API_PRODUCE:
+			answer = b.produce(d, &e)
+		default:
+			return
+		}
+
+		if !answer {
+			continue
+		}
+
+		var resp kafkaEncoder
+		resp.int32(int32(e.Len() + 4))
+		resp.int32(correlation)
+		resp.Write(e.Bytes())
+		if _, err := c.Write(resp.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// Checks one SASL message, scram holds the exchange so far and is emptied once it is done
+func (b *fakeBroker) authenticate(msg []byte, scram *[]string) ([]byte, bool) {
+	if b.sasl == KAFKA_SASL_PLAIN {
+		return nil, string(msg) == "\x00"+b.username+"\x00"+b.password
+	}
+
+	salt, iterations := []byte("pepper"), 64
+	if len(*scram) == 0 {
+		clientFirst := strings.TrimPrefix(string(msg), "n,,")
+		serverFirst := "r=" + scramAttributes(clientFirst)["r"] + "server,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=" + strconv.Itoa(iterations)
+		*scram = []string{clientFirst, serverFirst}
+		return []byte(serverFirst), scramAttributes(clientFirst)["n"] == b.username
+	}
+
+	final := string(msg)
+	withoutProof := final[:strings.Index(final, ",p=")]
+	authMessage := []byte((*scram)[0] + "," + (*scram)[1] + "," + withoutProof)
+	*scram = nil
+
+	salted := pbkdf2(sha256.New, []byte(b.password), salt, iterations, sha256.Size)
+	clientKey := hmacSum(sha256.New, salted, []byte("Client Key"))
+	stored := sha256.Sum256(clientKey)
+	proof := hmacSum(sha256.New, stored[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	if !hmac.Equal([]byte(scramAttributes(final)["p"]), []byte(base64.StdEncoding.EncodeToString(proof))) {
+		return nil, false
+	}
+
+	signature := hmacSum(sha256.New, hmacSum(sha256.New, salted, []byte("Server Key")), authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(signature)), true
+}
+
+func (b *fakeBroker) metadata(e *kafkaEncoder) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	e.int32(0) // Throttle time
+	e.int32(int32(len(b.nodes)))
+	for id, addr := range b.nodes {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		e.int32(id)
+		e.string(host)
+		e.int32(int32(p))
+		e.int16(-1) // Rack
+	}
+
+	e.int16(-1) // Cluster id
+	e.int32(b.id)
+
+	e.int32(1)
+	if b.leaders == nil {
+		e.int16(3)
+	} else {
+		e.int16(0)
+	}
+	e.string("audit")
+	e.int8(0)
+
+	// Partitions are listed backwards to make sure they are put in order
+	e.int32(int32(len(b.leaders)))
+	for p := len(b.leaders) - 1; p >= 0; p-- {
+		e.int16(0)
+		e.int32(int32(p))
+		e.int32(b.leaders[p])
+		e.int32(0) // Replicas
+		e.int32(0) // In sync replicas
+	}
+}
+
+// Records the batches in a produce request, returns false when no answer is wanted
+func (b *fakeBroker) produce(d *kafkaDecoder, e *kafkaEncoder) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	d.string() // Transactional id
+	b.acks = d.int16()
+	d.int32() // Timeout
+
+	topics := d.int32()
+	e.int32(topics)
+	for ; topics > 0; topics-- {
+		e.string(d.string())
+
+		partitions := d.int32()
+		e.int32(partitions)
+		for ; partitions > 0; partitions-- {
+			p, batch := d.int32(), d.bytes()
+
+			var code int16
+			if f := b.failures[p]; len(f) > 0 {
+				code, b.failures[p] = f[0], f[1:]
+			} else if msgs, codec, err := decodeRecordBatch(batch); err != nil {
+				code = 2
+			} else {
+				b.received[p] = append(b.received[p], msgs...)
+				b.codec = codec
+			}
+
+			e.int32(p)
+			e.int16(code)
+			e.int64(0)  // Base offset
+			e.int64(-1) // Log append time
+		}
+	}
+
+	e.int32(0) // Throttle time
+	return b.acks != 0
+}
+
+// Undoes kafkaCompress, for checking what a broker would read
+func kafkaDecompress(codec int8, b []byte) ([]byte, error) {
+	if codec != KAFKA_COMPRESSION_GZIP {
+		return b, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(gz)
+}
+
+// Reads a v2 record batch the way a broker would
+func decodeRecordBatch(batch []byte) ([]kafkaMessage, int8, error) {
+	d := &kafkaDecoder{b: batch}
+	d.int64() // Base offset
+	if int(d.int32()) != len(batch)-12 {
+		return nil, 0, errors.New("bad length")
+	}
+
+	d.int32() // Partition leader epoch
+	if d.int8() != 2 {
+		return nil, 0, errors.New("bad magic")
+	}
+
+	if uint32(d.int32()) != crc32.Checksum(batch[21:], kafkaCRCTable) {
+		return nil, 0, errors.New("bad crc")
+	}
+
+	codec := int8(d.int16() & 7)
+	lastDelta := d.int32()
+	d.int64() // Base and max timestamp
+	d.int64()
+	d.int64() // Producer id, epoch and base sequence
+	d.int16()
+	d.int32()
+	count := int(d.int32())
+	if d.err != nil || lastDelta != int32(count-1) {
+		return nil, 0, errors.New("bad header")
+	}
+
+	records, err := kafkaDecompress(codec, d.b)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msgs := []kafkaMessage{}
+	r := &kafkaDecoder{b: records}
+	for i := 0; i < count; i++ {
+		r.varint() // Length
+		r.int8()   // Attributes
+		r.varint() // Timestamp delta
+		if r.varint() != int64(i) {
+			return nil, 0, errors.New("bad offset delta")
+		}
+
+		var m kafkaMessage
+		if n := r.varint(); n >= 0 {
+			m.Key = r.next(int(n))
+		}
+		m.Value = r.next(int(r.varint()))
+		r.varint() // Headers
+
+		msgs = append(msgs, m)
+	}
+
+	if r.err != nil || len(r.b) != 0 {
+		return nil, 0, errors.New("bad records")
+	}
+
+	return msgs, codec, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	KAFKA_SASL_PLAIN         = "PLAIN"
+	KAFKA_SASL_SCRAM_SHA_256 = "SCRAM-SHA-256"
+	KAFKA_SASL_SCRAM_SHA_512 = "SCRAM-SHA-512"
+)
+
+// Parses output.kafka.sasl.mechanism into the name brokers know it by
+func kafkaSASLMechanism(mechanism string) (string, error) {
+	switch strings.ToLower(mechanism) {
+	case "plain":
+		return KAFKA_SASL_PLAIN, nil
+	case "scram-sha-256":
+		return KAFKA_SASL_SCRAM_SHA_256, nil
+	case "scram-sha-512":
+		return KAFKA_SASL_SCRAM_SHA_512, nil
+	}
+
+	return "", fmt.Errorf("output.kafka.sasl.mechanism must be plain, scram-sha-256 or scram-sha-512, `%s` provided", mechanism)
+}
+
+// Authenticates a new connection, step sends one message to the broker and returns its reply
+func kafkaSASL(mechanism, username, password string, step func([]byte) ([]byte, error)) error {
+	switch mechanism {
+	case KAFKA_SASL_PLAIN:
+		_, err := step([]byte("\x00" + username + "\x00" + password))
+		return err
+	case KAFKA_SASL_SCRAM_SHA_256:
+		return scramAuthenticate(sha256.New, username, password, scramNonce(), step)
+	case KAFKA_SASL_SCRAM_SHA_512:
+		return scramAuthenticate(sha512.New, username, password, scramNonce(), step)
+	}
+
+	return fmt.Errorf("Unknown SASL mechanism %s", mechanism)
+}
+
+func scramNonce() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Runs the client side of a SCRAM exchange (RFC 5802), the password is used as is without SASLprep
+func scramAuthenticate(h func() hash.Hash, username, password, nonce string, step func([]byte) ([]byte, error)) error {
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username)
+	clientFirst := "n=" + user + ",r=" + nonce
+
+	serverFirst, err := step([]byte("n,," + clientFirst))
+	if err != nil {
+		return err
+	}
+
+	attrs := scramAttributes(string(serverFirst))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("Server refused the username: %s", e)
+	}
+
+	serverNonce := attrs["r"]
+	if !strings.HasPrefix(serverNonce, nonce) || len(serverNonce) == len(nonce) {
+		return errors.New("Server nonce does not extend ours")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return fmt.Errorf("Server sent a bad salt. Error: %s", err)
+	}
+
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return fmt.Errorf("Server sent a bad iteration count `%s`", attrs["i"])
+	}
+
+	salted := pbkdf2(h, []byte(password), salt, iterations, h().Size())
+	clientKey := hmacSum(h, salted, []byte("Client Key"))
+	stored := h()
+	stored.Write(clientKey)
+
+	clientFinal := "c=biws,r=" + serverNonce
+	authMessage := []byte(clientFirst + "," + string(serverFirst) + "," + clientFinal)
+
+	proof := hmacSum(h, stored.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	serverFinal, err := step([]byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+
+	attrs = scramAttributes(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("Server refused the password: %s", e)
+	}
+
+	// The server proves it knows the password too
+	signature := hmacSum(h, hmacSum(h, salted, []byte("Server Key")), authMessage)
+	if attrs["v"] != base64.StdEncoding.EncodeToString(signature) {
+		return errors.New("Server signature did not match")
+	}
+
+	return nil
+}
+
+// Splits a SCRAM message like r=abc,s=def into its attributes
+func scramAttributes(msg string) map[string]string {
+	attrs := map[string]string{}
+	for _, kv := range strings.Split(msg, ",") {
+		if i := strings.Index(kv, "="); i > 0 {
+			attrs[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	return attrs
+}
+
+func hmacSum(h func() hash.Hash, key, msg []byte) []byte {
+	m := hmac.New(h, key)
+	m.Write(msg)
+	return m.Sum(nil)
+}
+
+// PBKDF2 (RFC 8018) with HMAC as the pseudorandom function
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(h, password)
+
+	var key []byte
+	for block := 1; len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
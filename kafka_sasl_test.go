@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_kafkaSASLMechanism(t *testing.T) {
+	m, err := kafkaSASLMechanism("scram-sha-512")
+	assert.Nil(t, err)
+	assert.Equal(t, KAFKA_SASL_SCRAM_SHA_512, m)
+
+	m, err = kafkaSASLMechanism("PLAIN")
+	assert.Nil(t, err)
+	assert.Equal(t, KAFKA_SASL_PLAIN, m)
+
+	_, err = kafkaSASLMechanism("gssapi")
+	assert.EqualError(t, err, "output.kafka.sasl.mechanism must be plain, scram-sha-256 or scram-sha-512, `gssapi` provided")
+}
+
+func Test_kafkaSASL_plain(t *testing.T) {
+	var sent []string
+	err := kafkaSASL(KAFKA_SASL_PLAIN, "audit", "secret", func(b []byte) ([]byte, error) {
+		sent = append(sent, string(b))
+		return nil, nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"\x00audit\x00secret"}, sent)
+}
+
+func Test_scramAuthenticate(t *testing.T) {
+	// The SCRAM-SHA-256 example from RFC 7677
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	serverFinal := "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+
+	var sent []string
+	replies := []string{serverFirst, serverFinal}
+	step := func(b []byte) ([]byte, error) {
+		sent = append(sent, string(b))
+		r := replies[0]
+		replies = replies[1:]
+		return []byte(r), nil
+	}
+
+	assert.Nil(t, scramAuthenticate(sha256.New, "user", "pencil", "rOprNGfwEbeRWgbNEkqO", step))
+	assert.Equal(t, []string{
+		"n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+	}, sent)
+
+	// A server that doesn't know the password can't sign the exchange
+	replies = []string{serverFirst, "v=AAAA"}
+	assert.EqualError(t, scramAuthenticate(sha256.New, "user", "pencil", "rOprNGfwEbeRWgbNEkqO", step), "Server signature did not match")
+
+	replies = []string{serverFirst, "e=invalid-proof"}
+	assert.EqualError(t, scramAuthenticate(sha256.New, "user", "wrong", "rOprNGfwEbeRWgbNEkqO", step), "Server refused the password: invalid-proof")
+
+	// The server has to add to our nonce
+	replies = []string{"r=someone-else,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"}
+	assert.EqualError(t, scramAuthenticate(sha256.New, "user", "pencil", "rOprNGfwEbeRWgbNEkqO", step), "Server nonce does not extend ours")
+
+	// Usernames are escaped
+	sent = nil
+	scramAuthenticate(sha256.New, "a=b,c", "pencil", "n", func(b []byte) ([]byte, error) {
+		sent = append(sent, string(b))
+		return nil, errors.New("stop")
+	})
+	assert.Equal(t, []string{"n,,n=a=3Db=2Cc,r=n"}, sent)
+}
+
+func Test_pbkdf2(t *testing.T) {
+	assert.Equal(t, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b", hex.EncodeToString(pbkdf2(sha256.New, []byte("password"), []byte("salt"), 1, 32)))
+	assert.Equal(t, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a", hex.EncodeToString(pbkdf2(sha256.New, []byte("password"), []byte("salt"), 4096, 32)))
+
+	// Longer than one block
+	assert.Equal(t, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9", hex.EncodeToString(pbkdf2(sha256.New, []byte("passwordPASSWORDpassword"), []byte("saltSALTsaltSALTsaltSALTsaltSALTsalt"), 4096, 40)))
+}
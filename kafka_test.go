@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_kafkaWriter_partitionKey(t *testing.T) {
+	line := []byte(`{"sequence":1,"timestamp":"1500000000.123","messages":[{"type":1300,"data":"arch=c000003e syscall=59 success=yes exit=0 ppid=1 pid=2 auid=1000 uid=0 sauid=5"}]}`)
+
+	var ts = []struct {
+		key      string
+		expected []byte
+	}{
+		{KAFKA_KEY_NONE, nil},
+		{KAFKA_KEY_HOSTNAME, []byte("host-1")},
+		{KAFKA_KEY_AUID, []byte("1000")},
+		{KAFKA_KEY_SYSCALL, []byte("59")},
+	}
+
+	for _, ta := range ts {
+		w := &kafkaWriter{kafkaConfig: kafkaConfig{key: ta.key, hostname: "host-1"}}
+		assert.Equal(t, ta.expected, w.partitionKey(line), ta.key)
+	}
+
+	// No field to key on is left to round robin
+	w := &kafkaWriter{kafkaConfig: kafkaConfig{key: KAFKA_KEY_AUID}}
+	assert.Nil(t, w.partitionKey([]byte(`{"sequence":1,"messages":[]}`)))
+}
+
+func Test_newKafkaWriter(t *testing.T) {
+	c := kafkaConfig{key: KAFKA_KEY_NONE, maxEvents: 1, maxBytes: 1, interval: time.Second}
+
+	_, err := newKafkaWriter(c, &fakeProducer{})
+	assert.EqualError(t, err, "Brokers and a topic are required")
+
+	c.brokers = []string{"localhost:9092"}
+	c.topic = "audit"
+	c.key = "pid"
+	_, err = newKafkaWriter(c, &fakeProducer{})
+	assert.EqualError(t, err, "Key must be one of none, hostname, auid or syscall, `pid` provided")
+
+	c.key = KAFKA_KEY_NONE
+	c.maxEvents = 0
+	_, err = newKafkaWriter(c, &fakeProducer{})
+	assert.EqualError(t, err, "Batch max_events, max_bytes and interval must be greater than 0")
+}
+
+func Test_kafkaWriter(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	p := &fakeProducer{}
+	w, err := newKafkaWriter(kafkaConfig{
+		brokers:   []string{"localhost:9092"},
+		topic:     "audit",
+		key:       KAFKA_KEY_NONE,
+		maxEvents: 2,
+		maxBytes:  1 << 20,
+		interval:  time.Hour,
+		timeout:   time.Second,
+	}, p)
+	assert.Nil(t, err)
+
+	// A full batch is produced without the newlines
+	w.Write([]byte("1\n"))
+	w.Write([]byte("2\n"))
+	assert.Equal(t, []string{"1", "2"}, p.values())
+	assert.Equal(t, 0, len(w.msgs))
+
+	// Only the messages kafka didn't take are kept, the next write fails trying them again
+	p.fail(kafkaWriteErrors{nil, kafkaError(6)})
+	w.Write([]byte("3\n"))
+	w.Write([]byte("4\n"))
+	assert.Equal(t, 1, len(w.msgs))
+
+	p.fail(errors.New("leader not available"))
+	_, err = w.Write([]byte("5\n"))
+	assert.EqualError(t, err, "Failed to produce 1 events to audit. Error: leader not available")
+
+	// Once kafka is back the kept message goes first
+	_, err = w.Write([]byte("5\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, p.values())
+
+	// Messages kafka will never take are dropped instead of holding up the rest
+	p.fail(kafkaWriteErrors{kafkaError(10), nil})
+	_, err = w.Write([]byte("6\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(w.msgs))
+	assert.Equal(t, "Dropping 1 events audit will not accept. Error: Kafka error 10 MESSAGE_TOO_LARGE\n", elb.String())
+
+	// Close produces what is left, without the context already cancelled by closing, and closes the producer
+	w.Write([]byte("7\n"))
+	assert.Nil(t, w.Close())
+	assert.Equal(t, []string{"1", "2", "3", "4", "6", "7"}, p.values())
+	assert.False(t, p.cancelled)
+	assert.True(t, p.closed)
+}
+
+// A producer that records the value of every message it takes and can fail the next write
+type fakeProducer struct {
+	lock      sync.Mutex
+	sent      []string
+	err       error
+	cancelled bool // If the last produce was given a context that was already done
+	closed    bool
+}
+
+func (p *fakeProducer) Produce(ctx context.Context, msgs []kafkaMessage) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := p.err
+	p.err = nil
+
+	// Give a cancel that is on its way time to land
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Millisecond * 10):
+	}
+	p.cancelled = ctx.Err() != nil
+
+	werrs, partial := err.(kafkaWriteErrors)
+	if err != nil && !partial {
+		return err
+	}
+
+	for i, m := range msgs {
+		if partial && werrs[i] != nil {
+			continue
+		}
+
+		p.sent = append(p.sent, string(m.Value))
+	}
+
+	return err
+}
+
+func (p *fakeProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+// Fails the next write with err
+func (p *fakeProducer) fail(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.err = err
+}
+
+func (p *fakeProducer) values() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]string{}, p.sent...)
+}
@@ -1,19 +1,27 @@
 package main
 
 import (
+	"net"
 	"os"
 	"regexp"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const (
 	EVENT_EOE = 1320 // End of multi packet event
+
+	COMPLETED_BY_EOE      = "eoe"      // The message group was written after its EOE message arrived
+	COMPLETED_BY_TIMEOUT  = "timeout"  // The message group was written after waiting for completeAfter without an EOE
+	COMPLETED_BY_SHUTDOWN = "shutdown" // The message group was written early because we are shutting down
 )
 
 type AuditMarshaller struct {
+	lock          sync.Mutex // Guards msgs and the sequence tracking, the flusher runs alongside Consume
 	msgs          map[int]*AuditMessageGroup
-	writer        *AuditWriter
+	outputs       []*AuditOutput
 	lastSeq       int
 	missed        map[int]bool
 	worstLag      int
@@ -23,20 +31,76 @@ type AuditMarshaller struct {
 	logOutOfOrder bool
 	maxOutOfOrder int
 	attempts      int
-	filters       map[string]map[uint16][]*regexp.Regexp // { syscall: { mtype: [regexp, ...] } }
+	filters       map[string]map[uint16][]*AuditFilter // { syscall: { mtype: [filter, ...] } }
 	statsdConfigs StatsdConfig
+	parseFields   bool
+	completeAfter time.Duration
+	groups        chan *AuditMessageGroup // Completed groups waiting for the write stage, nil writes them right away
+	outputQueue   int                     // Size of the queue each output is given while there is a write stage
+	dropped       uint64                  // Groups dropped because groups was full, updated atomically
+	writeLock     sync.RWMutex            // Held while writing so Reload can't swap the outputs out from under a write
 }
 
 type AuditFilter struct {
 	messageType uint16
 	regex       *regexp.Regexp
 	syscall     string
+
+	// Matchers for the decoded saddr of SOCKADDR messages, empty values match anything
+	family string
+	cidrs  []*net.IPNet
+	port   int
+}
+
+// Checks if the message satisfies every part of the filter
+func (f *AuditFilter) matches(msg *AuditMessage) bool {
+	if f.regex != nil && !f.regex.MatchString(msg.Data) {
+		return false
+	}
+
+	if !f.matchesSockaddr() {
+		return true
+	}
+
+	sa := msg.sockaddr()
+	if sa == nil {
+		return false
+	}
+
+	if f.family != "" && f.family != sa.Family {
+		return false
+	}
+
+	if f.port != 0 && f.port != sa.Port {
+		return false
+	}
+
+	if len(f.cidrs) == 0 {
+		return true
+	}
+
+	if sa.ip == nil {
+		return false
+	}
+
+	for _, cidr := range f.cidrs {
+		if cidr.Contains(sa.ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks if the filter has anything to match against a decoded saddr
+func (f *AuditFilter) matchesSockaddr() bool {
+	return f.family != "" || len(f.cidrs) > 0 || f.port != 0
 }
 
 // Create a new marshaller
-func NewAuditMarshaller(w *AuditWriter, eventMin uint16, eventMax uint16, trackMessages, logOOO bool, maxOOO int, filters []AuditFilter, statsdConfigs StatsdConfig) *AuditMarshaller {
+func NewAuditMarshaller(outputs []*AuditOutput, eventMin uint16, eventMax uint16, trackMessages, logOOO bool, maxOOO int, filters []AuditFilter, statsdConfigs StatsdConfig, parseFields bool, completeAfter time.Duration) *AuditMarshaller {
 	am := AuditMarshaller{
-		writer:        w,
+		outputs:       outputs,
 		msgs:          make(map[int]*AuditMessageGroup, 5), // It is not typical to have more than 2 message groups at any given time
 		missed:        make(map[int]bool, 10),
 		eventMin:      eventMin,
@@ -44,29 +108,64 @@ func NewAuditMarshaller(w *AuditWriter, eventMin uint16, eventMax uint16, trackM
 		trackMessages: trackMessages,
 		logOutOfOrder: logOOO,
 		maxOutOfOrder: maxOOO,
-		filters:       make(map[string]map[uint16][]*regexp.Regexp),
+		filters:       newFilterMap(filters),
 		statsdConfigs: statsdConfigs,
+		parseFields:   parseFields,
+		completeAfter: completeAfter,
 	}
 
-	for _, filter := range filters {
-		if _, ok := am.filters[filter.syscall]; !ok {
-			am.filters[filter.syscall] = make(map[uint16][]*regexp.Regexp)
-		}
+	return &am
+}
+
+// Takes the outputs, filters and settings of another marshaller, usually one built from a reloaded config
+// Pending message groups and sequence tracking are kept. The outputs that were replaced are returned so they can be closed
+func (a *AuditMarshaller) Reload(n *AuditMarshaller) []*AuditOutput {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	old := a.outputs
+	a.outputs = n.outputs
+	if a.groups != nil {
+		a.startOutputQueues()
+	}
+	a.eventMin = n.eventMin
+	a.eventMax = n.eventMax
+	a.trackMessages = n.trackMessages
+	a.logOutOfOrder = n.logOutOfOrder
+	a.maxOutOfOrder = n.maxOutOfOrder
+	a.filters = n.filters
+	a.statsdConfigs = n.statsdConfigs
+	a.parseFields = n.parseFields
+	a.completeAfter = n.completeAfter
+
+	return old
+}
+
+// Groups filters by syscall and message type so they are quick to look up
+func newFilterMap(filters []AuditFilter) map[string]map[uint16][]*AuditFilter {
+	fm := make(map[string]map[uint16][]*AuditFilter)
 
-		if _, ok := am.filters[filter.syscall][filter.messageType]; !ok {
-			am.filters[filter.syscall][filter.messageType] = []*regexp.Regexp{}
+	for i := range filters {
+		filter := &filters[i]
+		if _, ok := fm[filter.syscall]; !ok {
+			fm[filter.syscall] = make(map[uint16][]*AuditFilter)
 		}
 
-		am.filters[filter.syscall][filter.messageType] = append(am.filters[filter.syscall][filter.messageType], filter.regex)
+		fm[filter.syscall][filter.messageType] = append(fm[filter.syscall][filter.messageType], filter)
 	}
 
-	return &am
+	return fm
 }
 
 // Ingests a netlink message and likely prepares it to be logged
 func (a *AuditMarshaller) Consume(nlMsg *syscall.NetlinkMessage) {
 	aMsg := NewAuditMessage(nlMsg)
 
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
 	if aMsg.Seq == 0 {
 		// We got an invalid audit message, return the current message and reset
 		a.flushOld()
@@ -83,34 +182,126 @@ func (a *AuditMarshaller) Consume(nlMsg *syscall.NetlinkMessage) {
 		return
 	} else if nlMsg.Header.Type == EVENT_EOE {
 		// This is end of event msg, flush the msg with that sequence and discard this one
-		a.completeMessage(aMsg.Seq)
+		a.completeMessage(aMsg.Seq, COMPLETED_BY_EOE)
 		return
 	}
 
+	if a.parseFields {
+		aMsg.Fields = parseFields(aMsg.Type, aMsg.Data)
+	}
+
 	if val, ok := a.msgs[aMsg.Seq]; ok {
 		// Use the original AuditMessageGroup if we have one
 		val.AddMessage(aMsg)
 	} else {
 		// Create a new AuditMessageGroup
-		a.msgs[aMsg.Seq] = NewAuditMessageGroup(aMsg)
+		amg := NewAuditMessageGroup(aMsg)
+		amg.CompleteAfter = time.Now().Add(a.completeAfter)
+		a.msgs[aMsg.Seq] = amg
 	}
 
 	a.flushOld()
 }
 
+// ConsumeBatches consumes every batch received on batches until it is closed, then closes done
+// This runs on its own goroutine so decoding and writing events doesn't hold up reading the socket
+func (a *AuditMarshaller) ConsumeBatches(batches <-chan *Batch, done chan<- struct{}) {
+	for b := range batches {
+		for _, msg := range b.Msgs {
+			a.Consume(msg)
+		}
+
+		// Consume copies what it keeps so the buffers can be reused right away
+		b.Free()
+	}
+
+	close(done)
+}
+
+// WriteGroups hands every completed message group received on groups to the output queues until it is closed
+// Then it waits for the outputs to write what they have queued and closes done
+// This is the write stage, it is the only part of the pipeline that waits on statsd
+func (a *AuditMarshaller) WriteGroups(groups <-chan *AuditMessageGroup, done chan<- struct{}) {
+	for msg := range groups {
+		a.queueWrite(msg)
+	}
+
+	// Reload doesn't start queues once the write stage is stopping, so these are the last ones
+	a.writeLock.RLock()
+	for _, o := range a.outputs {
+		o.stopQueue()
+	}
+	a.writeLock.RUnlock()
+
+	close(done)
+}
+
+// Sets the queue completed message groups are sent to and the size of each output's queue
+// nil makes completing a group write it right away, the output queues are stopped by WriteGroups
+func (a *AuditMarshaller) setQueue(groups chan *AuditMessageGroup, outputQueue int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	a.groups = groups
+	a.outputQueue = outputQueue
+	if groups != nil {
+		a.startOutputQueues()
+	}
+}
+
+// Gives every output a queue and a goroutine of its own, so a slow or failing output only holds up itself
+// Both locks must be held
+func (a *AuditMarshaller) startOutputQueues() {
+	for _, o := range a.outputs {
+		o.startQueue(a.outputQueue, a.outputFailed)
+	}
+}
+
+// Flushes old messages every interval until done is closed
+// Without this a message group that never gets an EOE waits for the next message to arrive, which can take a long time on a quiet host
+func (a *AuditMarshaller) FlushEvery(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			a.lock.Lock()
+			a.flushOld()
+			a.lock.Unlock()
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// Writes every pending message group regardless of age, used when shutting down
+func (a *AuditMarshaller) Flush() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for seq := range a.msgs {
+		a.completeMessage(seq, COMPLETED_BY_SHUTDOWN)
+	}
+}
+
 // Outputs any messages that are old enough
 // This is because there is no indication of multi message events coming from kaudit
 func (a *AuditMarshaller) flushOld() {
 	now := time.Now()
 	for seq, msg := range a.msgs {
 		if msg.CompleteAfter.Before(now) || now.Equal(msg.CompleteAfter) {
-			a.completeMessage(seq)
+			a.completeMessage(seq, COMPLETED_BY_TIMEOUT)
 		}
 	}
 }
 
-// Write a complete message group to the configured output in json format
-func (a *AuditMarshaller) completeMessage(seq int) {
+// Hands a complete message group to the write stage, or writes it if there isn't one
+// completedBy records whether the group ended with an EOE or timed out waiting for one
+func (a *AuditMarshaller) completeMessage(seq int, completedBy string) {
 	var msg *AuditMessageGroup
 	var ok bool
 
@@ -124,30 +315,113 @@ func (a *AuditMarshaller) completeMessage(seq int) {
 		return
 	}
 
+	msg.CompletedBy = completedBy
+	delete(a.msgs, seq)
+
+	if a.groups == nil {
+		a.write(msg)
+		return
+	}
+
+	// Waiting for room would stall parsing and then the netlink reader, so the group is dropped and counted instead
+	select {
+	case a.groups <- msg:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// Sends a complete message group to statsd and queues it for every output, an output with a full queue drops it
+func (a *AuditMarshaller) queueWrite(msg *AuditMessageGroup) {
+	a.writeLock.RLock()
+	defer a.writeLock.RUnlock()
+
 	if a.statsdConfigs.kind == "statsd" || a.statsdConfigs.kind == "dogstatsd" {
 		if err := a.sendDatagram(msg); err != nil {
 			el.Println("Failed to send statsd datagram. Error:", err)
 		}
 	}
 
-	if err := a.writer.Write(msg); err != nil {
-		el.Println("Failed to write message. Error:", err)
-		os.Exit(1)
+	for _, o := range a.outputs {
+		o.enqueue(msg)
 	}
+}
 
-	delete(a.msgs, seq)
+// Called by an output queue after a write failed, exits if the last write to every output failed
+func (a *AuditMarshaller) outputFailed(failed *AuditOutput) {
+	a.writeLock.RLock()
+	defer a.writeLock.RUnlock()
+
+	current := false
+	for _, o := range a.outputs {
+		if !o.isFailing() {
+			return
+		}
+		current = current || o == failed
+	}
+
+	// An output a reload replaced is only finishing its queue
+	if !current {
+		return
+	}
+
+	el.Println("Failed to write message to any output. Exiting.")
+	os.Exit(1)
+}
+
+// Write a complete message group to statsd and the configured outputs in json format
+func (a *AuditMarshaller) write(msg *AuditMessageGroup) {
+	a.writeLock.RLock()
+	defer a.writeLock.RUnlock()
+
+	if a.statsdConfigs.kind == "statsd" || a.statsdConfigs.kind == "dogstatsd" {
+		if err := a.sendDatagram(msg); err != nil {
+			el.Println("Failed to send statsd datagram. Error:", err)
+		}
+	}
+
+	// A failing output should not stop the others from getting the message
+	failed := 0
+	for _, o := range a.outputs {
+		if err := o.Write(msg); err != nil {
+			el.Printf("Failed to write message to the %s output. Error: %s\n", o.name, err)
+			failed++
+		}
+	}
+
+	if failed == len(a.outputs) {
+		el.Println("Failed to write message to any output. Exiting.")
+		os.Exit(1)
+	}
 }
 
 func (a *AuditMarshaller) dropMessage(msg *AuditMessageGroup) bool {
-	filters, ok := a.filters[msg.Syscall]
-	if !ok {
+	return filtersMatch(a.filters, msg)
+}
+
+// Checks if any message in the group matches a filter for the groups syscall, by number or by name
+func filtersMatch(fm map[string]map[uint16][]*AuditFilter, msg *AuditMessageGroup) bool {
+	if filters, ok := fm[msg.Syscall]; ok && groupMatches(filters, msg) {
+		return true
+	}
+
+	if msg.SyscallName == "" {
 		return false
 	}
 
+	if filters, ok := fm[msg.SyscallName]; ok && groupMatches(filters, msg) {
+		return true
+	}
+
+	return false
+}
+
+// Checks if any message in the group matches one of the filters for its message type
+func groupMatches(filters map[uint16][]*AuditFilter, msg *AuditMessageGroup) bool {
 	for _, msg := range msg.Msgs {
 		if fg, ok := filters[msg.Type]; ok {
 			for _, filter := range fg {
-				if filter.MatchString(msg.Data) {
+				if filter.matches(msg) {
 					return true
 				}
 			}
@@ -196,12 +470,6 @@ func (a *AuditMarshaller) sendDatagram(msg *AuditMessageGroup) error {
 	if data_gram == "" {
 		return nil
 	}
-	udp_cl, err := newStatsdClient(a.statsdConfigs.ip + ":" + a.statsdConfigs.port)
 	el.Println("sending datagram to address "+a.statsdConfigs.ip+":"+a.statsdConfigs.port+" with content:", data_gram)
-	if err != nil {
-		return err
-	}
-	defer udp_cl.conn.Close()
-	udp_cl.conn.Write([]byte(data_gram))
-	return nil
+	return sendStatsd(&a.statsdConfigs, data_gram)
 }
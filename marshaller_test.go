@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	"errors"
+	"net"
+	"regexp"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -16,7 +19,7 @@ func TestMarshallerConstants(t *testing.T) {
 
 func TestAuditMarshaller_Consume(t *testing.T) {
 	w := &bytes.Buffer{}
-	m := NewAuditMarshaller(NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"})
+	m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}, uint16(1100), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, COMPLETE_AFTER)
 
 	// Flush group on 1320
 	m.Consume(&syscall.NetlinkMessage{
@@ -45,7 +48,7 @@ func TestAuditMarshaller_Consume(t *testing.T) {
 
 	assert.Equal(
 		t,
-		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"},{\"type\":1301,\"data\":\"hi there\"}],\"uid_map\":{}}\n",
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"},{\"type\":1301,\"data\":\"hi there\"}],\"uid_map\":{},\"completed_by\":\"eoe\"}\n",
 		w.String(),
 	)
 	assert.Equal(t, 0, len(m.msgs))
@@ -113,18 +116,54 @@ func TestAuditMarshaller_Consume(t *testing.T) {
 		m.Consume(new1320("0"))
 	}
 
-	assert.Equal(t, "{\"sequence\":4,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{}}\n", w.String())
+	assert.Equal(t, "{\"sequence\":4,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{},\"completed_by\":\"timeout\"}\n", w.String())
 	expected := start.Add(time.Second * 2)
 	assert.True(t, expected.Equal(time.Now()) || expected.Before(time.Now()), "Should have taken at least 2 seconds to flush")
 	assert.Equal(t, 0, len(m.msgs))
 }
 
+func TestAuditMarshaller_FlushEvery(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, time.Millisecond*50)
+
+	done := make(chan struct{})
+	defer close(done)
+	go m.FlushEvery(time.Millisecond*10, done)
+
+	// No EOE and no more messages, the flusher should write it on its own
+	start := time.Now()
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): hi there"),
+	})
+
+	for {
+		m.lock.Lock()
+		pending := len(m.msgs)
+		m.lock.Unlock()
+
+		if pending == 0 {
+			break
+		}
+
+		if time.Since(start) > time.Second {
+			t.Fatal("Message group was not flushed")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	assert.True(t, time.Since(start) >= time.Millisecond*50, "Should have waited for completeAfter")
+	m.lock.Lock()
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{},\"completed_by\":\"timeout\"}\n", w.String())
+	m.lock.Unlock()
+}
+
 func TestAuditMarshaller_completeMessage(t *testing.T) {
 	//TODO: cant test because completeMessage calls exit
 	t.Skip()
 	return
 	// lb, elb := hookLogger()
-	// m := NewAuditMarshaller(NewAuditWriter(&FailWriter{}, 1), uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"})
+	// m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(&FailWriter{}, 1), nil)}, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, COMPLETE_AFTER)
 
 	// m.Consume(&syscall.NetlinkMessage{
 	// 	Header: syscall.NlMsghdr{
@@ -137,11 +176,160 @@ func TestAuditMarshaller_completeMessage(t *testing.T) {
 	// 	Data: []byte("audit(10000001:4): hi there"),
 	// })
 
-	// m.completeMessage(4)
+	// m.completeMessage(4, COMPLETED_BY_EOE)
 	// assert.Equal(t, "!", lb.String())
 	// assert.Equal(t, "!", elb.String())
 }
 
+func TestAuditMarshaller_multipleOutputs(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	all := &bytes.Buffer{}
+	filtered := &bytes.Buffer{}
+	outputs := []*AuditOutput{
+		NewAuditOutput("failing", NewAuditWriter(&FailWriter{}, 1), nil),
+		NewAuditOutput("all", NewAuditWriter(all, 1), nil),
+		NewAuditOutput("filtered", NewAuditWriter(filtered, 1), []AuditFilter{
+			{syscall: "59", messageType: 1300, regex: regexp.MustCompile("ignore me")},
+		}),
+	}
+
+	m := NewAuditMarshaller(outputs, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, COMPLETE_AFTER)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): syscall=59 keep me"),
+	})
+	m.Consume(new1320("1"))
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:2): syscall=59 ignore me"),
+	})
+	m.Consume(new1320("2"))
+
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"syscall=59 keep me\"}],\"uid_map\":{},\"completed_by\":\"eoe\"}\n"+
+			"{\"sequence\":2,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"syscall=59 ignore me\"}],\"uid_map\":{},\"completed_by\":\"eoe\"}\n",
+		all.String(),
+	)
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"syscall=59 keep me\"}],\"uid_map\":{},\"completed_by\":\"eoe\"}\n",
+		filtered.String(),
+	)
+	assert.Equal(t, "", lb.String())
+	assert.Equal(t, "Failed to write message to the failing output. Error: derp\nFailed to write message to the failing output. Error: derp\n", elb.String())
+}
+
+func TestAuditMarshaller_syscallName(t *testing.T) {
+	w := &bytes.Buffer{}
+	filters := []AuditFilter{
+		{syscall: "connect", messageType: 1300, regex: regexp.MustCompile("ignore me")},
+		{syscall: "59", messageType: 1300, regex: regexp.MustCompile("drop me")},
+	}
+	m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}, uint16(1300), uint16(1399), false, false, 0, filters, StatsdConfig{kind: "none"}, false, COMPLETE_AFTER)
+
+	// filtered by name
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): arch=c000003e syscall=42 ignore me"),
+	})
+	m.Consume(new1320("1"))
+
+	// filtered by number
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:2): arch=c000003e syscall=59 drop me"),
+	})
+	m.Consume(new1320("2"))
+
+	// connect on i386 is a different number
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:3): arch=40000003 syscall=42 ignore me"),
+	})
+	m.Consume(new1320("3"))
+
+	assert.Equal(
+		t,
+		"{\"sequence\":3,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"arch=40000003 syscall=42 ignore me\"}],\"uid_map\":{},\"syscall_name\":\"pipe\",\"completed_by\":\"eoe\"}\n",
+		w.String(),
+	)
+}
+
+func TestAuditMarshaller_sockaddrFilters(t *testing.T) {
+	w := &bytes.Buffer{}
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	filters := []AuditFilter{
+		{syscall: "connect", messageType: 1306, cidrs: []*net.IPNet{local, private}},
+		{syscall: "connect", messageType: 1306, family: "unix"},
+		{syscall: "bind", messageType: 1306, family: "inet6", port: 443},
+	}
+	m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}, uint16(1300), uint16(1399), false, false, 0, filters, StatsdConfig{kind: "none"}, false, COMPLETE_AFTER)
+
+	send := func(seq, sc, saddr string) {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte("audit(10000001:" + seq + "): arch=c000003e syscall=" + sc),
+		})
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1306)},
+			Data:   []byte("audit(10000001:" + seq + "): saddr=" + saddr),
+		})
+		m.Consume(new1320(seq))
+	}
+
+	send("1", "42", "020000507F0000010000000000000000")                         // connect to 127.0.0.1:80
+	send("2", "42", "020000500A0102030000000000000000")                         // connect to 10.1.2.3:80
+	send("3", "42", "01002F72756E2F7800")                                       // connect to /run/x
+	send("4", "49", "0A0001BB000000000000000000000000000000000000000100000000") // bind to [::1]:443
+	send("5", "42", "02000050080808080000000000000000")                         // connect to 8.8.8.8:80
+	send("6", "49", "0A000050000000000000000000000000000000000000000100000000") // bind to [::1]:80
+
+	assert.Equal(t, 2, strings.Count(w.String(), "\n"), "Only 2 messages should have been written")
+	assert.Contains(t, w.String(), "\"sequence\":5,")
+	assert.Contains(t, w.String(), "\"sequence\":6,")
+	assert.Contains(t, w.String(), "\"decoded\":{\"saddr\":{\"family\":\"inet\",\"addr\":\"8.8.8.8\",\"port\":80}}")
+}
+
+func TestAuditMarshaller_parseFields(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, true, COMPLETE_AFTER)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1307)},
+		Data:   []byte("audit(10000001:1): cwd=\"/root\""),
+	})
+	m.Consume(new1320("1"))
+
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1307,\"data\":\"cwd=\\\"/root\\\"\",\"fields\":{\"cwd\":\"/root\"}}],\"uid_map\":{},\"completed_by\":\"eoe\"}\n",
+		w.String(),
+	)
+}
+
+func TestAuditMarshaller_execve(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, COMPLETE_AFTER)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1309)},
+		Data:   []byte("audit(10000001:1): argc=2 a0=\"ls\" a1=2D6C"),
+	})
+	m.Consume(new1320("1"))
+
+	assert.Equal(
+		t,
+		"{\"sequence\":1,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1309,\"data\":\"argc=2 a0=\\\"ls\\\" a1=2D6C\",\"decoded\":{\"a1\":\"-l\"}}],\"uid_map\":{},\"argc\":2,\"argv\":[\"ls\",\"-l\"],\"completed_by\":\"eoe\"}\n",
+		w.String(),
+	)
+}
+
 func new1320(seq string) *syscall.NetlinkMessage {
 	return &syscall.NetlinkMessage{
 		Header: syscall.NlMsghdr{
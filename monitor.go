@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// statusMonitor polls the kernel audit status to report events the kernel dropped before they reached us
+// Unlike the sequence tracking in the marshaller the lost counter is exact
+type statusMonitor struct {
+	ticker *time.Ticker
+	C      <-chan time.Time // Ticks when the status should be checked, nil if polling is disabled
+	lost   uint32
+	seen   bool
+	pid    uint32 // Our pid when we should own the audit pid, 0 when reading the multicast group
+}
+
+// Changes how often the status is checked, an interval of 0 or less disables polling
+func (s *statusMonitor) setInterval(interval time.Duration) {
+	if s.ticker != nil {
+		s.ticker.Stop()
+		s.ticker = nil
+		s.C = nil
+	}
+
+	if interval > 0 {
+		s.ticker = time.NewTicker(interval)
+		s.C = s.ticker.C
+	}
+}
+
+// Gets the current audit status, logs if the kernel lost events since the last check and sends metrics for it
+// Returns true if another process owns the audit pid, the kernel is sending our events to it
+func (s *statusMonitor) check(c ruleClient, sc *StatsdConfig) (bool, error) {
+	status, err := c.GetStatus()
+	if err != nil {
+		return false, err
+	}
+
+	var delta uint32
+	if !s.seen {
+		// Events lost before we started still matter, they were likely lost while nothing was reading them
+		if status.Lost > 0 {
+			el.Printf("Kernel has lost %d audit events since audit was enabled. Backlog %d of %d\n", status.Lost, status.Backlog, status.BacklogLimit)
+		}
+		s.seen = true
+	} else if status.Lost > s.lost {
+		delta = status.Lost - s.lost
+		el.Printf("Kernel lost %d audit events, %d in total. Backlog %d of %d\n", delta, status.Lost, status.Backlog, status.BacklogLimit)
+	}
+
+	// The counter goes backwards if someone resets it, start again from there
+	s.lost = status.Lost
+
+	datagrams := []string{
+		"goaudit.kernel.lost:" + strconv.FormatUint(uint64(delta), 10) + "|c",
+		"goaudit.kernel.backlog:" + strconv.FormatUint(uint64(status.Backlog), 10) + "|g",
+		"goaudit.kernel.backlog_limit:" + strconv.FormatUint(uint64(status.BacklogLimit), 10) + "|g",
+	}
+
+	// A pid of 0 means nobody owns it, the keep alive will claim it again
+	stolen := s.pid != 0 && status.Pid != 0 && status.Pid != s.pid
+	if stolen {
+		el.Printf("Audit pid is owned by process %d instead of us (%d), we are not receiving events\n", status.Pid, s.pid)
+		datagrams = append(datagrams, "goaudit.kernel.pid_stolen:1|c")
+	}
+
+	for _, d := range datagrams {
+		if err := sendStatsd(sc, d); err != nil {
+			el.Println("Failed to send statsd datagram. Error:", err)
+		}
+	}
+
+	return stolen, nil
+}
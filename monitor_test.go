@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_statusMonitor_setInterval(t *testing.T) {
+	s := &statusMonitor{}
+	s.setInterval(0)
+	assert.Nil(t, s.C, "Polling should be disabled")
+
+	s.setInterval(time.Millisecond)
+	assert.NotNil(t, s.C)
+	<-s.C
+
+	s.setInterval(-1)
+	assert.Nil(t, s.C, "Polling should be disabled")
+	assert.Nil(t, s.ticker)
+}
+
+func Test_statusMonitor_check(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Failed to listen for statsd", err)
+	}
+	defer conn.Close()
+
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	sc := &StatsdConfig{kind: "statsd", ip: "127.0.0.1", port: port}
+
+	readDatagrams := func(count int) []string {
+		d := []string{}
+		b := make([]byte, 1024)
+		for i := 0; i < count; i++ {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(b)
+			if err != nil {
+				t.Fatal("Failed to read datagram", err)
+			}
+			d = append(d, string(b[:n]))
+		}
+		return d
+	}
+
+	s := &statusMonitor{}
+	c := &fakeRuleClient{status: AuditStatusPayload{Lost: 5, Backlog: 10, BacklogLimit: 64}}
+
+	// losses from before we started are reported once but not counted as new
+	assertCheck(t, s, c, sc, false)
+	assert.Equal(t, "Kernel has lost 5 audit events since audit was enabled. Backlog 10 of 64\n", elb.String())
+	assert.Equal(t, []string{"goaudit.kernel.lost:0|c", "goaudit.kernel.backlog:10|g", "goaudit.kernel.backlog_limit:64|g"}, readDatagrams(3))
+
+	// nothing new
+	elb.Reset()
+	assertCheck(t, s, c, sc, false)
+	assert.Equal(t, "", elb.String())
+	readDatagrams(3)
+
+	// new losses
+	c.status.Lost = 12
+	c.status.Backlog = 64
+	assertCheck(t, s, c, sc, false)
+	assert.Equal(t, "Kernel lost 7 audit events, 12 in total. Backlog 64 of 64\n", elb.String())
+	assert.Equal(t, []string{"goaudit.kernel.lost:7|c", "goaudit.kernel.backlog:64|g", "goaudit.kernel.backlog_limit:64|g"}, readDatagrams(3))
+
+	// the counter was reset
+	elb.Reset()
+	c.status.Lost = 1
+	assertCheck(t, s, c, sc, false)
+	assert.Equal(t, "", elb.String())
+	assert.Equal(t, uint32(1), s.lost)
+	readDatagrams(3)
+
+	// someone else took the audit pid
+	elb.Reset()
+	s.pid = 100
+	c.status.Pid = 200
+	assertCheck(t, s, c, sc, true)
+	assert.Equal(t, "goaudit.kernel.pid_stolen:1|c", readDatagrams(4)[3])
+
+	// errors
+	c.statusErr = errors.New("nope")
+	_, err = s.check(c, sc)
+	assert.EqualError(t, err, "nope")
+	assert.Equal(t, "", lb.String())
+}
+
+func Test_statusMonitor_checkPid(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	s := &statusMonitor{pid: 100}
+	sc := &StatsdConfig{kind: "none"}
+	c := &fakeRuleClient{status: AuditStatusPayload{Pid: 100}}
+
+	// we own it
+	assertCheck(t, s, c, sc, false)
+
+	// nobody owns it, the keep alive will take it back
+	c.status.Pid = 0
+	assertCheck(t, s, c, sc, false)
+	assert.Equal(t, "", elb.String())
+
+	// someone else owns it
+	c.status.Pid = 200
+	assertCheck(t, s, c, sc, true)
+	assert.Equal(t, "Audit pid is owned by process 200 instead of us (100), we are not receiving events\n", elb.String())
+
+	// multicast readers never own it
+	elb.Reset()
+	s.pid = 0
+	assertCheck(t, s, c, sc, false)
+	assert.Equal(t, "", elb.String())
+	assert.Equal(t, "", lb.String())
+}
+
+// Helper to run a status check that is expected to succeed
+func assertCheck(t *testing.T, s *statusMonitor, c ruleClient, sc *StatsdConfig, stolen bool) {
+	st, err := s.check(c, sc)
+	assert.Nil(t, err)
+	assert.Equal(t, stolen, st, "Stolen mismatch")
+}
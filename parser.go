@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
+	"net"
 	"os/user"
 	"strconv"
 	"strings"
@@ -15,16 +17,65 @@ var headerSepChar = byte(':')
 var spaceChar = byte(' ')
 
 const (
-	HEADER_MIN_LENGTH = 7               // Minimum length of an audit header
-	HEADER_START_POS  = 6               // Position in the audit header that the data starts
-	COMPLETE_AFTER    = time.Second * 2 // Log a message after this time or EOE
+	HEADER_MIN_LENGTH  = 7                      // Minimum length of an audit header
+	HEADER_START_POS   = 6                      // Position in the audit header that the data starts
+	COMPLETE_AFTER     = time.Second * 2        // Log a message after this time or EOE, the default for events.complete_after
+	MIN_COMPLETE_AFTER = time.Millisecond * 100 // Groups are flushed every quarter of complete_after, anything shorter would spin
 )
 
+// Fields the kernel hex encodes if they contain spaces, quotes or control characters
+var untrustedFields = map[string]bool{
+	"acct":      true,
+	"cmd":       true,
+	"comm":      true,
+	"cwd":       true,
+	"data":      true,
+	"dir":       true,
+	"exe":       true,
+	"key":       true,
+	"name":      true,
+	"ocomm":     true,
+	"path":      true,
+	"proctitle": true,
+	"watch":     true,
+}
+
+// Fields that look like decimal numbers but are really hex
+var hexNumberFields = map[string]bool{
+	"arch": true,
+	"a0":   true,
+	"a1":   true,
+	"a2":   true,
+	"a3":   true,
+}
+
+// Address families we know how to decode from a SOCKADDR message
+const (
+	AF_UNIX    = 1
+	AF_INET    = 2
+	AF_INET6   = 10
+	AF_NETLINK = 16
+)
+
+// Sockaddr is a decoded `saddr` field from a SOCKADDR message
+type Sockaddr struct {
+	Family string `json:"family"`
+	Addr   string `json:"addr,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Pid    uint32 `json:"pid,omitempty"`
+	Groups uint32 `json:"groups,omitempty"`
+
+	ip net.IP
+}
+
 type AuditMessage struct {
-	Type      uint16 `json:"type"`
-	Data      string `json:"data"`
-	Seq       int    `json:"-"`
-	AuditTime string `json:"-"`
+	Type      uint16                 `json:"type"`
+	Data      string                 `json:"data"`
+	Decoded   map[string]interface{} `json:"decoded,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	Seq       int                    `json:"-"`
+	AuditTime string                 `json:"-"`
 }
 
 type AuditMessageGroup struct {
@@ -34,6 +85,26 @@ type AuditMessageGroup struct {
 	Msgs          []*AuditMessage   `json:"messages"`
 	UidMap        map[string]string `json:"uid_map"`
 	Syscall       string            `json:"-"`
+	SyscallName   string            `json:"syscall_name,omitempty"`
+	Arch          uint32            `json:"-"`
+	Argc          int               `json:"argc,omitempty"`
+	Argv          []string          `json:"argv,omitempty"`
+	ArgvTruncated bool              `json:"argv_truncated,omitempty"`
+	CompletedBy   string            `json:"completed_by"`
+	execve        *execveArgs
+}
+
+// Collects execve arguments as they arrive, long arguments are split into chunks and can span several messages
+type execveArgs struct {
+	argc int
+	args map[int]*execveArg
+}
+
+type execveArg struct {
+	value  string
+	whole  bool
+	length int
+	chunks map[int]string
 }
 
 // Creates a new message group from the details parsed from the message
@@ -54,9 +125,11 @@ func NewAuditMessageGroup(am *AuditMessage) *AuditMessageGroup {
 // Creates a new go-audit message from a netlink message
 func NewAuditMessage(nlm *syscall.NetlinkMessage) *AuditMessage {
 	aTime, seq := parseAuditHeader(nlm)
+	data := string(nlm.Data)
 	return &AuditMessage{
 		Type:      nlm.Header.Type,
-		Data:      string(nlm.Data),
+		Data:      data,
+		Decoded:   decodeFields(nlm.Header.Type, data),
 		Seq:       seq,
 		AuditTime: aTime,
 	}
@@ -84,12 +157,253 @@ func parseAuditHeader(msg *syscall.NetlinkMessage) (time string, seq int) {
 	return time, seq
 }
 
+// Splits the key=value pairs of a message into a map
+// Quoted values are kept as is, hex encoded strings are decoded, whole numbers become numbers, (null) becomes nil
+// and the msg='...' payload of user space messages is parsed into its own map
+func parseFields(msgType uint16, data string) map[string]interface{} {
+	fields := make(map[string]interface{})
+
+	eachField(data, func(key, val string, quote byte) {
+		fields[key] = fieldValue(msgType, key, val, quote)
+	})
+
+	return fields
+}
+
+// Calls fn for every key=value pair in a message, quote is the quote character the value was wrapped in or 0
+func eachField(data string, fn func(key, val string, quote byte)) {
+	for len(data) > 0 {
+		// Skip any leading spaces
+		if data[0] == spaceChar {
+			data = data[1:]
+			continue
+		}
+
+		eq := strings.IndexByte(data, '=')
+		sp := strings.IndexByte(data, spaceChar)
+		if eq < 0 {
+			break
+		}
+
+		if sp >= 0 && sp < eq {
+			// This token has no value, like the `avc:  denied` in selinux messages
+			data = data[sp+1:]
+			continue
+		}
+
+		key := data[:eq]
+		data = data[eq+1:]
+
+		var val string
+		quote := byte(0)
+		if len(data) > 0 && (data[0] == '"' || data[0] == '\'') {
+			quote = data[0]
+			end := strings.IndexByte(data[1:], quote)
+			if end < 0 {
+				// Unterminated quote, take the rest of the message
+				val, data = data[1:], ""
+			} else {
+				val, data = data[1:end+1], data[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(data, spaceChar)
+			if end < 0 {
+				end = len(data)
+			}
+			val, data = data[:end], data[end:]
+		}
+
+		fn(key, val, quote)
+	}
+}
+
+// Finds the hex encoded fields of proctitle, execve, path and cwd messages and decodes them
+// Values that contain NUL separators, like a proctitle, are split into an array
+// Returns nil if the message has nothing to decode
+func decodeFields(msgType uint16, data string) map[string]interface{} {
+	switch msgType {
+	case 1327, 1309, 1302, 1307, 1306:
+	default:
+		return nil
+	}
+
+	var decoded map[string]interface{}
+	eachField(data, func(key, val string, quote byte) {
+		if quote != 0 || !isEncodedField(msgType, key) {
+			return
+		}
+
+		if msgType == 1306 {
+			if sa := decodeSockaddr(val); sa != nil {
+				decoded = map[string]interface{}{key: sa}
+			}
+			return
+		}
+
+		if dec, ok := decodeUntrusted(val); ok {
+			if decoded == nil {
+				decoded = make(map[string]interface{}, 1)
+			}
+			decoded[key] = dec
+		}
+	})
+
+	return decoded
+}
+
+// Checks if a field of a proctitle, execve, path or cwd message is one the kernel hex encodes
+func isEncodedField(msgType uint16, key string) bool {
+	switch msgType {
+	case 1327:
+		return key == "proctitle"
+	case 1309:
+		return isExecveArg(key)
+	case 1302:
+		return key == "name"
+	case 1307:
+		return key == "cwd"
+	case 1306:
+		return key == "saddr"
+	}
+
+	return false
+}
+
+// Decodes a hex encoded sockaddr, returns nil if it is malformed or the address family is not one we know
+// The family and netlink values are in host byte order, ports are in network byte order
+func decodeSockaddr(val string) *Sockaddr {
+	b, err := hex.DecodeString(val)
+	if err != nil || len(b) < 2 {
+		return nil
+	}
+
+	switch Endianness.Uint16(b[0:2]) {
+	case AF_INET:
+		if len(b) < 8 {
+			return nil
+		}
+
+		ip := net.IP(append([]byte{}, b[4:8]...))
+		return &Sockaddr{Family: "inet", Addr: ip.String(), Port: int(b[2])<<8 | int(b[3]), ip: ip}
+
+	case AF_INET6:
+		if len(b) < 24 {
+			return nil
+		}
+
+		ip := net.IP(append([]byte{}, b[8:24]...))
+		return &Sockaddr{Family: "inet6", Addr: ip.String(), Port: int(b[2])<<8 | int(b[3]), ip: ip}
+
+	case AF_UNIX:
+		path := b[2:]
+		if len(path) > 0 && path[0] == 0 {
+			// Abstract sockets start with a NUL and are not terminated, show them the way ss does
+			return &Sockaddr{Family: "unix", Path: "@" + string(bytes.TrimRight(path[1:], "\x00"))}
+		}
+
+		if i := bytes.IndexByte(path, 0); i >= 0 {
+			path = path[:i]
+		}
+		return &Sockaddr{Family: "unix", Path: string(path)}
+
+	case AF_NETLINK:
+		if len(b) < 12 {
+			return nil
+		}
+
+		return &Sockaddr{Family: "netlink", Pid: Endianness.Uint32(b[4:8]), Groups: Endianness.Uint32(b[8:12])}
+	}
+
+	return nil
+}
+
+// Returns the decoded sockaddr of a SOCKADDR message, or nil if there isn't one
+func (am *AuditMessage) sockaddr() *Sockaddr {
+	sa, _ := am.Decoded["saddr"].(*Sockaddr)
+	return sa
+}
+
+// Checks if a field is an execve argument, a0, a1[0], etc
+func isExecveArg(key string) bool {
+	return len(key) > 1 && key[0] == 'a' && key[1] >= '0' && key[1] <= '9' && !strings.HasSuffix(key, "_len")
+}
+
+// Decodes a hex encoded string, NUL separated values are split into an array of strings
+func decodeUntrusted(val string) (interface{}, bool) {
+	dec, ok := decodeHex(val)
+	if !ok {
+		return nil, false
+	}
+
+	if strings.IndexByte(dec, 0) < 0 {
+		return dec, true
+	}
+
+	return strings.Split(strings.TrimRight(dec, "\x00"), "\x00"), true
+}
+
+// Converts a raw field value into something more useful for json
+func fieldValue(msgType uint16, key string, val string, quote byte) interface{} {
+	switch {
+	case quote == '\'' && key == "msg":
+		return parseFields(msgType, val)
+	case quote != 0:
+		return val
+	case val == "(null)":
+		return nil
+	case isUntrustedField(msgType, key):
+		if dec, ok := decodeUntrusted(val); ok {
+			return dec
+		}
+		return val
+	case hexNumberFields[key]:
+		return val
+	}
+
+	if len(val) > 1 && (val[0] == '0' || (val[0] == '-' && val[1] == '0')) {
+		// Leading zeros are usually octal, like file modes
+		return val
+	}
+
+	if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return n
+	}
+
+	return val
+}
+
+// Checks if a field in a message type may have been hex encoded by the kernel
+func isUntrustedField(msgType uint16, key string) bool {
+	if untrustedFields[key] {
+		return true
+	}
+
+	// Every argument in an execve message is untrusted
+	return msgType == 1309 && isExecveArg(key)
+}
+
+// Decodes a hex encoded string, the bool is false if the value wasn't valid hex
+func decodeHex(val string) (string, bool) {
+	if len(val) == 0 || len(val)%2 != 0 {
+		return "", false
+	}
+
+	b, err := hex.DecodeString(val)
+	if err != nil {
+		return "", false
+	}
+
+	return string(b), true
+}
+
 // Add a new message to the current message group
 func (amg *AuditMessageGroup) AddMessage(am *AuditMessage) {
 	amg.Msgs = append(amg.Msgs, am)
 	//TODO: need to find more message types that won't contain uids, also make these constants
 	switch am.Type {
-	case 1309, 1307, 1306:
+	case 1309:
+		amg.addExecve(am)
+	case 1307, 1306:
 		// Don't map uids here
 	case 1300:
 		amg.findSyscall(am)
@@ -99,6 +413,117 @@ func (amg *AuditMessageGroup) AddMessage(am *AuditMessage) {
 	}
 }
 
+// Adds the arguments in an execve message to the group and rebuilds argv
+func (amg *AuditMessageGroup) addExecve(am *AuditMessage) {
+	if amg.execve == nil {
+		amg.execve = &execveArgs{args: make(map[int]*execveArg)}
+	}
+
+	e := amg.execve
+	eachField(am.Data, func(key, val string, quote byte) {
+		if key == "argc" {
+			e.argc, _ = strconv.Atoi(val)
+			return
+		}
+
+		if !isExecveArg(key) && !strings.HasSuffix(key, "_len") {
+			return
+		}
+
+		// Keys look like a0, a1_len or a1[0]
+		end := strings.IndexAny(key, "_[")
+		if end < 0 {
+			end = len(key)
+		}
+
+		num, err := strconv.Atoi(key[1:end])
+		if err != nil {
+			return
+		}
+
+		arg, ok := e.args[num]
+		if !ok {
+			arg = &execveArg{}
+			e.args[num] = arg
+		}
+
+		switch {
+		case end == len(key):
+			arg.value = execveValue(val, quote)
+			arg.whole = true
+		case key[end] == '_':
+			arg.length, _ = strconv.Atoi(val)
+		default:
+			chunk, err := strconv.Atoi(strings.TrimSuffix(key[end+1:], "]"))
+			if err != nil {
+				return
+			}
+
+			if arg.chunks == nil {
+				arg.chunks = make(map[int]string)
+			}
+			arg.chunks[chunk] = execveValue(val, quote)
+		}
+	})
+
+	amg.Argc, amg.Argv, amg.ArgvTruncated = e.argv()
+}
+
+// Unquoted arguments and chunks are hex encoded, lengths never are
+func execveValue(val string, quote byte) string {
+	if quote == 0 {
+		if dec, ok := decodeHex(val); ok {
+			return dec
+		}
+	}
+
+	return val
+}
+
+// Assembles the arguments collected so far, truncated is true if any argument or part of one is missing
+func (e *execveArgs) argv() (argc int, argv []string, truncated bool) {
+	argc = e.argc
+	for num := range e.args {
+		if num >= argc {
+			// We never saw argc or it was wrong
+			argc = num + 1
+			truncated = true
+		}
+	}
+
+	argv = make([]string, argc)
+	for i := 0; i < argc; i++ {
+		arg, ok := e.args[i]
+		if !ok {
+			truncated = true
+			continue
+		}
+
+		if arg.whole {
+			argv[i] = arg.value
+			continue
+		}
+
+		var buf bytes.Buffer
+		for c := 0; c < len(arg.chunks); c++ {
+			chunk, ok := arg.chunks[c]
+			if !ok {
+				truncated = true
+				break
+			}
+			buf.WriteString(chunk)
+		}
+
+		if buf.Len() < arg.length {
+			truncated = true
+		}
+
+		argv[i] = buf.String()
+	}
+
+	return argc, argv, truncated
+}
+
 // Find all `uid=` occurrences in a message and adds the username to the UidMap object
 func (amg *AuditMessageGroup) mapUids(am *AuditMessage) {
 	data := am.Data
@@ -140,28 +565,41 @@ func (amg *AuditMessageGroup) mapUids(am *AuditMessage) {
 
 }
 
+// Finds the syscall and arch of the event and translates the syscall number to a name
 func (amg *AuditMessageGroup) findSyscall(am *AuditMessage) {
-	data := am.Data
+	amg.Syscall = findValue(am.Data, "syscall=")
+
+	if arch, err := strconv.ParseUint(findValue(am.Data, "arch="), 16, 32); err == nil {
+		amg.Arch = uint32(arch)
+	}
+
+	if num, err := strconv.Atoi(amg.Syscall); err == nil {
+		amg.SyscallName = syscallName(amg.Arch, num)
+	}
+}
+
+// Finds the short unquoted value for key, like `syscall=`, in a message
+func findValue(data string, key string) string {
 	start := 0
 	end := 0
 
-	if start = strings.Index(data, "syscall="); start < 0 {
-		return
+	if start = strings.Index(data, key); start < 0 {
+		return ""
 	}
 
 	// Progress the start point beyond the = sign
-	start += 8
+	start += len(key)
 	if end = strings.IndexByte(data[start:], spaceChar); end < 0 {
-		// There was no ending space, maybe the syscall id is at the end of the line
+		// There was no ending space, maybe the value is at the end of the line
 		end = len(data) - start
 
-		// If the end of the line is greater than 5 characters away (overflows a 16 bit uint) then it can't be a syscall id
-		if end > 5 {
-			return
+		// If the end of the line is greater than 8 characters away (overflows a 32 bit hex uint) then it can't be what we want
+		if end > 8 {
+			return ""
 		}
 	}
 
-	amg.Syscall = data[start : start+end]
+	return data[start : start+end]
 }
 
 // Gets a username for a user id
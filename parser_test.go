@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/stretchr/testify/assert"
+	"net"
 	"syscall"
 	"testing"
 	"time"
@@ -31,6 +32,13 @@ func TestNewAuditMessage(t *testing.T) {
 	assert.Equal(t, 99, am.Seq)
 	assert.Equal(t, "10000001", am.AuditTime)
 	assert.Equal(t, "hi there", am.Data)
+	assert.Nil(t, am.Decoded)
+
+	msg.Header.Type = 1327
+	msg.Data = []byte("audit(10000001:99): proctitle=6C73002D6C61")
+	am = NewAuditMessage(msg)
+	assert.Equal(t, "proctitle=6C73002D6C61", am.Data)
+	assert.Equal(t, map[string]interface{}{"proctitle": []string{"ls", "-la"}}, am.Decoded)
 }
 
 func TestAuditMessageGroup_AddMessage(t *testing.T) {
@@ -75,6 +83,80 @@ func TestAuditMessageGroup_AddMessage(t *testing.T) {
 	assert.Equal(t, 1, len(amg.UidMap), "Incorrect uid mapping count")
 }
 
+func TestAuditMessageGroup_findSyscall(t *testing.T) {
+	var ts = []struct {
+		data    string
+		syscall string
+		name    string
+		arch    uint32
+	}{
+		{"arch=c000003e syscall=59 success=yes", "59", "execve", AUDIT_ARCH_X86_64},
+		{"arch=40000003 syscall=11 success=yes", "11", "execve", AUDIT_ARCH_I386},
+		{"arch=c00000b7 syscall=221", "221", "execve", AUDIT_ARCH_AARCH64},
+		{"arch=c000003e syscall=9999 success=yes", "9999", "", AUDIT_ARCH_X86_64},
+		{"arch=deadbeef syscall=59", "59", "", 0xdeadbeef},
+		{"syscall=59 success=yes", "59", "", 0},
+		{"success=yes", "", "", 0},
+	}
+
+	for _, ta := range ts {
+		amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: ta.data})
+		assert.Equal(t, ta.syscall, amg.Syscall, "For `"+ta.data+"`")
+		assert.Equal(t, ta.name, amg.SyscallName, "For `"+ta.data+"`")
+		assert.Equal(t, ta.arch, amg.Arch, "For `"+ta.data+"`")
+	}
+}
+
+func TestAuditMessageGroup_addExecve(t *testing.T) {
+	// simple arguments, quoted and hex encoded
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1309, Data: `argc=3 a0="ls" a1=6D792066696C65 a2="-alF"`})
+	assert.Equal(t, 3, amg.Argc)
+	assert.Equal(t, []string{"ls", "my file", "-alF"}, amg.Argv)
+	assert.False(t, amg.ArgvTruncated)
+
+	// long arguments are split into chunks across several messages
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "syscall=59"})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=3 a0="echo" a1_len=10 a1[0]=3031323334`})
+	assert.Equal(t, []string{"echo", "01234", ""}, amg.Argv)
+	assert.True(t, amg.ArgvTruncated, "Should be truncated until everything arrives")
+
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `a1[1]="56789" a2="end"`})
+	assert.Equal(t, 3, amg.Argc)
+	assert.Equal(t, []string{"echo", "0123456789", "end"}, amg.Argv)
+	assert.False(t, amg.ArgvTruncated)
+
+	// lengths aren't hex, even when they have an even number of digits
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1309, Data: `argc=2 a0="cat" a1_len=10 a1[0]=3031323334`})
+	assert.Equal(t, 10, amg.execve.args[1].length)
+	assert.Equal(t, []string{"cat", "01234"}, amg.Argv)
+	assert.True(t, amg.ArgvTruncated, "Should be truncated when the chunks are shorter than the length")
+
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1309, Data: `argc=2 a0="cat" a1_len=1000 a1[0]="0123456789"`})
+	assert.Equal(t, 1000, amg.execve.args[1].length)
+	assert.True(t, amg.ArgvTruncated)
+
+	// missing chunks
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1309, Data: `argc=2 a0="cat" a1_len=6 a1[0]=6162 a1[2]=6566`})
+	assert.Equal(t, []string{"cat", "ab"}, amg.Argv)
+	assert.True(t, amg.ArgvTruncated)
+
+	// missing arguments
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1309, Data: `argc=3 a0="cat" a2="b"`})
+	assert.Equal(t, []string{"cat", "", "b"}, amg.Argv)
+	assert.True(t, amg.ArgvTruncated)
+
+	// no argc
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1309, Data: `a0="cat" a1="b"`})
+	assert.Equal(t, 2, amg.Argc)
+	assert.Equal(t, []string{"cat", "b"}, amg.Argv)
+	assert.True(t, amg.ArgvTruncated)
+
+	// other messages don't have argv
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Data: "a0=1 a1=2"})
+	assert.Equal(t, 0, amg.Argc)
+	assert.Nil(t, amg.Argv)
+}
+
 func TestNewAuditMessageGroup(t *testing.T) {
 	uidMap = make(map[string]string, 0)
 	m := &AuditMessage{
@@ -140,6 +222,136 @@ func TestAuditMessageGroup_mapUids(t *testing.T) {
 	assert.Equal(t, "derp", amg.UidMap["99999"])
 }
 
+func Test_parseFields(t *testing.T) {
+	// syscall record, hex looking numbers stay strings and octal stays as is
+	f := parseFields(1300, `arch=c000003e syscall=59 success=yes exit=-2 a0=10 items=2 pid=11623 auid=4294967295 tty=pts0 comm="ls" exe=2F746D702F6D7920657865 key=(null)`)
+	assert.Equal(t, map[string]interface{}{
+		"arch":    "c000003e",
+		"syscall": int64(59),
+		"success": "yes",
+		"exit":    int64(-2),
+		"a0":      "10",
+		"items":   int64(2),
+		"pid":     int64(11623),
+		"auid":    int64(4294967295),
+		"tty":     "pts0",
+		"comm":    "ls",
+		"exe":     "/tmp/my exe",
+		"key":     nil,
+	}, f)
+
+	// path record
+	f = parseFields(1302, `item=0 name="/bin/ls" inode=262316 dev=ca:01 mode=0100755 ouid=0 nametype=NORMAL`)
+	assert.Equal(t, map[string]interface{}{
+		"item":     int64(0),
+		"name":     "/bin/ls",
+		"inode":    int64(262316),
+		"dev":      "ca:01",
+		"mode":     "0100755",
+		"ouid":     int64(0),
+		"nametype": "NORMAL",
+	}, f)
+
+	// execve arguments are all untrusted
+	f = parseFields(1309, `argc=3 a0="ls" a1=2D2D636F6C6F723D6175746F a2_len=4 a2[0]=2D616C46`)
+	assert.Equal(t, map[string]interface{}{
+		"argc":   int64(3),
+		"a0":     "ls",
+		"a1":     "--color=auto",
+		"a2_len": int64(4),
+		"a2[0]":  "-alF",
+	}, f)
+
+	// user space messages have a nested payload
+	f = parseFields(1100, `pid=1 uid=0 auid=1000 ses=3 msg='op=PAM:authentication grantors=pam_unix acct="root" exe="/bin/su" hostname=? res=success'`)
+	assert.Equal(t, map[string]interface{}{
+		"pid":  int64(1),
+		"uid":  int64(0),
+		"auid": int64(1000),
+		"ses":  int64(3),
+		"msg": map[string]interface{}{
+			"op":       "PAM:authentication",
+			"grantors": "pam_unix",
+			"acct":     "root",
+			"exe":      "/bin/su",
+			"hostname": "?",
+			"res":      "success",
+		},
+	}, f)
+
+	// tokens without values are skipped, unterminated quotes take the rest of the line, bad hex is left alone
+	f = parseFields(1400, `avc:  denied  { read } for  pid=1 comm="oops there name=nothex`)
+	assert.Equal(t, map[string]interface{}{
+		"pid":  int64(1),
+		"comm": "oops there name=nothex",
+	}, f)
+
+	f = parseFields(1327, `proctitle=6C73002D6C61`)
+	assert.Equal(t, map[string]interface{}{"proctitle": []string{"ls", "-la"}}, f)
+
+	f = parseFields(1302, `name=nothex`)
+	assert.Equal(t, map[string]interface{}{"name": "nothex"}, f)
+
+	assert.Equal(t, map[string]interface{}{}, parseFields(1300, ""))
+}
+
+func Test_decodeFields(t *testing.T) {
+	// proctitle is NUL separated
+	assert.Equal(
+		t,
+		map[string]interface{}{"proctitle": []string{"/usr/bin/ls", "-la", "/tmp"}},
+		decodeFields(1327, "proctitle=2F7573722F62696E2F6C73002D6C61002F746D70"),
+	)
+
+	// execve arguments, whole or in chunks
+	assert.Equal(
+		t,
+		map[string]interface{}{"a1": "my file", "a2[0]": "-alF"},
+		decodeFields(1309, `argc=3 a0="ls" a1=6D792066696C65 a2_len=4 a2[0]=2D616C46`),
+	)
+
+	// path names and cwd
+	assert.Equal(t, map[string]interface{}{"name": "/tmp/a b"}, decodeFields(1302, `item=0 name=2F746D702F612062 inode=1 dev=ca:01`))
+	assert.Equal(t, map[string]interface{}{"cwd": "/home/a b"}, decodeFields(1307, `cwd=2F686F6D652F612062`))
+
+	// nothing encoded, bad hex or other message types
+	assert.Nil(t, decodeFields(1302, `item=0 name="/bin/ls" inode=1`))
+	assert.Nil(t, decodeFields(1302, `name=(null)`))
+	assert.Nil(t, decodeFields(1307, `cwd=nothex`))
+	assert.Nil(t, decodeFields(1300, `comm=6C73 a0=2F`))
+}
+
+func Test_decodeSockaddr(t *testing.T) {
+	var ts = []struct {
+		saddr  string
+		result *Sockaddr
+	}{
+		{"020000507F0000010000000000000000", &Sockaddr{Family: "inet", Addr: "127.0.0.1", Port: 80, ip: net.IP{127, 0, 0, 1}}},
+		{"0A0001BB000000000000000000000000000000000000000100000000", &Sockaddr{Family: "inet6", Addr: "::1", Port: 443, ip: net.IPv6loopback}},
+		{"01002F72756E2F7800", &Sockaddr{Family: "unix", Path: "/run/x"}},
+		{"010000666F6F", &Sockaddr{Family: "unix", Path: "@foo"}},
+		{"10000000D204000001000000", &Sockaddr{Family: "netlink", Pid: 1234, Groups: 1}},
+
+		// truncated, unknown families and junk
+		{"02000050", nil},
+		{"0A0001BB00000000", nil},
+		{"1000", nil},
+		{"1100000000000000", nil},
+		{"02", nil},
+		{"nothex", nil},
+	}
+
+	for _, ta := range ts {
+		assert.Equal(t, ta.result, decodeSockaddr(ta.saddr), "For `"+ta.saddr+"`")
+	}
+
+	// only saddr in SOCKADDR messages is decoded
+	m := &AuditMessage{Type: 1306, Decoded: decodeFields(1306, "saddr=020000507F0000010000000000000000")}
+	assert.Equal(t, "127.0.0.1", m.sockaddr().Addr)
+	assert.Nil(t, decodeFields(1306, "saddr=1100"))
+	assert.Nil(t, (&AuditMessage{Type: 1300}).sockaddr())
+}
+
 func Benchmark_getUsername(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_ = getUsername("0")
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// pipeline moves events from the netlink reader to the outputs through bounded queues
+// Received batches wait to be parsed by the marshaller and completed message groups wait to be written
+// No stage waits on the one after it, whatever doesn't fit in a full queue is dropped and counted
+type pipeline struct {
+	marshaller *AuditMarshaller
+	batches    chan *Batch
+	parsed     chan struct{}
+	groups     chan *AuditMessageGroup
+	written    chan struct{}
+
+	// Only touched by the reader goroutine
+	droppedPackets  uint64
+	reportedPackets uint64
+	reportedGroups  uint64
+}
+
+// Starts the parse and write stages and a queue for each output
+// parseQueue is counted in batches, writeQueue and outputQueue in message groups
+func newPipeline(marshaller *AuditMarshaller, parseQueue, writeQueue, outputQueue int) *pipeline {
+	p := &pipeline{
+		marshaller: marshaller,
+		batches:    make(chan *Batch, parseQueue),
+		parsed:     make(chan struct{}),
+		groups:     make(chan *AuditMessageGroup, writeQueue),
+		written:    make(chan struct{}),
+	}
+
+	marshaller.setQueue(p.groups, outputQueue)
+	go marshaller.ConsumeBatches(p.batches, p.parsed)
+	go marshaller.WriteGroups(p.groups, p.written)
+
+	return p
+}
+
+// Queues a batch to be parsed, it is dropped if the parse queue is full so reading is never held up
+func (p *pipeline) receive(b *Batch) {
+	select {
+	case p.batches <- b:
+	default:
+		p.droppedPackets += uint64(len(b.Msgs))
+		b.Free()
+	}
+}
+
+// Parses and writes everything that was queued, then stops both stages and the output queues
+// Groups completed afterwards are written right away by whoever completes them
+func (p *pipeline) stop() {
+	close(p.batches)
+	<-p.parsed
+
+	p.marshaller.setQueue(nil, 0)
+	close(p.groups)
+	<-p.written
+}
+
+// Logs anything dropped since the last report and sends the queue depths and drops to statsd
+// Each output reports its own queue and spool too
+func (p *pipeline) report(sc *StatsdConfig) {
+	packets := p.droppedPackets - p.reportedPackets
+	p.reportedPackets = p.droppedPackets
+
+	dropped := atomic.LoadUint64(&p.marshaller.dropped)
+	groups := dropped - p.reportedGroups
+	p.reportedGroups = dropped
+
+	if packets > 0 || groups > 0 {
+		el.Printf("Queues were full, dropped %d packets waiting to be parsed and %d events waiting to be written\n", packets, groups)
+	}
+
+	datagrams := []string{
+		"goaudit.queue.parse.depth:" + strconv.Itoa(len(p.batches)) + "|g",
+		"goaudit.queue.parse.dropped:" + strconv.FormatUint(packets, 10) + "|c",
+		"goaudit.queue.write.depth:" + strconv.Itoa(len(p.groups)) + "|g",
+		"goaudit.queue.write.dropped:" + strconv.FormatUint(groups, 10) + "|c",
+	}
+
+	for _, d := range datagrams {
+		if err := sendStatsd(sc, d); err != nil {
+			el.Println("Failed to send statsd datagram. Error:", err)
+		}
+	}
+
+	// Outputs are only swapped by a reload, which happens on this goroutine too
+	for _, o := range p.marshaller.outputs {
+		o.report(sc)
+		if o.spool != nil {
+			o.spool.report(sc)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_pipeline(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, time.Hour)
+	p := newPipeline(m, 4, 4, 4)
+
+	p.receive(&Batch{Msgs: []*syscall.NetlinkMessage{
+		{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:1): one")},
+		{Header: syscall.NlMsghdr{Type: EVENT_EOE}, Data: []byte("audit(10000001:1): ")},
+		{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:2): two")},
+	}})
+
+	// Everything queued is written before stop returns, groups completed afterwards are written right away
+	p.stop()
+	assert.Equal(t, 1, strings.Count(w.String(), "\n"))
+	assert.Contains(t, w.String(), `"sequence":1,`)
+	assert.Nil(t, m.groups)
+
+	m.Flush()
+	assert.Equal(t, 2, strings.Count(w.String(), "\n"))
+	assert.Contains(t, w.String(), `"sequence":2,`)
+}
+
+func Test_pipeline_drops(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditOutput{NewAuditOutput("test", NewAuditWriter(w, 1), nil)}, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, time.Hour)
+
+	// No stages are running so the queues fill up
+	p := &pipeline{marshaller: m, batches: make(chan *Batch, 1), groups: make(chan *AuditMessageGroup, 1)}
+	m.setQueue(p.groups, 1)
+
+	msgs := []*syscall.NetlinkMessage{{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:1): one")}}
+	p.receive(&Batch{Msgs: msgs})
+	p.receive(&Batch{Msgs: append(msgs, msgs[0])})
+	assert.Equal(t, uint64(2), p.droppedPackets)
+	assert.Equal(t, 1, len(p.batches))
+
+	for i := 1; i <= 3; i++ {
+		m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:" + strconv.Itoa(i) + "): x")})
+	}
+	m.Flush()
+	assert.Equal(t, uint64(2), m.dropped)
+	assert.Equal(t, 1, len(p.groups))
+	assert.Equal(t, "", w.String(), "Nothing should have been written while there is a write queue")
+
+	p.report(&m.statsdConfigs)
+	assert.Equal(t, "Queues were full, dropped 2 packets waiting to be parsed and 2 events waiting to be written\n", elb.String())
+
+	// Only new drops are reported
+	elb.Reset()
+	p.report(&m.statsdConfigs)
+	assert.Equal(t, "", elb.String())
+	assert.Equal(t, "", lb.String())
+}
+
+func Test_pipeline_outputQueues(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	// One output that is stuck writing and one that keeps up
+	stuck, fast := newGateWriter(), newGateWriter()
+	close(fast.unblock)
+	outputs := []*AuditOutput{NewAuditOutput("stuck", NewAuditWriter(stuck, 1), nil), NewAuditOutput("fast", NewAuditWriter(fast, 1), nil)}
+	m := NewAuditMarshaller(outputs, uint16(1300), uint16(1399), false, false, 0, []AuditFilter{}, StatsdConfig{kind: "none"}, false, time.Hour)
+	p := newPipeline(m, 4, 4, 2)
+
+	// The stuck output holds the first group and queues two more, the rest is dropped for it alone
+	for i := 1; i <= 5; i++ {
+		p.receive(&Batch{Msgs: []*syscall.NetlinkMessage{
+			{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte("audit(10000001:" + strconv.Itoa(i) + "): x")},
+			{Header: syscall.NlMsghdr{Type: EVENT_EOE}, Data: []byte("audit(10000001:" + strconv.Itoa(i) + "): ")},
+		}})
+
+		for j := 0; j < 100 && fast.lines() < i; j++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		assert.Equal(t, i, fast.lines(), "The fast output should get every group")
+
+		if i == 1 {
+			<-stuck.started
+		}
+	}
+
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&outputs[0].dropped))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&outputs[1].dropped))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&m.dropped))
+
+	p.report(&m.statsdConfigs)
+	assert.Equal(t, "The stuck output's queue is full, dropped 2 events\n", elb.String())
+
+	// Stopping waits for what the stuck output has queued
+	close(stuck.unblock)
+	p.stop()
+	assert.Equal(t, 3, stuck.lines())
+	assert.Nil(t, outputs[0].queue)
+}
+
+// A writer that can be read while an output writes to it, writes wait until unblock is closed
+// started gets a value when the first write begins
+type gateWriter struct {
+	lock    sync.Mutex
+	buf     bytes.Buffer
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func newGateWriter() *gateWriter {
+	return &gateWriter{started: make(chan struct{}, 1), unblock: make(chan struct{})}
+}
+
+func (g *gateWriter) Write(p []byte) (int, error) {
+	select {
+	case g.started <- struct{}{}:
+	default:
+	}
+
+	<-g.unblock
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.buf.Write(p)
+}
+
+func (g *gateWriter) lines() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return strings.Count(g.buf.String(), "\n")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest sequenceId allowed in the meta structured data before it wraps back to 1
+	RFC5424_MAX_SEQUENCE = 2147483647
+
+	RFC5424_MIN_BACKOFF = time.Second
+	RFC5424_MAX_BACKOFF = time.Minute
+	RFC5424_TIMEOUT     = time.Second * 10
+)
+
+// rfc5424Writer sends each line as an RFC 5424 syslog message over TCP or TLS, framed by octet counting (RFC 6587)
+// Octet counting means a message can be any size and contain newlines, relays don't have to guess where it ends
+// A failed write closes the connection, the next write reconnects once the backoff has passed. A collector that stops
+// reading fails writes after timeout instead of holding up the write stage
+type rfc5424Writer struct {
+	lock       sync.Mutex
+	network    string // tcp or tls
+	address    string
+	tls        *tls.Config
+	priority   int
+	hostname   string
+	appName    string
+	procId     string
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration // For connecting and for each write
+
+	conn      net.Conn
+	sequence  int
+	backoff   time.Duration // How long to wait after the next failed connection attempt
+	connectAt time.Time     // No connection is attempted before this
+
+	buf bytes.Buffer
+}
+
+type rfc5424Config struct {
+	network    string
+	address    string
+	tls        *tls.Config
+	priority   int
+	hostname   string
+	appName    string
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+}
+
+// Connects straight away so a bad address or certificate is found at startup
+func newRFC5424Writer(c rfc5424Config) (*rfc5424Writer, error) {
+	if c.network != "tcp" && c.network != "tls" {
+		return nil, fmt.Errorf("RFC 5424 syslog network must be tcp or tls, `%s` provided", c.network)
+	}
+
+	if c.priority < 0 || c.priority > 191 {
+		return nil, fmt.Errorf("Syslog priority must be between 0 and 191, %d provided", c.priority)
+	}
+
+	if c.minBackoff <= 0 || c.maxBackoff < c.minBackoff {
+		return nil, fmt.Errorf("Reconnect backoff must be greater than 0 and no more than the max, %s provided", c.minBackoff)
+	}
+
+	if c.timeout <= 0 {
+		return nil, fmt.Errorf("Syslog timeout must be greater than 0, %s provided", c.timeout)
+	}
+
+	w := &rfc5424Writer{
+		network:    c.network,
+		address:    c.address,
+		tls:        c.tls,
+		priority:   c.priority,
+		hostname:   headerField(c.hostname, 255),
+		appName:    headerField(c.appName, 48),
+		procId:     strconv.Itoa(os.Getpid()),
+		minBackoff: c.minBackoff,
+		maxBackoff: c.maxBackoff,
+		timeout:    c.timeout,
+		backoff:    c.minBackoff,
+	}
+
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Write sends one message, a trailing newline is not part of the message
+func (w *rfc5424Writer) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.conn == nil {
+		if time.Now().Before(w.connectAt) {
+			return 0, fmt.Errorf("Not connected to %s, reconnecting in %s", w.address, w.connectAt.Sub(time.Now()).Truncate(time.Millisecond))
+		}
+
+		if err := w.connect(); err != nil {
+			return 0, err
+		}
+	}
+
+	w.sequence++
+	if w.sequence > RFC5424_MAX_SEQUENCE {
+		w.sequence = 1
+	}
+
+	msg := fmt.Sprintf(
+		"<%d>1 %s %s %s %s - [meta sequenceId=\"%d\"][origin software=\"go-audit\"] ",
+		w.priority,
+		time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"),
+		w.hostname,
+		w.appName,
+		w.procId,
+		w.sequence,
+	)
+
+	line := bytes.TrimRight(b, "\n")
+
+	w.buf.Reset()
+	w.buf.WriteString(strconv.Itoa(len(msg) + len(line)))
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(msg)
+	w.buf.Write(line)
+
+	// A timeout fails the write like any other error, the connection is dropped and the next write reconnects
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	if _, err := w.conn.Write(w.buf.Bytes()); err != nil {
+		// Part of the frame may have been sent, the collector would misread anything else sent on this connection
+		w.conn.Close()
+		w.conn = nil
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Dials the collector, every failure doubles the wait before the next attempt up to maxBackoff
+func (w *rfc5424Writer) connect() error {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: w.timeout}
+	if w.network == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", w.address, w.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", w.address)
+	}
+
+	if err != nil {
+		w.connectAt = time.Now().Add(w.backoff)
+		w.backoff *= 2
+		if w.backoff > w.maxBackoff {
+			w.backoff = w.maxBackoff
+		}
+
+		return fmt.Errorf("Failed to connect to syslog at %s. Error: %s", w.address, err)
+	}
+
+	w.conn = conn
+	w.backoff = w.minBackoff
+	w.connectAt = time.Time{}
+	return nil
+}
+
+func (w *rfc5424Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.conn == nil {
+		return nil
+	}
+
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// Header fields are printable ascii without spaces and have a max length, an empty field is written as -
+func headerField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, s)
+
+	if len(s) > max {
+		s = s[:max]
+	}
+
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
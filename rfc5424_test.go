@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rfc5424Writer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newRFC5424Writer(rfc5424Config{
+		network:    "tcp",
+		address:    l.Addr().String(),
+		priority:   134,
+		hostname:   "my host",
+		appName:    "go-audit",
+		minBackoff: time.Millisecond * 50,
+		maxBackoff: time.Millisecond * 100,
+		timeout:    time.Second,
+	})
+	assert.Nil(t, err)
+	defer w.Close()
+
+	conn, _ := l.Accept()
+	r := bufio.NewReader(conn)
+
+	// Messages are octet counted so newlines inside them survive
+	n, err := w.Write([]byte("{\"a\":\"b\nc\"}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 12, n)
+	msg := readFrame(t, r)
+	assert.Regexp(t, `^<134>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z my_host go-audit `+strconv.Itoa(os.Getpid())+` - \[meta sequenceId="1"\]\[origin software="go-audit"\] \{"a":"b`+"\n"+`c"\}$`, msg)
+
+	w.Write([]byte("second\n"))
+	assert.Contains(t, readFrame(t, r), `[meta sequenceId="2"]`)
+
+	// A broken connection is reconnected on the next write
+	conn.Close()
+	l.Close()
+	for i := 0; i < 10; i++ {
+		if _, err = w.Write([]byte("lost\n")); err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.NotNil(t, err, "Writing to a closed connection should eventually fail")
+
+	// Nothing is listening, every failure backs off
+	_, err = w.Write([]byte("lost\n"))
+	assert.Contains(t, err.Error(), "Failed to connect to syslog at "+l.Addr().String())
+	_, err = w.Write([]byte("lost\n"))
+	assert.Contains(t, err.Error(), "Not connected to "+l.Addr().String()+", reconnecting in ")
+	assert.Equal(t, time.Millisecond*100, w.backoff)
+
+	l, err = net.Listen("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	time.Sleep(time.Millisecond * 60)
+	_, err = w.Write([]byte("back\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Millisecond*50, w.backoff)
+
+	conn, _ = l.Accept()
+	defer conn.Close()
+	assert.True(t, strings.HasSuffix(readFrame(t, bufio.NewReader(conn)), "] back"))
+}
+
+func Test_rfc5424Writer_timeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	w, err := newRFC5424Writer(rfc5424Config{
+		network:    "tcp",
+		address:    l.Addr().String(),
+		minBackoff: time.Millisecond * 50,
+		maxBackoff: time.Millisecond * 100,
+		timeout:    time.Millisecond * 50,
+	})
+	assert.Nil(t, err)
+	defer w.Close()
+
+	// A collector that stops reading fills the socket buffers, the write that doesn't fit times out
+	conn, _ := l.Accept()
+	defer conn.Close()
+
+	line := []byte(strings.Repeat("a", 64<<10) + "\n")
+	start := time.Now()
+	for i := 0; i < 1000 && err == nil; i++ {
+		_, err = w.Write(line)
+	}
+
+	assert.NotNil(t, err, "Writing should have timed out")
+	assert.Contains(t, err.Error(), "i/o timeout")
+	assert.True(t, time.Since(start) < time.Second*5, "Should not have blocked")
+	assert.Nil(t, w.conn, "The connection should have been dropped")
+
+	// The next write reconnects
+	_, err = w.Write([]byte("back\n"))
+	assert.Nil(t, err)
+	assert.NotNil(t, w.conn)
+}
+
+func Test_rfc5424Writer_tls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server, err := tls.LoadX509KeyPair(path.Join(dir, "server.pem"), path.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The collector only accepts clients with a certificate from the CA
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	frames := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				b, _ := bufio.NewReader(conn).ReadString(' ')
+				frames <- b
+			}()
+		}
+	}()
+
+	c := rfc5424Config{network: "tls", address: l.Addr().String(), priority: 1, minBackoff: time.Second, maxBackoff: time.Second, timeout: time.Second}
+
+	// No client certificate
+	c.tls, err = newTLSConfig(path.Join(dir, "ca.pem"), "", "", "")
+	assert.Nil(t, err)
+	w, err := newRFC5424Writer(c)
+	if err == nil {
+		// With TLS 1.3 the collector rejects the certificate after the handshake, so it shows up on a later write
+		for i := 0; i < 10 && err == nil; i++ {
+			_, err = w.Write([]byte("rejected\n"))
+			time.Sleep(time.Millisecond * 10)
+		}
+		w.Close()
+	}
+	assert.NotNil(t, err)
+
+	// All good
+	c.tls, err = newTLSConfig(path.Join(dir, "ca.pem"), path.Join(dir, "client.pem"), path.Join(dir, "client.key"), "")
+	assert.Nil(t, err)
+	w, err = newRFC5424Writer(c)
+	assert.Nil(t, err)
+	defer w.Close()
+
+	_, err = w.Write([]byte("secret\n"))
+	assert.Nil(t, err)
+
+	for {
+		select {
+		case frame := <-frames:
+			if frame == "" {
+				continue
+			}
+			assert.Regexp(t, `^\d+ $`, frame)
+			return
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for a message")
+		}
+	}
+}
+
+func Test_newRFC5424Writer(t *testing.T) {
+	_, err := newRFC5424Writer(rfc5424Config{network: "udp"})
+	assert.EqualError(t, err, "RFC 5424 syslog network must be tcp or tls, `udp` provided")
+
+	_, err = newRFC5424Writer(rfc5424Config{network: "tcp", priority: 192})
+	assert.EqualError(t, err, "Syslog priority must be between 0 and 191, 192 provided")
+
+	_, err = newRFC5424Writer(rfc5424Config{network: "tcp", minBackoff: time.Second, maxBackoff: time.Millisecond})
+	assert.EqualError(t, err, "Reconnect backoff must be greater than 0 and no more than the max, 1s provided")
+
+	_, err = newRFC5424Writer(rfc5424Config{network: "tcp", minBackoff: time.Second, maxBackoff: time.Second})
+	assert.EqualError(t, err, "Syslog timeout must be greater than 0, 0s provided")
+
+	assert.Equal(t, "-", headerField("", 5))
+	assert.Equal(t, "a_b", headerField("a b", 5))
+	assert.Equal(t, "abcde", headerField("abcdefg", 5))
+}
+
+// Reads one octet counted message
+func readFrame(t *testing.T, r *bufio.Reader) string {
+	size, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatal("Failed to read the frame size:", err)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil {
+		t.Fatal("Frame size is not a number:", err)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatal("Failed to read the frame:", err)
+	}
+
+	return string(b)
+}
+
+// Writes <name>.pem and <name>.key to dir, signed by parent or self signed as a CA when parent is nil
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to generate a key:", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal("Failed to create a certificate:", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("Failed to encode a key:", err)
+	}
+
+	ioutil.WriteFile(path.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(path.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Failed to parse a certificate:", err)
+	}
+
+	return cert, key
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Rotated files are named <path>.<time>, this sorts oldest first
+	ROTATE_TIME_FORMAT = "20060102-150405"
+
+	// How long to wait before trying again after a rotation fails
+	ROTATE_RETRY_INTERVAL = time.Minute
+)
+
+// rotatingFile is the file output, it rotates itself by size and age and can be reopened after something else rotated it
+// Writes and rotation share a lock so a line is never split across files or written to a file being rotated away
+type rotatingFile struct {
+	lock     sync.Mutex
+	path     string
+	mode     os.FileMode
+	uid      int
+	gid      int
+	maxSize  int64         // Rotate before the file grows past this many bytes, 0 disables
+	interval time.Duration // Rotate once the file has been written to for this long, 0 disables
+	keep     int           // Rotated files to keep, 0 keeps them all
+	compress bool
+
+	file    *os.File
+	size    int64
+	opened  time.Time
+	retryAt time.Time // Set when a rotation fails so every write doesn't try again
+
+	rotated []string      // Rotated files waiting to be compressed and pruned
+	wake    chan struct{} // Tells cleanup there are rotated files, sending never blocks so writes aren't held up
+	closing bool
+	cleaned chan struct{}
+}
+
+// Wraps a file that is already open, rotated files are compressed and pruned on another goroutine
+func newRotatingFile(f *os.File, path string, mode os.FileMode, uid, gid int, maxSize int64, interval time.Duration, keep int, compress bool) (*rotatingFile, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rotatingFile{
+		path:     path,
+		mode:     mode,
+		uid:      uid,
+		gid:      gid,
+		maxSize:  maxSize,
+		interval: interval,
+		keep:     keep,
+		compress: compress,
+		file:     f,
+		size:     stat.Size(),
+		opened:   time.Now(),
+		wake:     make(chan struct{}, 1),
+		cleaned:  make(chan struct{}),
+	}
+
+	go r.cleanup()
+	return r, nil
+}
+
+// Write appends one line, rotating first if the line would take the file past maxSize or it is older than interval
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.shouldRotate(len(b)) {
+		if err := r.rotate(); err != nil {
+			el.Printf("Failed to rotate %s, still writing to it. Error: %s\n", r.path, err)
+			r.retryAt = time.Now().Add(ROTATE_RETRY_INTERVAL)
+		}
+	}
+
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) shouldRotate(n int) bool {
+	// An empty file is never rotated, there would be nothing in the rotated file
+	// Nor is one being closed, cleanup has stopped taking rotated files
+	if r.size == 0 || r.closing || time.Now().Before(r.retryAt) {
+		return false
+	}
+
+	if r.maxSize > 0 && r.size+int64(n) > r.maxSize {
+		return true
+	}
+
+	return r.interval > 0 && time.Since(r.opened) >= r.interval
+}
+
+// Moves the current file aside and starts a new one, the current file is kept if a new one can't be opened
+func (r *rotatingFile) rotate() error {
+	name := r.path + "." + time.Now().Format(ROTATE_TIME_FORMAT)
+	for i := 1; exists(name) || exists(name+".gz"); i++ {
+		name = r.path + "." + time.Now().Format(ROTATE_TIME_FORMAT) + "-" + strconv.Itoa(i)
+	}
+
+	if err := os.Rename(r.path, name); err != nil {
+		return err
+	}
+
+	f, err := openOutputFile(r.path, r.mode, r.uid, r.gid)
+	if err != nil {
+		// Our descriptor still points at the renamed file, put it back so writing can carry on
+		os.Rename(name, r.path)
+		return err
+	}
+
+	r.swap(f, 0)
+	r.rotated = append(r.rotated, name)
+
+	// A wake up that is already waiting will pick this file up too
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Reopen starts a new file at path, for when something like logrotate has moved the file away
+// The current file is kept if a new one can't be opened
+func (r *rotatingFile) Reopen() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f, err := openOutputFile(r.path, r.mode, r.uid, r.gid)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.swap(f, stat.Size())
+	return nil
+}
+
+func (r *rotatingFile) swap(f *os.File, size int64) {
+	if err := r.file.Close(); err != nil {
+		el.Printf("Error closing old log file: %+v\n", err)
+	}
+
+	r.file = f
+	r.size = size
+	r.opened = time.Now()
+	r.retryAt = time.Time{}
+}
+
+// Close closes the file once rotated files have been compressed and pruned
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	if !r.closing {
+		r.closing = true
+		close(r.wake)
+	}
+	r.lock.Unlock()
+
+	// cleanup needs the lock to take rotated files, a write that comes in meanwhile still goes to the current file
+	<-r.cleaned
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Close()
+}
+
+// Compresses and prunes rotated files until Close, this can take a while so it is kept away from writes
+func (r *rotatingFile) cleanup() {
+	for range r.wake {
+		for {
+			name, ok := r.nextRotated()
+			if !ok {
+				break
+			}
+
+			if r.compress {
+				if err := r.gzip(name); err != nil {
+					el.Printf("Failed to compress %s. Error: %s\n", name, err)
+				}
+			}
+
+			if r.keep > 0 {
+				r.prune()
+			}
+		}
+	}
+
+	close(r.cleaned)
+}
+
+// Takes the oldest rotated file that still needs cleaning up
+func (r *rotatingFile) nextRotated() (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.rotated) == 0 {
+		return "", false
+	}
+
+	name := r.rotated[0]
+	r.rotated = r.rotated[1:]
+	return name, true
+}
+
+// Replaces a rotated file with a gzipped copy
+func (r *rotatingFile) gzip(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := openOutputFile(name+".gz.tmp", r.mode, r.uid, r.gid)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(name + ".gz.tmp")
+		return err
+	}
+
+	if err := os.Rename(name+".gz.tmp", name+".gz"); err != nil {
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// Removes the oldest rotated files so only keep are left
+func (r *rotatingFile) prune() {
+	files, err := ioutil.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		el.Printf("Failed to list rotated files. Error: %s\n", err)
+		return
+	}
+
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(filepath.Base(r.path)) + `\.(\d{8}-\d{6})(?:-(\d+))?(?:\.gz)?$`)
+	rotated := byRotation{}
+	for _, f := range files {
+		m := re.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+
+		seq, _ := strconv.Atoi(m[2])
+		rotated = append(rotated, rotatedFile{path: filepath.Join(filepath.Dir(r.path), f.Name()), time: m[1], seq: seq})
+	}
+
+	// Names don't sort by age, -10 comes before -2 and a gzipped file after the -1 rotated after it
+	sort.Sort(rotated)
+	for i := 0; i < len(rotated)-r.keep; i++ {
+		if err := os.Remove(rotated[i].path); err != nil {
+			el.Printf("Failed to remove rotated file %s. Error: %s\n", rotated[i].path, err)
+		}
+	}
+}
+
+// A rotated file and when its name says it was rotated
+type rotatedFile struct {
+	path string
+	time string // In ROTATE_TIME_FORMAT, which sorts oldest first
+	seq  int    // The -N suffix of files rotated in the same second, 0 for the first
+}
+
+// Sorts rotated files oldest first
+type byRotation []rotatedFile
+
+func (b byRotation) Len() int      { return len(b) }
+func (b byRotation) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byRotation) Less(i, j int) bool {
+	if b[i].time != b[j].time {
+		return b[i].time < b[j].time
+	}
+
+	return b[i].seq < b[j].seq
+}
+
+// Opens a file for appending with the mode and owner the file output is configured with
+func openOutputFile(path string, mode os.FileMode, uid, gid int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open output file. Error: %s", err)
+	}
+
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to set file permissions. Error: %s", err)
+	}
+
+	if err := f.Chown(uid, gid); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not chown output file. Error: %s", err)
+	}
+
+	return f, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_rotatingFile(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	dir, p := rotateDir(t)
+	defer os.RemoveAll(dir)
+
+	r := openRotatingFile(t, p, 11, 0, 2, false)
+
+	// Lines are never split, the file only rotates between them
+	r.Write([]byte("123456\n"))
+	r.Write([]byte("789\n"))
+	assert.Equal(t, []string{"go-audit.log"}, rotated(t, dir))
+
+	r.Write([]byte("abcdef\n"))
+	files := rotated(t, dir)
+	assert.Equal(t, 2, len(files))
+	assert.Equal(t, "abcdef\n", read(t, p))
+	assert.Equal(t, "123456\n789\n", read(t, path.Join(dir, files[1])))
+	assert.Regexp(t, `^go-audit\.log\.\d{8}-\d{6}$`, files[1])
+
+	// Rotating again in the same second gets a suffix instead of overwriting anything
+	r.Write([]byte("ghijkl\n"))
+	files = rotated(t, dir)
+	assert.Equal(t, 3, len(files))
+	assert.Regexp(t, `^go-audit\.log\.\d{8}-\d{6}(-1)?$`, files[2])
+
+	// Only keep rotated files are left
+	r.Write([]byte("mnopqr\n"))
+	assert.Nil(t, r.Close())
+	files = rotated(t, dir)
+	assert.Equal(t, 3, len(files))
+	assert.Equal(t, "ghijkl\n", read(t, path.Join(dir, files[2])))
+	assert.Equal(t, "mnopqr\n", read(t, p))
+}
+
+func Test_rotatingFile_interval(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	dir, p := rotateDir(t)
+	defer os.RemoveAll(dir)
+
+	r := openRotatingFile(t, p, 0, time.Hour, 0, true)
+	r.Write([]byte("old\n"))
+	assert.Equal(t, []string{"go-audit.log"}, rotated(t, dir))
+
+	r.opened = r.opened.Add(-time.Hour)
+	r.Write([]byte("new\n"))
+	assert.Nil(t, r.Close())
+
+	files := rotated(t, dir)
+	assert.Equal(t, 2, len(files))
+	assert.Regexp(t, `^go-audit\.log\.\d{8}-\d{6}\.gz$`, files[1])
+	assert.Equal(t, "new\n", read(t, p))
+
+	f, _ := os.Open(path.Join(dir, files[1]))
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(gz)
+	assert.Equal(t, "old\n", string(b))
+}
+
+func Test_rotatingFile_slowCleanup(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	dir, p := rotateDir(t)
+	defer os.RemoveAll(dir)
+
+	f, err := openOutputFile(p, 0600, os.Getuid(), os.Getgid())
+	if err != nil {
+		t.Fatal("Failed to open the output file:", err)
+	}
+
+	// No cleanup is running yet, like when compressing takes a long time
+	r := &rotatingFile{
+		path:     p,
+		mode:     0600,
+		uid:      os.Getuid(),
+		gid:      os.Getgid(),
+		maxSize:  5,
+		compress: true,
+		file:     f,
+		opened:   time.Now(),
+		wake:     make(chan struct{}, 1),
+		cleaned:  make(chan struct{}),
+	}
+
+	written := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			r.Write([]byte("12345\n"))
+		}
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Writes were held up waiting for cleanup")
+	}
+
+	// Every rotated file is still cleaned up once cleanup gets to them
+	go r.cleanup()
+	assert.Nil(t, r.Close())
+
+	files := rotated(t, dir)
+	assert.Equal(t, 20, len(files))
+	for _, file := range files[1:] {
+		assert.Regexp(t, `\.gz$`, file)
+	}
+}
+
+func Test_rotatingFile_prune(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	dir, p := rotateDir(t)
+	defer os.RemoveAll(dir)
+
+	r := openRotatingFile(t, p, 0, 0, 3, false)
+	defer r.Close()
+
+	// In name order -10 comes before -2 and the first file of the second, once gzipped, comes after all of them
+	for _, n := range []string{
+		"go-audit.log.20170101-000000.gz",
+		"go-audit.log.20170101-000000-1",
+		"go-audit.log.20170101-000000-2.gz",
+		"go-audit.log.20170101-000000-10",
+		"go-audit.log.20170102-000000",
+		"go-audit.log.other",
+	} {
+		assert.Nil(t, ioutil.WriteFile(path.Join(dir, n), []byte("x\n"), 0600))
+	}
+
+	r.prune()
+	assert.Equal(t, []string{
+		"go-audit.log",
+		"go-audit.log.20170101-000000-10",
+		"go-audit.log.20170101-000000-2.gz",
+		"go-audit.log.20170102-000000",
+		"go-audit.log.other",
+	}, rotated(t, dir))
+}
+
+func Test_rotatingFile_failures(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	dir, p := rotateDir(t)
+	defer os.RemoveAll(dir)
+
+	r := openRotatingFile(t, p, 5, 0, 0, false)
+	r.Write([]byte("12345\n"))
+
+	// The file is gone, writing carries on to the old descriptor
+	os.Remove(p)
+	_, err := r.Write([]byte("67890\n"))
+	assert.Nil(t, err)
+	assert.Contains(t, elb.String(), "Failed to rotate "+p+", still writing to it. Error: rename ")
+	assert.False(t, r.retryAt.IsZero(), "Rotation should not be retried on every write")
+
+	// Reopening brings it back
+	assert.Nil(t, r.Reopen())
+	r.Write([]byte("abc\n"))
+	assert.Equal(t, "abc\n", read(t, p))
+	assert.True(t, r.retryAt.IsZero())
+
+	// A failed reopen keeps the old file
+	os.Remove(p)
+	r.path = path.Join(dir, "missing", "go-audit.log")
+	assert.EqualError(t, r.Reopen(), "Failed to open output file. Error: open "+r.path+": no such file or directory")
+	_, err = r.Write([]byte("def\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+}
+
+func openRotatingFile(t *testing.T, p string, maxSize int64, interval time.Duration, keep int, compress bool) *rotatingFile {
+	f, err := openOutputFile(p, 0600, os.Getuid(), os.Getgid())
+	if err != nil {
+		t.Fatal("Failed to open the output file:", err)
+	}
+
+	r, err := newRotatingFile(f, p, 0600, os.Getuid(), os.Getgid(), maxSize, interval, keep, compress)
+	if err != nil {
+		t.Fatal("Failed to create the rotating file:", err)
+	}
+
+	return r
+}
+
+func rotateDir(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "go-audit-rotate")
+	if err != nil {
+		t.Fatal("Failed to create a directory:", err)
+	}
+
+	return dir, path.Join(dir, "go-audit.log")
+}
+
+// Every file in dir sorted by name, so the current file comes first and rotated files follow oldest first
+func rotated(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal("Failed to list files:", err)
+	}
+
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func read(t *testing.T, p string) string {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal("Failed to read file:", err)
+	}
+
+	return string(b)
+}
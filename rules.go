@@ -0,0 +1,920 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	AUDIT_BITMASK_SIZE   = 64         // Number of uint32 words in a rule syscall mask
+	AUDIT_CLASS_BITS     = 0xffff0000 // The top 16 bits of the last mask word select syscall classes, the kernel expands them
+	AUDIT_MAX_FIELDS     = 64         // Maximum number of fields a single rule can have
+	AUDIT_MAX_KEY_LEN    = 256        // Maximum length of a rule key
+	AUDIT_KEY_SEPARATOR  = "\x01"     // Separates multiple keys on a single rule
+	AUDIT_RULE_DATA_SIZE = 1040       // Size of audit_rule_data without the string buffer
+
+	// Filter lists, see http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L150
+	AUDIT_FILTER_USER    = 0x00
+	AUDIT_FILTER_TASK    = 0x01
+	AUDIT_FILTER_ENTRY   = 0x02
+	AUDIT_FILTER_WATCH   = 0x03
+	AUDIT_FILTER_EXIT    = 0x04
+	AUDIT_FILTER_TYPE    = 0x05
+	AUDIT_FILTER_FS      = 0x06
+	AUDIT_FILTER_PREPEND = 0x10
+
+	// Rule actions
+	AUDIT_NEVER  = 0
+	AUDIT_ALWAYS = 2
+
+	// Field comparison operators
+	AUDIT_BIT_MASK              = 0x08000000
+	AUDIT_LESS_THAN             = 0x10000000
+	AUDIT_GREATER_THAN          = 0x20000000
+	AUDIT_NOT_EQUAL             = 0x30000000
+	AUDIT_EQUAL                 = 0x40000000
+	AUDIT_BIT_TEST              = AUDIT_BIT_MASK | AUDIT_EQUAL
+	AUDIT_LESS_THAN_OR_EQUAL    = AUDIT_LESS_THAN | AUDIT_EQUAL
+	AUDIT_GREATER_THAN_OR_EQUAL = AUDIT_GREATER_THAN | AUDIT_EQUAL
+
+	// Rule fields
+	AUDIT_PID          = 0
+	AUDIT_UID          = 1
+	AUDIT_EUID         = 2
+	AUDIT_SUID         = 3
+	AUDIT_FSUID        = 4
+	AUDIT_GID          = 5
+	AUDIT_EGID         = 6
+	AUDIT_SGID         = 7
+	AUDIT_FSGID        = 8
+	AUDIT_LOGINUID     = 9
+	AUDIT_PERS         = 10
+	AUDIT_ARCH         = 11
+	AUDIT_MSGTYPE      = 12
+	AUDIT_SUBJ_USER    = 13
+	AUDIT_SUBJ_ROLE    = 14
+	AUDIT_SUBJ_TYPE    = 15
+	AUDIT_SUBJ_SEN     = 16
+	AUDIT_SUBJ_CLR     = 17
+	AUDIT_PPID         = 18
+	AUDIT_OBJ_USER     = 19
+	AUDIT_OBJ_ROLE     = 20
+	AUDIT_OBJ_TYPE     = 21
+	AUDIT_OBJ_LEV_LOW  = 22
+	AUDIT_OBJ_LEV_HIGH = 23
+	AUDIT_SESSIONID    = 25
+	AUDIT_FSTYPE       = 26
+	AUDIT_DEVMAJOR     = 100
+	AUDIT_DEVMINOR     = 101
+	AUDIT_INODE        = 102
+	AUDIT_EXIT         = 103
+	AUDIT_SUCCESS      = 104
+	AUDIT_WATCH        = 105
+	AUDIT_PERM         = 106
+	AUDIT_DIR          = 107
+	AUDIT_FILETYPE     = 108
+	AUDIT_OBJ_UID      = 109
+	AUDIT_OBJ_GID      = 110
+	AUDIT_EXE          = 112
+	AUDIT_ARG0         = 200
+	AUDIT_ARG1         = 201
+	AUDIT_ARG2         = 202
+	AUDIT_ARG3         = 203
+	AUDIT_FILTERKEY    = 210
+
+	// Watch permissions
+	AUDIT_PERM_EXEC  = 1
+	AUDIT_PERM_WRITE = 2
+	AUDIT_PERM_READ  = 4
+	AUDIT_PERM_ATTR  = 8
+
+	// Architecture identifiers, see http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L365
+	AUDIT_ARCH_X86_64  = 0xc000003e
+	AUDIT_ARCH_I386    = 0x40000003
+	AUDIT_ARCH_AARCH64 = 0xc00000b7
+	AUDIT_ARCH_ARM     = 0x40000028
+)
+
+// What a single configured rule asks us to do
+const (
+	ruleAdd = iota
+	ruleDelete
+	ruleDeleteAll
+	ruleSetEnabled
+)
+
+var ruleOperatorNames = map[uint32]string{}
+var ruleFieldNames = map[uint32]string{}
+
+func init() {
+	for _, o := range ruleOperators {
+		ruleOperatorNames[o.val] = o.op
+	}
+
+	for name, f := range ruleFields {
+		ruleFieldNames[f] = name
+	}
+
+	// Prefer the names auditctl -l prints
+	ruleFieldNames[AUDIT_LOGINUID] = "auid"
+	ruleFieldNames[AUDIT_WATCH] = "path"
+}
+
+var ruleLists = map[string]uint32{
+	"task":       AUDIT_FILTER_TASK,
+	"entry":      AUDIT_FILTER_ENTRY,
+	"exit":       AUDIT_FILTER_EXIT,
+	"user":       AUDIT_FILTER_USER,
+	"exclude":    AUDIT_FILTER_TYPE,
+	"filesystem": AUDIT_FILTER_FS,
+}
+
+var ruleActions = map[string]uint32{
+	"never":  AUDIT_NEVER,
+	"always": AUDIT_ALWAYS,
+}
+
+var ruleFields = map[string]uint32{
+	"pid":          AUDIT_PID,
+	"uid":          AUDIT_UID,
+	"euid":         AUDIT_EUID,
+	"suid":         AUDIT_SUID,
+	"fsuid":        AUDIT_FSUID,
+	"gid":          AUDIT_GID,
+	"egid":         AUDIT_EGID,
+	"sgid":         AUDIT_SGID,
+	"fsgid":        AUDIT_FSGID,
+	"auid":         AUDIT_LOGINUID,
+	"loginuid":     AUDIT_LOGINUID,
+	"pers":         AUDIT_PERS,
+	"arch":         AUDIT_ARCH,
+	"msgtype":      AUDIT_MSGTYPE,
+	"subj_user":    AUDIT_SUBJ_USER,
+	"subj_role":    AUDIT_SUBJ_ROLE,
+	"subj_type":    AUDIT_SUBJ_TYPE,
+	"subj_sen":     AUDIT_SUBJ_SEN,
+	"subj_clr":     AUDIT_SUBJ_CLR,
+	"ppid":         AUDIT_PPID,
+	"obj_user":     AUDIT_OBJ_USER,
+	"obj_role":     AUDIT_OBJ_ROLE,
+	"obj_type":     AUDIT_OBJ_TYPE,
+	"obj_lev_low":  AUDIT_OBJ_LEV_LOW,
+	"obj_lev_high": AUDIT_OBJ_LEV_HIGH,
+	"sessionid":    AUDIT_SESSIONID,
+	"fstype":       AUDIT_FSTYPE,
+	"devmajor":     AUDIT_DEVMAJOR,
+	"devminor":     AUDIT_DEVMINOR,
+	"inode":        AUDIT_INODE,
+	"exit":         AUDIT_EXIT,
+	"success":      AUDIT_SUCCESS,
+	"path":         AUDIT_WATCH,
+	"perm":         AUDIT_PERM,
+	"dir":          AUDIT_DIR,
+	"filetype":     AUDIT_FILETYPE,
+	"obj_uid":      AUDIT_OBJ_UID,
+	"obj_gid":      AUDIT_OBJ_GID,
+	"exe":          AUDIT_EXE,
+	"a0":           AUDIT_ARG0,
+	"a1":           AUDIT_ARG1,
+	"a2":           AUDIT_ARG2,
+	"a3":           AUDIT_ARG3,
+	"key":          AUDIT_FILTERKEY,
+}
+
+// Operators are ordered so that 2 character operators are matched before their 1 character prefixes
+var ruleOperators = []struct {
+	op  string
+	val uint32
+}{
+	{"!=", AUDIT_NOT_EQUAL},
+	{"<=", AUDIT_LESS_THAN_OR_EQUAL},
+	{">=", AUDIT_GREATER_THAN_OR_EQUAL},
+	{"&=", AUDIT_BIT_TEST},
+	{"=", AUDIT_EQUAL},
+	{"<", AUDIT_LESS_THAN},
+	{">", AUDIT_GREATER_THAN},
+	{"&", AUDIT_BIT_MASK},
+}
+
+var ruleFileTypes = map[string]uint32{
+	"file":      0100000,
+	"dir":       0040000,
+	"socket":    0140000,
+	"link":      0120000,
+	"character": 0020000,
+	"block":     0060000,
+	"fifo":      0010000,
+}
+
+// ruleClient is the part of the NetlinkClient used to manage kernel audit rules
+type ruleClient interface {
+	Execute(msgType uint16, payload interface{}) error
+	ListRules() ([][]byte, error)
+	GetStatus() (*AuditStatusPayload, error)
+}
+
+// auditRuleData mirrors the kernels struct audit_rule_data
+type auditRuleData struct {
+	Flags      uint32
+	Action     uint32
+	FieldCount uint32
+	Mask       [AUDIT_BITMASK_SIZE]uint32
+	Fields     [AUDIT_MAX_FIELDS]uint32
+	Values     [AUDIT_MAX_FIELDS]uint32
+	FieldFlags [AUDIT_MAX_FIELDS]uint32
+	BufLen     uint32
+	Buf        []byte
+}
+
+// auditRule is a single configured rule after being compiled
+type auditRule struct {
+	kind    int
+	data    *auditRuleData
+	enabled uint32
+}
+
+// Compiles an auditctl style rule into something we can send to the kernel
+func parseRule(rule string) (*auditRule, error) {
+	args := strings.Fields(rule)
+	if len(args) == 0 {
+		return nil, errors.New("Rule is empty")
+	}
+
+	r := &auditRule{kind: -1}
+	data := &auditRuleData{}
+	arch := nativeArch()
+	keys := []string{}
+	hasSyscalls := false
+	isWatch := false
+	hasList := false
+
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+
+		if opt == "-D" {
+			r.kind = ruleDeleteAll
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("Option %s requires a value", opt)
+		}
+
+		i++
+		val := args[i]
+
+		switch opt {
+		case "-a", "-A", "-d":
+			if hasList || isWatch {
+				return nil, fmt.Errorf("Option %s can only be provided once", opt)
+			}
+
+			if err := data.setListAction(val); err != nil {
+				return nil, err
+			}
+
+			if opt == "-A" {
+				data.Flags |= AUDIT_FILTER_PREPEND
+			}
+
+			r.kind = ruleAdd
+			if opt == "-d" {
+				r.kind = ruleDelete
+			}
+
+			hasList = true
+
+		case "-w", "-W":
+			if hasList || isWatch {
+				return nil, fmt.Errorf("Option %s can not be combined with another -a, -d, -w or -W", opt)
+			}
+
+			if err := data.setWatch(val); err != nil {
+				return nil, err
+			}
+
+			r.kind = ruleAdd
+			if opt == "-W" {
+				r.kind = ruleDelete
+			}
+
+			isWatch = true
+
+		case "-p":
+			if !isWatch {
+				return nil, errors.New("Option -p is only valid with a watch")
+			}
+
+			perm, err := parsePerm(val)
+			if err != nil {
+				return nil, err
+			}
+
+			data.Values[data.findField(AUDIT_PERM)] = perm
+
+		case "-S":
+			if isWatch {
+				return nil, errors.New("Option -S is not valid with a watch")
+			}
+
+			for _, s := range strings.Split(val, ",") {
+				if err := data.addSyscall(arch, s); err != nil {
+					return nil, err
+				}
+			}
+
+			hasSyscalls = true
+
+		case "-F":
+			a, err := data.addField(val)
+			if err != nil {
+				return nil, err
+			}
+
+			if a != 0 {
+				if hasSyscalls {
+					return nil, errors.New("The arch field must come before any -S option")
+				}
+				arch = a
+			}
+
+		case "-k":
+			keys = append(keys, val)
+
+		case "-e":
+			enabled, err := strconv.ParseUint(val, 10, 32)
+			if err != nil || enabled > 2 {
+				return nil, fmt.Errorf("Invalid enabled value `%s`, must be 0, 1 or 2", val)
+			}
+
+			r.kind = ruleSetEnabled
+			r.enabled = uint32(enabled)
+
+		default:
+			return nil, fmt.Errorf("Unsupported option %s", opt)
+		}
+	}
+
+	switch r.kind {
+	case ruleDeleteAll, ruleSetEnabled:
+		if hasList || isWatch || len(keys) > 0 {
+			return nil, errors.New("Options -D and -e must be used on their own")
+		}
+
+		return r, nil
+
+	case -1:
+		return nil, errors.New("Rule must contain one of -a, -A, -d, -w, -W, -D or -e")
+	}
+
+	if len(keys) > 0 {
+		if err := data.addStringField(AUDIT_FILTERKEY, AUDIT_EQUAL, strings.Join(keys, AUDIT_KEY_SEPARATOR)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Syscall rules with no syscalls match every syscall, same as auditctl
+	list := data.Flags &^ AUDIT_FILTER_PREPEND
+	if !hasSyscalls && !isWatch && (list == AUDIT_FILTER_EXIT || list == AUDIT_FILTER_ENTRY) {
+		data.addSyscall(arch, "all")
+	}
+
+	r.data = data
+	return r, nil
+}
+
+// Parses the `list,action` or `action,list` value of -a and -d
+func (d *auditRuleData) setListAction(val string) error {
+	parts := strings.Split(val, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid list and action `%s`", val)
+	}
+
+	list, ok := ruleLists[parts[0]]
+	action, ok2 := ruleActions[parts[1]]
+	if !ok || !ok2 {
+		list, ok = ruleLists[parts[1]]
+		action, ok2 = ruleActions[parts[0]]
+	}
+
+	if !ok || !ok2 {
+		return fmt.Errorf("Invalid list and action `%s`", val)
+	}
+
+	d.Flags = list
+	d.Action = action
+	return nil
+}
+
+// Turns the rule into a file system watch, the same way auditctl -w does
+func (d *auditRuleData) setWatch(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("Watch path `%s` must be absolute", path)
+	}
+
+	field := uint32(AUDIT_WATCH)
+	if s, err := os.Stat(path); err == nil && s.IsDir() {
+		field = AUDIT_DIR
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	d.Flags = AUDIT_FILTER_EXIT
+	d.Action = AUDIT_ALWAYS
+	for i := 0; i < AUDIT_BITMASK_SIZE-1; i++ {
+		d.Mask[i] = ^uint32(0)
+	}
+
+	if err := d.addStringField(field, AUDIT_EQUAL, path); err != nil {
+		return err
+	}
+
+	return d.addValueField(AUDIT_PERM, AUDIT_EQUAL, AUDIT_PERM_READ|AUDIT_PERM_WRITE|AUDIT_PERM_EXEC|AUDIT_PERM_ATTR)
+}
+
+// Sets the mask bit for a syscall name or number, `all` sets every bit
+func (d *auditRuleData) addSyscall(arch uint32, name string) error {
+	if name == "all" {
+		for i := range d.Mask {
+			d.Mask[i] = ^uint32(0)
+		}
+		return nil
+	}
+
+	num, err := strconv.Atoi(name)
+	if err != nil {
+		table, ok := syscallTables[arch]
+		if !ok {
+			return fmt.Errorf("No syscall table for arch %x", arch)
+		}
+
+		if num, ok = table[name]; !ok {
+			return fmt.Errorf("Unknown syscall `%s`", name)
+		}
+	}
+
+	if num < 0 || num >= AUDIT_BITMASK_SIZE*32 {
+		return fmt.Errorf("Syscall `%s` is out of range", name)
+	}
+
+	d.Mask[num/32] |= 1 << uint(num%32)
+	return nil
+}
+
+// Parses a `-F field<op>value` argument and adds it to the rule
+// If the field was the arch then its value is returned so syscalls can be resolved against it
+func (d *auditRuleData) addField(arg string) (uint32, error) {
+	pos := strings.IndexAny(arg, "!=<>&")
+	if pos < 1 {
+		return 0, fmt.Errorf("Invalid field `%s`", arg)
+	}
+
+	name := arg[:pos]
+	field, ok := ruleFields[name]
+	if !ok {
+		return 0, fmt.Errorf("Unknown field `%s`", name)
+	}
+
+	var op uint32
+	var val string
+	for _, o := range ruleOperators {
+		if strings.HasPrefix(arg[pos:], o.op) {
+			op = o.val
+			val = arg[pos+len(o.op):]
+			break
+		}
+	}
+
+	if op == 0 {
+		return 0, fmt.Errorf("Invalid operator in field `%s`", arg)
+	}
+
+	switch field {
+	case AUDIT_SUBJ_USER, AUDIT_SUBJ_ROLE, AUDIT_SUBJ_TYPE, AUDIT_SUBJ_SEN, AUDIT_SUBJ_CLR,
+		AUDIT_OBJ_USER, AUDIT_OBJ_ROLE, AUDIT_OBJ_TYPE, AUDIT_OBJ_LEV_LOW, AUDIT_OBJ_LEV_HIGH,
+		AUDIT_WATCH, AUDIT_DIR, AUDIT_EXE, AUDIT_FILTERKEY:
+		return 0, d.addStringField(field, op, val)
+
+	case AUDIT_ARCH:
+		arch, err := parseArch(val)
+		if err != nil {
+			return 0, err
+		}
+		return arch, d.addValueField(field, op, arch)
+
+	case AUDIT_UID, AUDIT_EUID, AUDIT_SUID, AUDIT_FSUID, AUDIT_LOGINUID, AUDIT_OBJ_UID:
+		v, err := parseId(val, func(n string) (string, error) {
+			u, err := user.Lookup(n)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("Invalid value for field `%s`: %s", name, err)
+		}
+		return 0, d.addValueField(field, op, v)
+
+	case AUDIT_GID, AUDIT_EGID, AUDIT_SGID, AUDIT_FSGID, AUDIT_OBJ_GID:
+		v, err := parseId(val, func(n string) (string, error) {
+			g, err := user.LookupGroup(n)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("Invalid value for field `%s`: %s", name, err)
+		}
+		return 0, d.addValueField(field, op, v)
+
+	case AUDIT_PERM:
+		perm, err := parsePerm(val)
+		if err != nil {
+			return 0, err
+		}
+		return 0, d.addValueField(field, op, perm)
+
+	case AUDIT_FILETYPE:
+		ft, ok := ruleFileTypes[val]
+		if !ok {
+			return 0, fmt.Errorf("Invalid file type `%s`", val)
+		}
+		return 0, d.addValueField(field, op, ft)
+
+	case AUDIT_SUCCESS:
+		switch val {
+		case "yes", "1":
+			return 0, d.addValueField(field, op, 1)
+		case "no", "0":
+			return 0, d.addValueField(field, op, 0)
+		}
+		return 0, fmt.Errorf("Invalid value for field `success`: %s", val)
+	}
+
+	v, err := strconv.ParseInt(val, 0, 64)
+	if err != nil || v < -1<<31 || v > 1<<32-1 {
+		return 0, fmt.Errorf("Invalid value for field `%s`: %s", name, val)
+	}
+
+	return 0, d.addValueField(field, op, uint32(v))
+}
+
+// Adds a numeric field to the rule
+func (d *auditRuleData) addValueField(field, op, val uint32) error {
+	if d.FieldCount >= AUDIT_MAX_FIELDS {
+		return errors.New("Too many fields in rule")
+	}
+
+	d.Fields[d.FieldCount] = field
+	d.FieldFlags[d.FieldCount] = op
+	d.Values[d.FieldCount] = val
+	d.FieldCount++
+	return nil
+}
+
+// Adds a string field to the rule, the value of a string field is the length of the string in the rule buffer
+func (d *auditRuleData) addStringField(field, op uint32, val string) error {
+	if field == AUDIT_FILTERKEY && len(val) > AUDIT_MAX_KEY_LEN {
+		return fmt.Errorf("Key is longer than %d characters", AUDIT_MAX_KEY_LEN)
+	}
+
+	if err := d.addValueField(field, op, uint32(len(val))); err != nil {
+		return err
+	}
+
+	d.Buf = append(d.Buf, val...)
+	d.BufLen = uint32(len(d.Buf))
+	return nil
+}
+
+// Returns the index of a field in the rule, or the field count if it is not there
+func (d *auditRuleData) findField(field uint32) uint32 {
+	for i := uint32(0); i < d.FieldCount; i++ {
+		if d.Fields[i] == field {
+			return i
+		}
+	}
+
+	return d.FieldCount
+}
+
+// Encodes the rule into the format the kernel expects
+func (d *auditRuleData) toWire() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, AUDIT_RULE_DATA_SIZE+len(d.Buf)))
+	binary.Write(buf, Endianness, d.Flags)
+	binary.Write(buf, Endianness, d.Action)
+	binary.Write(buf, Endianness, d.FieldCount)
+	binary.Write(buf, Endianness, d.Mask)
+	binary.Write(buf, Endianness, d.Fields)
+	binary.Write(buf, Endianness, d.Values)
+	binary.Write(buf, Endianness, d.FieldFlags)
+	binary.Write(buf, Endianness, d.BufLen)
+	buf.Write(d.Buf)
+	return buf.Bytes()
+}
+
+// Decodes a rule as sent to us by the kernel
+func parseAuditRuleData(b []byte) (*auditRuleData, error) {
+	if len(b) < AUDIT_RULE_DATA_SIZE {
+		return nil, fmt.Errorf("Rule data is too short, %d bytes", len(b))
+	}
+
+	d := &auditRuleData{}
+	r := bytes.NewReader(b[:AUDIT_RULE_DATA_SIZE])
+	binary.Read(r, Endianness, &d.Flags)
+	binary.Read(r, Endianness, &d.Action)
+	binary.Read(r, Endianness, &d.FieldCount)
+	binary.Read(r, Endianness, &d.Mask)
+	binary.Read(r, Endianness, &d.Fields)
+	binary.Read(r, Endianness, &d.Values)
+	binary.Read(r, Endianness, &d.FieldFlags)
+	binary.Read(r, Endianness, &d.BufLen)
+
+	if d.FieldCount > AUDIT_MAX_FIELDS || len(b)-AUDIT_RULE_DATA_SIZE < int(d.BufLen) {
+		return nil, errors.New("Rule data is malformed")
+	}
+
+	d.Buf = append([]byte{}, b[AUDIT_RULE_DATA_SIZE:AUDIT_RULE_DATA_SIZE+int(d.BufLen)]...)
+	return d, nil
+}
+
+// Returns a version of the rule that can be compared against rules listed from the kernel
+func (d *auditRuleData) key() string {
+	c := *d
+	c.Mask[AUDIT_BITMASK_SIZE-1] &^= AUDIT_CLASS_BITS
+	return string(c.toWire())
+}
+
+// Renders the rule in auditctl syntax, mostly for logging
+func (d *auditRuleData) String() string {
+	parts := []string{}
+	list := d.Flags &^ AUDIT_FILTER_PREPEND
+	opt := "-a"
+	if d.Flags&AUDIT_FILTER_PREPEND != 0 {
+		opt = "-A"
+	}
+
+	listName := fmt.Sprintf("%d", list)
+	for k, v := range ruleLists {
+		if v == list {
+			listName = k
+		}
+	}
+
+	actionName := fmt.Sprintf("%d", d.Action)
+	for k, v := range ruleActions {
+		if v == d.Action {
+			actionName = k
+		}
+	}
+
+	parts = append(parts, opt, actionName+","+listName)
+
+	// Syscalls go after the arch like auditctl -l, the arch is needed to make sense of them
+	sysPos := len(parts)
+	arch := nativeArch()
+	buf := d.Buf
+	isWatch := false
+	for i := uint32(0); i < d.FieldCount && i < AUDIT_MAX_FIELDS; i++ {
+		field, op, val := d.Fields[i], d.FieldFlags[i], d.Values[i]
+
+		name, ok := ruleFieldNames[field]
+		if !ok {
+			name = fmt.Sprintf("%d", field)
+		}
+
+		opName, ok := ruleOperatorNames[op]
+		if !ok {
+			opName = fmt.Sprintf("(%x)", op)
+		}
+
+		var v string
+		switch field {
+		case AUDIT_SUBJ_USER, AUDIT_SUBJ_ROLE, AUDIT_SUBJ_TYPE, AUDIT_SUBJ_SEN, AUDIT_SUBJ_CLR,
+			AUDIT_OBJ_USER, AUDIT_OBJ_ROLE, AUDIT_OBJ_TYPE, AUDIT_OBJ_LEV_LOW, AUDIT_OBJ_LEV_HIGH,
+			AUDIT_WATCH, AUDIT_DIR, AUDIT_EXE, AUDIT_FILTERKEY:
+			if int(val) > len(buf) {
+				val = uint32(len(buf))
+			}
+			v, buf = string(buf[:val]), buf[val:]
+
+			if field == AUDIT_FILTERKEY {
+				for _, k := range strings.Split(v, AUDIT_KEY_SEPARATOR) {
+					parts = append(parts, "-k", k)
+				}
+				continue
+			}
+
+			isWatch = isWatch || field == AUDIT_WATCH || field == AUDIT_DIR
+
+		case AUDIT_ARCH:
+			arch = val
+			v = fmt.Sprintf("0x%x", val)
+			for k, a := range nativeArches[runtime.GOARCH] {
+				if a == val {
+					v = k
+				}
+			}
+
+		case AUDIT_PERM:
+			for _, p := range []struct {
+				bit uint32
+				c   string
+			}{{AUDIT_PERM_READ, "r"}, {AUDIT_PERM_WRITE, "w"}, {AUDIT_PERM_EXEC, "x"}, {AUDIT_PERM_ATTR, "a"}} {
+				if val&p.bit != 0 {
+					v += p.c
+				}
+			}
+
+		case AUDIT_EXIT:
+			v = strconv.Itoa(int(int32(val)))
+
+		default:
+			v = strconv.FormatUint(uint64(val), 10)
+		}
+
+		parts = append(parts, "-F", name+opName+v)
+		if field == AUDIT_ARCH {
+			sysPos = len(parts)
+		}
+	}
+
+	if !isWatch {
+		if s := d.syscalls(arch); s != "" {
+			parts = append(parts[:sysPos], append([]string{"-S", s}, parts[sysPos:]...)...)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Renders the syscall mask as a comma separated list of names, or `all`
+// Syscalls without a known name for the arch are rendered as numbers
+func (d *auditRuleData) syscalls(arch uint32) string {
+	all := true
+	names := []string{}
+	for i := 0; i < AUDIT_BITMASK_SIZE*32; i++ {
+		word, bit := d.Mask[i/32], uint32(1)<<uint(i%32)
+		if i/32 == AUDIT_BITMASK_SIZE-1 && bit&AUDIT_CLASS_BITS != 0 {
+			continue
+		}
+
+		if word&bit == 0 {
+			all = false
+			continue
+		}
+
+		if name := syscallName(arch, i); name != "" {
+			names = append(names, name)
+		} else {
+			names = append(names, strconv.Itoa(i))
+		}
+	}
+
+	if all {
+		return "all"
+	}
+
+	return strings.Join(names, ",")
+}
+
+// Works out which kernel rules need to be deleted and which configured rules need to be added
+// Rule order matters within a filter list so a configured rule that is loaded but out of order is replaced
+// Kernel rules that are not configured are deleted unless keepUnknown is set
+func diffRules(current []*auditRuleData, wanted []*auditRuleData, keepUnknown bool) (add []*auditRuleData, del []*auditRuleData, same int) {
+	wantedKeys := map[string]bool{}
+	for _, r := range wanted {
+		wantedKeys[r.key()] = true
+	}
+
+	lists := []uint32{}
+	byList := map[uint32][]*auditRuleData{}
+	for _, r := range wanted {
+		list := r.Flags &^ AUDIT_FILTER_PREPEND
+		if _, ok := byList[list]; !ok {
+			lists = append(lists, list)
+		}
+		byList[list] = append(byList[list], r)
+	}
+
+	loaded := map[uint32][]*auditRuleData{}
+	for _, r := range current {
+		if !wantedKeys[r.key()] {
+			if !keepUnknown {
+				del = append(del, r)
+			}
+			continue
+		}
+
+		list := r.Flags &^ AUDIT_FILTER_PREPEND
+		loaded[list] = append(loaded[list], r)
+	}
+
+	for _, list := range lists {
+		w, k := byList[list], loaded[list]
+
+		prefix := 0
+		for prefix < len(w) && prefix < len(k) && w[prefix].key() == k[prefix].key() {
+			prefix++
+		}
+
+		same += prefix
+		del = append(del, k[prefix:]...)
+		add = append(add, w[prefix:]...)
+	}
+
+	return add, del, same
+}
+
+// Converts rwxa style permissions into the kernel bit mask
+func parsePerm(val string) (uint32, error) {
+	perm := uint32(0)
+	for _, c := range val {
+		switch c {
+		case 'r':
+			perm |= AUDIT_PERM_READ
+		case 'w':
+			perm |= AUDIT_PERM_WRITE
+		case 'x':
+			perm |= AUDIT_PERM_EXEC
+		case 'a':
+			perm |= AUDIT_PERM_ATTR
+		default:
+			return 0, fmt.Errorf("Invalid permission `%s`", val)
+		}
+	}
+
+	if perm == 0 {
+		return 0, errors.New("Permissions can not be empty")
+	}
+
+	return perm, nil
+}
+
+// Converts b64, b32 or a raw arch identifier into the kernel arch value
+func parseArch(val string) (uint32, error) {
+	switch val {
+	case "b64", "b32":
+		if a, ok := nativeArches[runtime.GOARCH][val]; ok {
+			return a, nil
+		}
+		return 0, fmt.Errorf("Arch %s is not supported on %s", val, runtime.GOARCH)
+	}
+
+	a, err := strconv.ParseUint(val, 0, 32)
+	if err != nil {
+		// auditctl also accepts the arch identifiers without a 0x
+		if a, err = strconv.ParseUint(val, 16, 32); err != nil {
+			return 0, fmt.Errorf("Invalid arch `%s`", val)
+		}
+	}
+
+	return uint32(a), nil
+}
+
+// Converts a numeric id or name into the id, -1 and unset are the kernel's unset id
+func parseId(val string, lookup func(string) (string, error)) (uint32, error) {
+	if val == "unset" || val == "-1" {
+		return ^uint32(0), nil
+	}
+
+	id, err := strconv.ParseUint(val, 10, 32)
+	if err == nil {
+		return uint32(id), nil
+	}
+
+	s, err := lookup(val)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err = strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// Maps b64 and b32 to arch identifiers for the platform we were built for
+var nativeArches = map[string]map[string]uint32{
+	"amd64": {"b64": AUDIT_ARCH_X86_64, "b32": AUDIT_ARCH_I386},
+	"386":   {"b32": AUDIT_ARCH_I386},
+	"arm64": {"b64": AUDIT_ARCH_AARCH64, "b32": AUDIT_ARCH_ARM},
+	"arm":   {"b32": AUDIT_ARCH_ARM},
+}
+
+// Returns the arch identifier syscalls are resolved against when a rule does not specify one
+func nativeArch() uint32 {
+	if a, ok := nativeArches[runtime.GOARCH]["b64"]; ok {
+		return a
+	}
+
+	return nativeArches[runtime.GOARCH]["b32"]
+}
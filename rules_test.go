@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseRule(t *testing.T) {
+	// syscall rule
+	r, err := parseRule("-a exit,always -F arch=b64 -S execve,connect -k exec")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleAdd, r.kind)
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT), r.data.Flags)
+	assert.Equal(t, uint32(AUDIT_ALWAYS), r.data.Action)
+	assert.Equal(t, uint32(2), r.data.FieldCount)
+	assert.Equal(t, uint32(AUDIT_ARCH), r.data.Fields[0])
+	assert.Equal(t, uint32(AUDIT_EQUAL), r.data.FieldFlags[0])
+	assert.Equal(t, nativeArches["amd64"]["b64"], r.data.Values[0])
+	assert.Equal(t, uint32(AUDIT_FILTERKEY), r.data.Fields[1])
+	assert.Equal(t, uint32(4), r.data.Values[1])
+	assert.Equal(t, "exec", string(r.data.Buf))
+	assert.Equal(t, uint32(4), r.data.BufLen)
+
+	// execve is 59 and connect is 42 on x86_64
+	assert.Equal(t, uint32(1<<(59-32)|1<<(42-32)), r.data.Mask[1])
+	assert.Equal(t, uint32(0), r.data.Mask[0])
+
+	// action and list can be swapped, numeric syscalls, operators, prepend
+	r, err = parseRule("-A always,exit -S 59 -F auid>=1000 -F auid!=unset -F success=no")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT|AUDIT_FILTER_PREPEND), r.data.Flags)
+	assert.Equal(t, uint32(1<<(59-32)), r.data.Mask[1])
+	assert.Equal(t, uint32(3), r.data.FieldCount)
+	assert.Equal(t, []uint32{AUDIT_LOGINUID, AUDIT_LOGINUID, AUDIT_SUCCESS}, r.data.Fields[:3])
+	assert.Equal(t, []uint32{AUDIT_GREATER_THAN_OR_EQUAL, AUDIT_NOT_EQUAL, AUDIT_EQUAL}, r.data.FieldFlags[:3])
+	assert.Equal(t, []uint32{1000, 4294967295, 0}, r.data.Values[:3])
+
+	// exit rules without syscalls match everything
+	r, err = parseRule("-a always,exit -F exit=-13")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0xffffffff), r.data.Mask[0])
+	assert.Equal(t, uint32(0xfffffff3), r.data.Values[0])
+
+	// file watch with multiple keys
+	r, err = parseRule("-w /etc/shadow -p wa -k identity -k shadow")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleAdd, r.kind)
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT), r.data.Flags)
+	assert.Equal(t, []uint32{AUDIT_WATCH, AUDIT_PERM, AUDIT_FILTERKEY}, r.data.Fields[:3])
+	assert.Equal(t, []uint32{11, AUDIT_PERM_WRITE | AUDIT_PERM_ATTR, 15}, r.data.Values[:3])
+	assert.Equal(t, "/etc/shadowidentity\x01shadow", string(r.data.Buf))
+	assert.Equal(t, uint32(0xffffffff), r.data.Mask[0])
+	assert.Equal(t, uint32(0), r.data.Mask[AUDIT_BITMASK_SIZE-1])
+
+	// directory watches use the dir field
+	r, err = parseRule("-W " + os.TempDir() + "/")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleDelete, r.kind)
+	assert.Equal(t, uint32(AUDIT_DIR), r.data.Fields[0])
+	assert.Equal(t, uint32(AUDIT_PERM_READ|AUDIT_PERM_WRITE|AUDIT_PERM_EXEC|AUDIT_PERM_ATTR), r.data.Values[1])
+	assert.Equal(t, os.TempDir(), string(r.data.Buf))
+
+	// delete, delete all and enable
+	r, err = parseRule("-d exit,always -S all")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleDelete, r.kind)
+
+	r, err = parseRule("-D")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleDeleteAll, r.kind)
+
+	r, err = parseRule("-e 2")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleSetEnabled, r.kind)
+	assert.Equal(t, uint32(2), r.enabled)
+
+	// errors
+	var ts = []struct {
+		rule string
+		err  string
+	}{
+		{"", "Rule is empty"},
+		{"-a", "Option -a requires a value"},
+		{"-a exit", "Invalid list and action `exit`"},
+		{"-a exit,sometimes", "Invalid list and action `exit,sometimes`"},
+		{"-a exit,always -a exit,always", "Option -a can only be provided once"},
+		{"-a exit,always -w /etc", "Option -w can not be combined with another -a, -d, -w or -W"},
+		{"-w etc", "Watch path `etc` must be absolute"},
+		{"-a exit,always -p r", "Option -p is only valid with a watch"},
+		{"-w /etc -p z", "Invalid permission `z`"},
+		{"-w /etc -S execve", "Option -S is not valid with a watch"},
+		{"-a exit,always -S notasyscall", "Unknown syscall `notasyscall`"},
+		{"-a exit,always -S 5000", "Syscall `5000` is out of range"},
+		{"-a exit,always -S execve -F arch=b32", "The arch field must come before any -S option"},
+		{"-a exit,always -F nope=1", "Unknown field `nope`"},
+		{"-a exit,always -F =1", "Invalid field `=1`"},
+		{"-a exit,always -F uid=nobodyweknow", "Invalid value for field `uid`: user: unknown user nobodyweknow"},
+		{"-a exit,always -F pid=abc", "Invalid value for field `pid`: abc"},
+		{"-a exit,always -F success=maybe", "Invalid value for field `success`: maybe"},
+		{"-a exit,always -F filetype=thing", "Invalid file type `thing`"},
+		{"-a exit,always -F arch=nope", "Invalid arch `nope`"},
+		{"-e 3", "Invalid enabled value `3`, must be 0, 1 or 2"},
+		{"-e 1 -k nope", "Options -D and -e must be used on their own"},
+		{"-k lonely", "Rule must contain one of -a, -A, -d, -w, -W, -D or -e"},
+		{"-b 8192", "Unsupported option -b"},
+	}
+
+	for _, ta := range ts {
+		_, err := parseRule(ta.rule)
+		assert.EqualError(t, err, ta.err, "For rule `"+ta.rule+"`")
+	}
+}
+
+func Test_auditRuleData_wire(t *testing.T) {
+	r, err := parseRule("-a always,exit -F arch=b64 -S execve -F path=/bin/ls -k exec")
+	assert.Nil(t, err)
+
+	b := r.data.toWire()
+	assert.Equal(t, AUDIT_RULE_DATA_SIZE+len("/bin/lsexec"), len(b))
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT), Endianness.Uint32(b[0:4]))
+	assert.Equal(t, uint32(AUDIT_ALWAYS), Endianness.Uint32(b[4:8]))
+	assert.Equal(t, uint32(3), Endianness.Uint32(b[8:12]))
+	assert.Equal(t, "/bin/lsexec", string(b[AUDIT_RULE_DATA_SIZE:]))
+
+	d, err := parseAuditRuleData(b)
+	assert.Nil(t, err)
+	assert.Equal(t, r.data, d)
+
+	// bad data
+	_, err = parseAuditRuleData(b[:100])
+	assert.EqualError(t, err, "Rule data is too short, 100 bytes")
+
+	_, err = parseAuditRuleData(b[:AUDIT_RULE_DATA_SIZE+2])
+	assert.EqualError(t, err, "Rule data is malformed")
+}
+
+func Test_auditRuleData_String(t *testing.T) {
+	var ts = []struct {
+		rule   string
+		result string
+	}{
+		{"-a exit,always -F arch=b64 -S execve,connect -k exec", "-a always,exit -F arch=b64 -S connect,execve -k exec"},
+		{"-a exit,always -F arch=b32 -S execve,1023", "-a always,exit -F arch=b32 -S execve,1023"},
+		{"-A never,exit -F auid>=1000 -F exit=-13", "-A never,exit -S all -F auid>=1000 -F exit=-13"},
+		{"-a always,user -F uid!=0", "-a always,user -F uid!=0"},
+		{"-w /etc/shadow -k a -k b", "-a always,exit -F path=/etc/shadow -F perm=rwxa -k a -k b"},
+	}
+
+	for _, ta := range ts {
+		assert.Equal(t, ta.result, mustParseRule(t, ta.rule).String(), "For rule `"+ta.rule+"`")
+	}
+}
+
+func Test_diffRules(t *testing.T) {
+	a := mustParseRule(t, "-a always,exit -S execve")
+	b := mustParseRule(t, "-a never,exit -S connect")
+	c := mustParseRule(t, "-a always,exit -S all")
+	u := mustParseRule(t, "-a always,user -F uid=0")
+	x := mustParseRule(t, "-a always,exit -S open")
+
+	// the kernel expands syscall classes so `all` comes back without them
+	cKernel := *c
+	cKernel.Mask[AUDIT_BITMASK_SIZE-1] = 0x0000ffff
+
+	// nothing loaded
+	add, del, same := diffRules([]*auditRuleData{}, []*auditRuleData{a, b}, false)
+	assert.Equal(t, []*auditRuleData{a, b}, add)
+	assert.Equal(t, 0, len(del))
+	assert.Equal(t, 0, same)
+
+	// everything loaded
+	add, del, same = diffRules([]*auditRuleData{a, b, &cKernel}, []*auditRuleData{a, b, c}, false)
+	assert.Equal(t, 0, len(add))
+	assert.Equal(t, 0, len(del))
+	assert.Equal(t, 3, same)
+
+	// appended rules and rules in other lists don't disturb the existing ones
+	add, del, same = diffRules([]*auditRuleData{a}, []*auditRuleData{a, u, b}, false)
+	assert.Equal(t, []*auditRuleData{b, u}, add)
+	assert.Equal(t, 0, len(del))
+	assert.Equal(t, 1, same)
+
+	// unknown rules are removed unless asked not to
+	add, del, same = diffRules([]*auditRuleData{x, a}, []*auditRuleData{a}, false)
+	assert.Equal(t, 0, len(add))
+	assert.Equal(t, []*auditRuleData{x}, del)
+	assert.Equal(t, 1, same)
+
+	add, del, same = diffRules([]*auditRuleData{x, a}, []*auditRuleData{a}, true)
+	assert.Equal(t, 0, len(add))
+	assert.Equal(t, 0, len(del))
+	assert.Equal(t, 1, same)
+
+	// out of order rules are replaced from the first difference
+	add, del, same = diffRules([]*auditRuleData{a, c, b}, []*auditRuleData{a, b, c}, false)
+	assert.Equal(t, []*auditRuleData{b, c}, add)
+	assert.Equal(t, []*auditRuleData{c, b}, del)
+	assert.Equal(t, 1, same)
+}
+
+func mustParseRule(t *testing.T, rule string) *auditRuleData {
+	r, err := parseRule(rule)
+	if err != nil {
+		t.Fatal("Failed to parse rule", rule, err)
+	}
+
+	return r.data
+}
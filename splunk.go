@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SPLUNK_ACK_TIMEOUT     = time.Minute
+	SPLUNK_ACK_MAX_PENDING = 100
+	SPLUNK_ACK_INTERVAL    = time.Second
+)
+
+// splunkFormat wraps every event in the HTTP Event Collector envelope
+// With indexer acknowledgement a batch stays in memory until splunk says it was indexed, a batch that isn't
+// acknowledged within ackTimeout is sent again
+type splunkFormat struct {
+	host       string
+	source     string
+	sourcetype string
+	index      string
+
+	ack         bool
+	ackURL      string
+	channel     string
+	ackTimeout  time.Duration
+	maxPending  int
+	closeWait   time.Duration // Longest Close waits for acks, it has to fit in the shutdown timeout
+	ackInterval time.Duration
+	pending     []*splunkBatch // Oldest first
+}
+
+// A batch waiting for splunk to acknowledge it
+type splunkBatch struct {
+	id    int64
+	lines [][]byte
+	sent  time.Time
+}
+
+type splunkResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckId *int64 `json:"ackId"`
+}
+
+func newSplunkFormat(host, source, sourcetype, index string) *splunkFormat {
+	return &splunkFormat{
+		host:       host,
+		source:     source,
+		sourcetype: sourcetype,
+		index:      index,
+	}
+}
+
+// Turns on indexer acknowledgement, every request needs a channel for splunk to track acks by
+func (f *splunkFormat) enableAck(baseURL string, timeout time.Duration, maxPending int, interval time.Duration) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("Failed to create a channel id. Error: %s", err)
+	}
+
+	// A version 4 uuid
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	f.ack = true
+	f.channel = fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	f.ackURL = baseURL + "/services/collector/ack?channel=" + f.channel
+	f.ackTimeout = timeout
+	f.closeWait = timeout
+	f.maxPending = maxPending
+	f.ackInterval = interval
+	return nil
+}
+
+func (f *splunkFormat) contentType() string {
+	return "application/json"
+}
+
+func (f *splunkFormat) encode(buf *bytes.Buffer, lines [][]byte) {
+	for _, l := range lines {
+		buf.WriteByte('{')
+		if t := auditTime(l); t != "" {
+			buf.WriteString(`"time":`)
+			buf.WriteString(t)
+			buf.WriteByte(',')
+		}
+
+		f.field(buf, "host", f.host)
+		f.field(buf, "source", f.source)
+		f.field(buf, "sourcetype", f.sourcetype)
+		f.field(buf, "index", f.index)
+
+		buf.WriteString(`"event":`)
+		buf.Write(bytes.TrimRight(l, "\n"))
+		buf.WriteString("}\n")
+	}
+}
+
+func (f *splunkFormat) field(buf *bytes.Buffer, name string, value string) {
+	if value == "" {
+		return
+	}
+
+	buf.WriteString(strconv.Quote(name))
+	buf.WriteByte(':')
+	buf.WriteString(strconv.Quote(value))
+	buf.WriteByte(',')
+}
+
+// Without acks a success response means the batch is done. With acks the batch waits with the others for splunk
+// to index it, any that waited too long are returned to be sent again
+func (f *splunkFormat) accepted(w *httpWriter, body []byte, lines [][]byte) ([][]byte, error) {
+	resp := &splunkResponse{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, fmt.Errorf("Failed to decode the HEC response. Error: %s", err)
+	}
+
+	if resp.Code != 0 {
+		return nil, fmt.Errorf("HEC returned code %d: %s", resp.Code, resp.Text)
+	}
+
+	if !f.ack {
+		return nil, nil
+	}
+
+	if resp.AckId == nil {
+		return nil, errors.New("HEC did not return an ackId, is indexer acknowledgement enabled for the token?")
+	}
+
+	f.pending = append(f.pending, &splunkBatch{id: *resp.AckId, lines: lines, sent: time.Now()})
+	return f.waitForAcks(w, f.maxPending-1)
+}
+
+// Polls for acks until no more than max batches are pending, batches that waited longer than ackTimeout are
+// given up on and their lines are returned
+func (f *splunkFormat) waitForAcks(w *httpWriter, max int) ([][]byte, error) {
+	for {
+		// The batch was accepted so it must not be sent again just because acks couldn't be checked
+		if err := f.poll(w); err != nil {
+			el.Println(err)
+		}
+
+		expired := [][]byte{}
+		pending := f.pending[:0]
+		for _, b := range f.pending {
+			if time.Since(b.sent) >= f.ackTimeout {
+				expired = append(expired, b.lines...)
+			} else {
+				pending = append(pending, b)
+			}
+		}
+		f.pending = pending
+
+		if len(expired) > 0 || len(f.pending) <= max {
+			return expired, nil
+		}
+
+		select {
+		case <-time.After(f.ackInterval):
+		case <-w.done:
+			return nil, nil
+		}
+	}
+}
+
+// Asks splunk which of the pending batches have been indexed and forgets about them
+func (f *splunkFormat) poll(w *httpWriter) error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(f.pending))
+	for i, b := range f.pending {
+		ids[i] = b.id
+	}
+
+	body, _ := json.Marshal(map[string][]int64{"acks": ids})
+	req, err := http.NewRequest("POST", f.ackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to check HEC acks. Error: %s", err)
+	}
+
+	rb, err := ioutil.ReadAll(io.LimitReader(resp.Body, HTTP_MAX_RESPONSE))
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to check HEC acks. Error: %s", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Failed to check HEC acks. Server returned %s", resp.Status)
+	}
+
+	acks := struct {
+		Acks map[string]bool `json:"acks"`
+	}{}
+
+	if err := json.Unmarshal(rb, &acks); err != nil {
+		return fmt.Errorf("Failed to decode the HEC ack response. Error: %s", err)
+	}
+
+	pending := f.pending[:0]
+	for _, b := range f.pending {
+		if !acks.Acks[strconv.FormatInt(b.id, 10)] {
+			pending = append(pending, b)
+		}
+	}
+	f.pending = pending
+
+	return nil
+}
+
+// Gives splunk until the ack timeout or closeWait, whichever is sooner, to index what is still pending
+// Anything it doesn't is lost
+func (f *splunkFormat) close(w *httpWriter) error {
+	if !f.ack {
+		return nil
+	}
+
+	wait := f.ackTimeout
+	if f.closeWait < wait {
+		wait = f.closeWait
+	}
+
+	deadline := time.Now().Add(wait)
+	for len(f.pending) > 0 && time.Now().Before(deadline) {
+		if err := f.poll(w); err != nil {
+			el.Println(err)
+		}
+
+		if len(f.pending) > 0 {
+			time.Sleep(f.ackInterval)
+		}
+	}
+
+	lost := 0
+	for _, b := range f.pending {
+		lost += len(b.lines)
+	}
+
+	if lost > 0 {
+		return fmt.Errorf("%d events sent to splunk were never acknowledged", lost)
+	}
+
+	return nil
+}
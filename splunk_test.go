@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_splunkFormat(t *testing.T) {
+	f := newSplunkFormat("host-1", "go-audit", "linux:audit", "")
+
+	buf := &bytes.Buffer{}
+	f.encode(buf, [][]byte{
+		[]byte(`{"sequence":1,"timestamp":"1500000000.123","messages":[]}` + "\n"),
+		[]byte(`{"sequence":2}` + "\n"),
+	})
+
+	assert.Equal(
+		t,
+		`{"time":1500000000.123,"host":"host-1","source":"go-audit","sourcetype":"linux:audit","event":{"sequence":1,"timestamp":"1500000000.123","messages":[]}}`+"\n"+
+			`{"host":"host-1","source":"go-audit","sourcetype":"linux:audit","event":{"sequence":2}}`+"\n",
+		buf.String(),
+	)
+
+	// Every event is valid json
+	s := bufio.NewScanner(buf)
+	for s.Scan() {
+		assert.True(t, json.Valid(s.Bytes()), s.Text())
+	}
+
+	// Without acks any success is the end of it
+	retry, err := f.accepted(nil, []byte(`{"text":"Success","code":0}`), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, retry)
+
+	_, err = f.accepted(nil, []byte(`{"text":"Invalid data format","code":6}`), nil)
+	assert.EqualError(t, err, "HEC returned code 6: Invalid data format")
+
+	// With acks an ack id is needed
+	f.enableAck("http://localhost", time.Minute, 10, time.Millisecond)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, f.channel)
+	_, err = f.accepted(nil, []byte(`{"text":"Success","code":0}`), nil)
+	assert.EqualError(t, err, "HEC did not return an ackId, is indexer acknowledgement enabled for the token?")
+}
+
+func Test_splunkWriter_ack(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	hec := newFakeHEC()
+	defer hec.Close()
+
+	f := newSplunkFormat("", "", "", "")
+	f.enableAck(hec.URL, time.Hour, 2, time.Millisecond*5)
+	w := newTestHTTPWriter(t, hec.URL+"/services/collector/event", f, func(c *httpConfig) {
+		c.maxEvents = 1
+		c.maxRetries = 1
+		c.headers = map[string]string{"X-Splunk-Request-Channel": f.channel}
+	})
+
+	// Batches wait for acks in memory, up to max_pending
+	hec.setIndexing(false)
+	w.Write([]byte(`{"sequence":1}` + "\n"))
+	assert.Equal(t, 1, len(f.pending))
+	assert.Equal(t, f.channel, hec.channel)
+
+	// Once there are too many writing waits for splunk to catch up
+	time.AfterFunc(time.Millisecond*50, func() { hec.setIndexing(true) })
+	start := time.Now()
+	w.Write([]byte(`{"sequence":2}` + "\n"))
+	assert.True(t, time.Since(start) >= time.Millisecond*50, "Should have waited for acks")
+	assert.Equal(t, 0, len(f.pending))
+
+	// Batches that aren't acknowledged in time are sent again
+	f.ackTimeout = time.Millisecond * 20
+	hec.loseNext()
+	w.Write([]byte(`{"sequence":3}` + "\n"))
+	time.Sleep(time.Millisecond * 30)
+	_, err := w.Write([]byte(`{"sequence":4}` + "\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 3}, hec.sequences())
+
+	// Close waits for what is left, but no longer than closeWait even when the ack timeout is longer
+	f.ackTimeout = time.Hour
+	f.closeWait = time.Millisecond * 20
+	hec.setIndexing(false)
+	w.Write([]byte(`{"sequence":5}` + "\n"))
+	start = time.Now()
+	assert.EqualError(t, w.Close(), "1 events sent to splunk were never acknowledged")
+	assert.True(t, time.Since(start) < time.Second, "Close should have stopped waiting after closeWait")
+	assert.Equal(t, "", elb.String())
+}
+
+// An HTTP Event Collector with indexer acknowledgement, batches are only acknowledged while indexing is on
+type fakeHEC struct {
+	*httptest.Server
+	lock     sync.Mutex
+	seqs     []int
+	channel  string
+	nextId   int64
+	indexing bool
+	lose     bool
+	lost     map[int64]bool // Batches that will never be acknowledged
+}
+
+func newFakeHEC() *fakeHEC {
+	f := &fakeHEC{lost: map[int64]bool{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeHEC) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.URL.Path == "/services/collector/ack" {
+		req := struct {
+			Acks []int64 `json:"acks"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		acks := []string{}
+		for _, id := range req.Acks {
+			acked := f.indexing && !f.lost[id]
+			acks = append(acks, fmt.Sprintf(`"%d":%v`, id, acked))
+		}
+
+		fmt.Fprintf(w, `{"acks":{%s}}`, strings.Join(acks, ","))
+		return
+	}
+
+	f.channel = r.Header.Get("X-Splunk-Request-Channel")
+	d := json.NewDecoder(r.Body)
+	for {
+		e := struct {
+			Event struct {
+				Seq int `json:"sequence"`
+			} `json:"event"`
+		}{}
+
+		if err := d.Decode(&e); err != nil {
+			break
+		}
+		f.seqs = append(f.seqs, e.Event.Seq)
+	}
+
+	if f.lose {
+		f.lost[f.nextId] = true
+		f.lose = false
+	}
+
+	fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, f.nextId)
+	f.nextId++
+}
+
+func (f *fakeHEC) setIndexing(indexing bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.indexing = indexing
+}
+
+// The next batch is accepted but never acknowledged
+func (f *fakeHEC) loseNext() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.lose = true
+}
+
+func (f *fakeHEC) sequences() []int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]int{}, f.seqs...)
+}
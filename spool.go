@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SPOOL_DROP_OLDEST = "drop_oldest" // Delete the oldest segment to make room
+	SPOOL_DROP_NEWEST = "drop_newest" // Don't spool new events until there is room
+	SPOOL_BLOCK       = "block"       // Hold up the output's queue until replaying makes room
+
+	// Most events replayed at once so new events aren't held up for too long while catching up
+	SPOOL_REPLAY_BATCH = 1000
+
+	SPOOL_MAX_SIZE       = 100 * 1024 * 1024
+	SPOOL_SEGMENT_SIZE   = 8 * 1024 * 1024
+	SPOOL_RETRY_INTERVAL = time.Second * 5
+)
+
+// spoolConfig is how a spool was configured for an output
+type spoolConfig struct {
+	dir           string
+	maxSize       int64
+	segmentSize   int64
+	overflow      string
+	retryInterval time.Duration
+}
+
+// spoolSegment is one append only file of json lines
+type spoolSegment struct {
+	seq   int64 // Unix nano time the segment was created, also its file name so segments sort oldest first
+	size  int64
+	lines int
+}
+
+// spool keeps events on disk while an output is failing and replays them in order once it recovers
+// New events are spooled behind anything still waiting so the output always gets them in order
+// Delivery is at least once, a crash while replaying repeats what was replayed since the cursor was last saved
+type spool struct {
+	lock sync.Mutex
+	name string // Name of the output, for logs and metrics
+	spoolConfig
+
+	segments []*spoolSegment // Oldest first, new events are appended to the last one
+	file     *os.File        // The last segment, open for appending
+	reader   *bufio.Reader   // Reads the first segment from offset, nil until replaying starts
+	rfile    *os.File
+	offset   int64 // How much of the first segment has been replayed
+	replayed int   // How many lines of the first segment have been replayed
+	retryAt  time.Time
+	dropped  uint64
+	reported uint64
+
+	writer  *AuditWriter // Writer of the newest output in use, for replaying while no events arrive
+	users   []spoolUser  // Outputs sharing the spool, oldest first. Guarded by spools
+	retimed chan struct{}
+	done    chan struct{}
+}
+
+// spoolUser is an output sharing a spool and how it configured it
+type spoolUser struct {
+	writer *AuditWriter
+	config spoolConfig
+}
+
+// Spools that are open, keyed by directory. A reloaded output shares the spool of the output it replaces
+var spools = struct {
+	sync.Mutex
+	m map[string]*spool
+}{m: map[string]*spool{}}
+
+// Opens the spool in c.dir for the named output, anything already spooled there is replayed once the output works
+// A spool that is already open keeps replaying to the output it had and with its config until activate is called
+func openSpool(name string, c spoolConfig, w *AuditWriter) (*spool, error) {
+	spools.Lock()
+	defer spools.Unlock()
+
+	if s, ok := spools.m[c.dir]; ok {
+		if s.name != name {
+			return nil, fmt.Errorf("Spool path %s is already used by the %s output", c.dir, s.name)
+		}
+
+		s.users = append(s.users, spoolUser{writer: w, config: c})
+		return s, nil
+	}
+
+	s := &spool{
+		name:        name,
+		spoolConfig: c,
+		writer:      w,
+		users:       []spoolUser{{writer: w, config: c}},
+		retimed:     make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	spools.m[c.dir] = s
+	go s.replayEvery()
+
+	return s, nil
+}
+
+// Switches replaying and the spool config over to the output that opened the spool with w, once it is in use
+func (s *spool) activate(w *AuditWriter) {
+	spools.Lock()
+	defer spools.Unlock()
+
+	for _, u := range s.users {
+		if u.writer == w {
+			s.use(u)
+			return
+		}
+	}
+}
+
+// Changes the writer and config, users and writer only change with spools locked
+func (s *spool) use(u spoolUser) {
+	s.lock.Lock()
+	s.spoolConfig = u.config
+	s.writer = u.writer
+	s.lock.Unlock()
+
+	// Don't wait out the old interval
+	select {
+	case s.retimed <- struct{}{}:
+	default:
+	}
+}
+
+// Picks up the segments and replay cursor left by a previous run
+func (s *spool) load() error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return fmt.Errorf("Failed to create the spool directory. Error: %s", err)
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read the spool directory. Error: %s", err)
+	}
+
+	// ReadDir sorts by name, which is also oldest first since the names are all 19 digits
+	for _, f := range files {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), ".spool"), 10, 64)
+		if err != nil || !strings.HasSuffix(f.Name(), ".spool") {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(s.path(seq))
+		if err != nil {
+			return fmt.Errorf("Failed to read spool segment %s. Error: %s", f.Name(), err)
+		}
+
+		// A crash can leave half a line at the end, it can't be replayed
+		if end := strings.LastIndexByte(string(b), '\n') + 1; end != len(b) {
+			if err := os.Truncate(s.path(seq), int64(end)); err != nil {
+				return fmt.Errorf("Failed to truncate spool segment %s. Error: %s", f.Name(), err)
+			}
+			b = b[:end]
+		}
+
+		s.segments = append(s.segments, &spoolSegment{seq: seq, size: int64(len(b)), lines: strings.Count(string(b), "\n")})
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(s.dir, "cursor")); err == nil && len(s.segments) > 0 {
+		var seq, offset int64
+		var replayed int
+		if _, err := fmt.Sscanf(string(b), "%d %d %d", &seq, &offset, &replayed); err == nil && seq == s.segments[0].seq {
+			s.offset = offset
+			s.replayed = replayed
+		}
+	}
+
+	if len(s.segments) == 0 {
+		return nil
+	}
+
+	last := s.segments[len(s.segments)-1]
+	s.file, err = os.OpenFile(s.path(last.seq), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open spool segment. Error: %s", err)
+	}
+
+	l.Printf("Found %d spooled events for the %s output in %s\n", s.events(), s.name, s.dir)
+	return nil
+}
+
+// Writes the event to the output, or spools it if the output fails or older events are still waiting
+func (s *spool) write(w *AuditWriter, msg *AuditMessageGroup) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.segments) > 0 {
+		s.replay(w)
+	}
+
+	if len(s.segments) == 0 {
+		err := w.Write(msg)
+		if err == nil {
+			return nil
+		}
+
+		el.Printf("Failed to write to the %s output, spooling events to %s until it recovers. Error: %s\n", s.name, s.dir, err)
+		s.retryAt = time.Now().Add(s.retryInterval)
+	}
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.append(w, append(line, '\n'))
+}
+
+// Adds a line to the newest segment, making room first if the spool is full
+func (s *spool) append(w *AuditWriter, line []byte) error {
+	for s.size()+int64(len(line)) > s.maxSize {
+		if len(s.segments) == 0 {
+			// The line alone is bigger than the spool
+			s.dropped++
+			return nil
+		}
+
+		switch s.overflow {
+		case SPOOL_DROP_NEWEST:
+			s.dropped++
+			return nil
+
+		case SPOOL_BLOCK:
+			if s.replay(w) {
+				continue
+			}
+
+			select {
+			case <-s.done:
+				return fmt.Errorf("The %s spool was closed while waiting for room", s.name)
+			case <-time.After(s.retryAt.Sub(time.Now())):
+			}
+
+		default:
+			s.dropped += uint64(s.segments[0].lines - s.replayed)
+			if err := s.dropFirst(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].size+int64(len(line)) > s.segmentSize {
+		if err := s.newSegment(); err != nil {
+			return err
+		}
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if n, err := s.file.Write(line); err != nil {
+		// Don't leave part of a line for the next one to be appended to
+		if n > 0 {
+			s.file.Truncate(last.size)
+		}
+		return fmt.Errorf("Failed to write to the %s spool. Error: %s", s.name, err)
+	}
+
+	last.size += int64(len(line))
+	last.lines++
+	return nil
+}
+
+// Starts a new segment for appending
+func (s *spool) newSegment() error {
+	seq := time.Now().UnixNano()
+	if len(s.segments) > 0 && seq <= s.segments[len(s.segments)-1].seq {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+
+	f, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_EXCL|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create a spool segment. Error: %s", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+
+	s.file = f
+	s.segments = append(s.segments, &spoolSegment{seq: seq})
+	return nil
+}
+
+// Sends spooled events to the output oldest first, until the spool is empty, SPOOL_REPLAY_BATCH were sent or the output fails
+// Nothing is tried before retryAt after a failure. Returns true if any room was made
+func (s *spool) replay(w *AuditWriter) bool {
+	if len(s.segments) == 0 || time.Now().Before(s.retryAt) {
+		return false
+	}
+
+	progress := false
+	for i := 0; i < SPOOL_REPLAY_BATCH && len(s.segments) > 0; i++ {
+		line, err := s.next(false)
+		if err == io.EOF {
+			if err := s.dropFirst(); err != nil {
+				el.Println(err)
+				break
+			}
+
+			progress = true
+			if len(s.segments) == 0 {
+				l.Printf("Replayed every spooled event to the %s output\n", s.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			el.Printf("Failed to read the %s spool. Error: %s\n", s.name, err)
+			s.closeReader()
+			s.retryAt = time.Now().Add(s.retryInterval)
+			break
+		}
+
+		// Output filters aren't checked again, they were applied before the event was spooled
+		if err := w.WriteLine(line); err != nil {
+			// The line is read again once the reader is reopened at offset
+			s.closeReader()
+			s.retryAt = time.Now().Add(s.retryInterval)
+			break
+		}
+
+		s.offset += int64(len(line))
+		s.replayed++
+		progress = true
+	}
+
+	s.saveCursor()
+	return progress
+}
+
+// Reads the next line to replay from the first segment, io.EOF means the segment has been replayed
+func (s *spool) next(retried bool) ([]byte, error) {
+	if s.reader == nil {
+		f, err := os.Open(s.path(s.segments[0].seq))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := f.Seek(s.offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		s.rfile = f
+		s.reader = bufio.NewReader(f)
+	}
+
+	line, err := s.reader.ReadBytes('\n')
+	if err != io.EOF || (len(line) == 0 && s.offset >= s.segments[0].size) {
+		return line, err
+	}
+
+	// More was appended after the reader hit the end, start again from offset rather than replay part of a line
+	s.closeReader()
+	if retried {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return s.next(true)
+}
+
+// Deletes the first segment, whether it was replayed or is being dropped
+func (s *spool) dropFirst() error {
+	s.closeReader()
+
+	if len(s.segments) == 1 && s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	first := s.segments[0]
+	s.segments = s.segments[1:]
+	s.offset = 0
+	s.replayed = 0
+
+	if err := os.Remove(s.path(first.seq)); err != nil {
+		return fmt.Errorf("Failed to remove spool segment. Error: %s", err)
+	}
+
+	return nil
+}
+
+func (s *spool) closeReader() {
+	if s.rfile != nil {
+		s.rfile.Close()
+	}
+
+	s.rfile = nil
+	s.reader = nil
+}
+
+// Records how far replaying got so a restart doesn't replay it all again
+func (s *spool) saveCursor() {
+	cursor := filepath.Join(s.dir, "cursor")
+	if len(s.segments) == 0 {
+		os.Remove(cursor)
+		return
+	}
+
+	b := []byte(fmt.Sprintf("%d %d %d\n", s.segments[0].seq, s.offset, s.replayed))
+	if err := ioutil.WriteFile(cursor+".tmp", b, 0600); err != nil {
+		el.Printf("Failed to save the %s spool cursor. Error: %s\n", s.name, err)
+		return
+	}
+
+	if err := os.Rename(cursor+".tmp", cursor); err != nil {
+		el.Printf("Failed to save the %s spool cursor. Error: %s\n", s.name, err)
+	}
+}
+
+// Bytes waiting to be replayed
+func (s *spool) size() int64 {
+	size := -s.offset
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+
+	return size
+}
+
+// Events waiting to be replayed
+func (s *spool) events() int {
+	events := -s.replayed
+	for _, seg := range s.segments {
+		events += seg.lines
+	}
+
+	return events
+}
+
+// How long the oldest segment has been waiting, 0 if nothing is
+func (s *spool) age() time.Duration {
+	if len(s.segments) == 0 {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, s.segments[0].seq))
+}
+
+func (s *spool) path(seq int64) string {
+	return filepath.Join(s.dir, strconv.FormatInt(seq, 10)+".spool")
+}
+
+// Keeps replaying while no new events arrive to trigger it, until the spool is closed
+func (s *spool) replayEvery() {
+	for {
+		s.lock.Lock()
+		interval := s.retryInterval
+		s.lock.Unlock()
+
+		select {
+		case <-time.After(interval):
+			s.lock.Lock()
+			select {
+			case <-s.done:
+				// Released while waiting for the lock, the writer may be closed
+			default:
+				s.replay(s.writer)
+			}
+			s.lock.Unlock()
+		case <-s.retimed:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Logs anything dropped since the last report and sends the spool size, age and drops to statsd
+func (s *spool) report(sc *StatsdConfig) {
+	s.lock.Lock()
+	size, events, age := s.size(), s.events(), s.age()
+	dropped := s.dropped - s.reported
+	s.reported = s.dropped
+	s.lock.Unlock()
+
+	if dropped > 0 {
+		el.Printf("The %s spool is full, dropped %d events\n", s.name, dropped)
+	}
+
+	prefix := "goaudit.spool." + s.name + "."
+	datagrams := []string{
+		prefix + "size:" + strconv.FormatInt(size, 10) + "|g",
+		prefix + "events:" + strconv.Itoa(events) + "|g",
+		prefix + "age:" + strconv.FormatInt(int64(age.Seconds()), 10) + "|g",
+		prefix + "dropped:" + strconv.FormatUint(dropped, 10) + "|c",
+	}
+
+	for _, d := range datagrams {
+		if err := sendStatsd(sc, d); err != nil {
+			el.Println("Failed to send statsd datagram. Error:", err)
+		}
+	}
+}
+
+// Stops the output that opened the spool with w using it, it is closed once no output uses it
+// Anything still spooled stays on disk for the next run
+func (s *spool) release(w *AuditWriter) {
+	spools.Lock()
+	defer spools.Unlock()
+
+	for i, u := range s.users {
+		if u.writer == w {
+			s.users = append(s.users[:i], s.users[i+1:]...)
+			break
+		}
+	}
+
+	if len(s.users) > 0 {
+		// Replaying can't go to an output that is being closed, fall back to the newest one left
+		if s.writer == w {
+			s.use(s.users[len(s.users)-1])
+		}
+		return
+	}
+
+	delete(spools.m, s.dir)
+	close(s.done)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.saveCursor()
+	s.closeReader()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_spool(t *testing.T) {
+	lb, elb := hookLogger()
+	defer resetLogger()
+
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+
+	w := &flakyWriter{}
+	aw := NewAuditWriter(w, 1)
+	s, err := openSpool("test", spoolConfig{dir: dir, maxSize: 1 << 20, segmentSize: 1 << 10, overflow: SPOOL_DROP_OLDEST, retryInterval: time.Hour}, aw)
+	assert.Nil(t, err)
+	defer s.release(aw)
+
+	// A working output gets events straight away
+	assert.Nil(t, s.write(aw, spoolGroup(1)))
+	assert.Equal(t, 0, s.events())
+
+	// A failing one has them spooled
+	w.setFail(true)
+	assert.Nil(t, s.write(aw, spoolGroup(2)))
+	assert.Equal(t, 1, s.events())
+	assert.Equal(t, "Failed to write to the test output, spooling events to "+dir+" until it recovers. Error: down\n", elb.String())
+
+	// Once spooling, new events wait behind the old ones until it is time to retry
+	w.setFail(false)
+	assert.Nil(t, s.write(aw, spoolGroup(3)))
+	assert.Equal(t, 2, s.events())
+	assert.Equal(t, []int{1}, w.sequences(t))
+
+	// Everything is replayed in order and the spool is cleaned up
+	s.retryAt = time.Time{}
+	assert.Nil(t, s.write(aw, spoolGroup(4)))
+	assert.Equal(t, 0, s.events())
+	assert.Equal(t, int64(0), s.size())
+	assert.Equal(t, []int{1, 2, 3, 4}, w.sequences(t))
+	assert.Equal(t, "Replayed every spooled event to the test output\n", lb.String())
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 0, len(files), "Replayed segments and the cursor should have been removed")
+
+	// Another output can't share the spool but the same output can, like when reloading
+	_, err = openSpool("other", spoolConfig{dir: dir}, aw)
+	assert.EqualError(t, err, "Spool path "+dir+" is already used by the test output")
+
+	s2, err := openSpool("test", spoolConfig{dir: dir, maxSize: 1 << 20, segmentSize: 1 << 10, overflow: SPOOL_DROP_OLDEST, retryInterval: time.Hour}, aw)
+	assert.Nil(t, err)
+	assert.True(t, s == s2)
+	s2.release(aw)
+}
+
+func Test_spool_reopen(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+
+	line := spoolLine(t, 1)
+	c := spoolConfig{dir: dir, maxSize: 1 << 20, segmentSize: int64(len(line) * 2), overflow: SPOOL_DROP_OLDEST, retryInterval: time.Hour}
+
+	w := &flakyWriter{fail: true}
+	aw := NewAuditWriter(w, 1)
+	s, err := openSpool("test", c, aw)
+	assert.Nil(t, err)
+
+	for i := 1; i <= 5; i++ {
+		assert.Nil(t, s.write(aw, spoolGroup(i)))
+	}
+	assert.Equal(t, 3, len(s.segments), "Segments should hold 2 events each")
+
+	// Replay part of it
+	w.setFail(false)
+	w.allow = 3
+	s.retryAt = time.Time{}
+	s.replay(aw)
+	assert.Equal(t, []int{1, 2, 3}, w.sequences(t))
+	s.release(aw)
+
+	// A crash mid write leaves part of a line behind
+	f, _ := os.OpenFile(s.path(s.segments[len(s.segments)-1].seq), os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"sequence":6,"time`)
+	f.Close()
+
+	w = &flakyWriter{}
+	aw = NewAuditWriter(w, 1)
+	s, err = openSpool("test", c, aw)
+	assert.Nil(t, err)
+	defer s.release(aw)
+
+	assert.Equal(t, 2, s.events(), "Replayed events and the partial line should have been skipped")
+	s.replay(aw)
+	assert.Equal(t, []int{4, 5}, w.sequences(t))
+	assert.Equal(t, 0, s.events())
+}
+
+func Test_spool_reload(t *testing.T) {
+	hookLogger()
+	defer resetLogger()
+
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+
+	c := spoolConfig{dir: dir, maxSize: 1 << 20, segmentSize: 1 << 10, overflow: SPOOL_DROP_OLDEST, retryInterval: time.Hour}
+	w1 := &flakyWriter{fail: true}
+	aw1 := NewAuditWriter(w1, 1)
+	s, err := openSpool("test", c, aw1)
+	assert.Nil(t, err)
+	assert.Nil(t, s.write(aw1, spoolGroup(1)))
+
+	// A reload that fails never takes the spool over
+	failed := NewAuditWriter(&flakyWriter{}, 1)
+	c2 := c
+	c2.retryInterval = time.Millisecond * 10
+	_, err = openSpool("test", c2, failed)
+	assert.Nil(t, err)
+	assert.True(t, s.writer == aw1)
+	assert.Equal(t, time.Hour, s.retryInterval)
+
+	s.release(failed)
+	assert.True(t, s.writer == aw1)
+	assert.Equal(t, time.Hour, s.retryInterval)
+
+	// One that works replays to the new output, with its retry interval, once it is activated
+	w2 := &flakyWriter{}
+	aw2 := NewAuditWriter(w2, 1)
+	_, err = openSpool("test", c2, aw2)
+	assert.Nil(t, err)
+	s.activate(aw2)
+	s.release(aw1)
+	assert.True(t, s.writer == aw2)
+	assert.Equal(t, c2.retryInterval, s.retryInterval)
+
+	s.lock.Lock()
+	s.retryAt = time.Time{}
+	s.lock.Unlock()
+
+	for i := 0; i < 100 && len(w2.sequences(t)) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, []int{1}, w2.sequences(t), "Should not have waited out the old retry interval")
+	assert.Equal(t, 0, len(w1.sequences(t)))
+
+	s.release(aw2)
+	_, ok := spools.m[dir]
+	assert.False(t, ok, "The spool should be closed once no output uses it")
+}
+
+func Test_spool_overflow(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	line := spoolLine(t, 1)
+	newSpool := func(overflow string) (*spool, *flakyWriter, *AuditWriter) {
+		dir := spoolDir(t)
+		w := &flakyWriter{fail: true}
+		aw := NewAuditWriter(w, 1)
+		s, err := openSpool("test", spoolConfig{dir: dir, maxSize: int64(len(line) * 4), segmentSize: int64(len(line) * 2), overflow: overflow, retryInterval: time.Millisecond * 10}, aw)
+		if err != nil {
+			t.Fatal("Failed to open the spool:", err)
+		}
+
+		for i := 1; i <= 4; i++ {
+			assert.Nil(t, s.write(aw, spoolGroup(i)))
+		}
+		assert.Equal(t, 4, s.events())
+
+		return s, w, aw
+	}
+
+	// New events are dropped
+	s, w, aw := newSpool(SPOOL_DROP_NEWEST)
+	assert.Nil(t, s.write(aw, spoolGroup(5)))
+	assert.Equal(t, 4, s.events())
+	assert.Equal(t, uint64(1), s.dropped)
+
+	elb.Reset()
+	s.report(&StatsdConfig{kind: "none"})
+	assert.Equal(t, "The test spool is full, dropped 1 events\n", elb.String())
+
+	w.setFail(false)
+	s.retryAt = time.Time{}
+	s.replay(aw)
+	assert.Equal(t, []int{1, 2, 3, 4}, w.sequences(t))
+	s.release(aw)
+	os.RemoveAll(s.dir)
+
+	// The oldest segment is dropped
+	s, w, aw = newSpool(SPOOL_DROP_OLDEST)
+	assert.Nil(t, s.write(aw, spoolGroup(5)))
+	assert.Equal(t, 3, s.events())
+	assert.Equal(t, uint64(2), s.dropped)
+
+	w.setFail(false)
+	s.retryAt = time.Time{}
+	s.replay(aw)
+	assert.Equal(t, []int{3, 4, 5}, w.sequences(t))
+	s.release(aw)
+	os.RemoveAll(s.dir)
+
+	// Writing waits until the output recovers
+	s, w, aw = newSpool(SPOOL_BLOCK)
+	time.AfterFunc(time.Millisecond*50, func() { w.setFail(false) })
+	assert.Nil(t, s.write(aw, spoolGroup(5)))
+	assert.Equal(t, uint64(0), s.dropped)
+	assert.Equal(t, []int{1, 2}, w.sequences(t)[:2], "The oldest segment should have been replayed to make room")
+
+	s.retryAt = time.Time{}
+	s.replay(aw)
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, w.sequences(t))
+	s.release(aw)
+	os.RemoveAll(s.dir)
+
+	// Or the spool is closed
+	s, w, aw = newSpool(SPOOL_BLOCK)
+	released := make(chan struct{})
+	time.AfterFunc(time.Millisecond*50, func() {
+		s.release(aw)
+		close(released)
+	})
+	assert.EqualError(t, s.write(aw, spoolGroup(5)), "The test spool was closed while waiting for room")
+
+	// Release saves the cursor after the write gives up
+	<-released
+	os.RemoveAll(s.dir)
+}
+
+func Test_spool_replayAttempts(t *testing.T) {
+	_, elb := hookLogger()
+	defer resetLogger()
+
+	dir := spoolDir(t)
+	defer os.RemoveAll(dir)
+
+	w := &flakyWriter{fail: true}
+	aw := NewAuditWriter(w, 2)
+	s, err := openSpool("test", spoolConfig{dir: dir, maxSize: 1 << 20, segmentSize: 1 << 10, overflow: SPOOL_DROP_OLDEST, retryInterval: time.Hour}, aw)
+	assert.Nil(t, err)
+	defer s.release(aw)
+
+	assert.Nil(t, s.write(aw, spoolGroup(1)))
+	assert.Equal(t, 1, s.events())
+
+	// Replaying gets the same attempts as any other write
+	w.setFail(false)
+	w.failures = 1
+	s.retryAt = time.Time{}
+	assert.True(t, s.replay(aw))
+	assert.Equal(t, 0, s.events())
+	assert.Equal(t, []int{1}, w.sequences(t))
+	assert.Contains(t, elb.String(), "Failed to write message, retrying in 1 second. Error: down\n")
+}
+
+// A writer that can be made to fail, to fail the next failures writes or to fail once it has written allow lines
+type flakyWriter struct {
+	lock     sync.Mutex
+	buf      []string
+	fail     bool
+	failures int
+	allow    int
+}
+
+func (f *flakyWriter) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		return 0, errors.New("down")
+	}
+
+	if f.fail || (f.allow > 0 && len(f.buf) >= f.allow) {
+		return 0, errors.New("down")
+	}
+
+	f.buf = append(f.buf, string(b))
+	return len(b), nil
+}
+
+func (f *flakyWriter) setFail(fail bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.fail = fail
+}
+
+// The sequence of every message group written, in order
+func (f *flakyWriter) sequences(t *testing.T) []int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	seqs := []int{}
+	for _, line := range f.buf {
+		msg := &AuditMessageGroup{}
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line)), msg); err != nil {
+			t.Fatal("Failed to decode a written line:", err)
+		}
+		seqs = append(seqs, msg.Seq)
+	}
+
+	return seqs
+}
+
+func spoolGroup(seq int) *AuditMessageGroup {
+	return &AuditMessageGroup{Seq: seq, AuditTime: "10000001", CompletedBy: COMPLETED_BY_EOE}
+}
+
+// How a single digit sequence group looks in the spool
+func spoolLine(t *testing.T, seq int) string {
+	b, err := json.Marshal(spoolGroup(seq))
+	if err != nil {
+		t.Fatal("Failed to encode group:", err)
+	}
+
+	return string(b) + "\n"
+}
+
+func spoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "go-audit-spool")
+	if err != nil {
+		t.Fatal("Failed to create a spool directory:", err)
+	}
+
+	return dir
+}
@@ -29,6 +29,9 @@ type StatsdConfig struct {
 	ip     string
 	port   string
 	tokens map[uint16]map[string]string
+
+	// Use syscall names instead of numbers in metric names and the syscall token
+	syscallNames bool
 }
 
 func appendKeyTag(l []string, k1, k2, v string) []string {
@@ -79,7 +82,12 @@ func formatDatagram(msg *AuditMessageGroup, confs *StatsdConfig) string {
 			// el.Println("config token matched on item type: ", mes.Type)
 			for k, v := range confs.tokens[mes.Type] {
 				// el.Println("attempting cutout of token: ", k, v, ":", cutout(cont, " " + k + "="))
-				if val := cutout(cont, " "+k+"="); val != "" {
+				val := cutout(cont, " "+k+"=")
+				if k == "syscall" && mes.Type == 1300 && confs.syscallNames && msg.SyscallName != "" {
+					val = msg.SyscallName
+				}
+
+				if val != "" {
 					df.tokens[k] = val
 					if _, ok := df.mtagbls[k]; ok {
 						df.tags = appendKeyTag(df.tags, v, k, tag_delim+val)
@@ -94,6 +102,8 @@ func formatDatagram(msg *AuditMessageGroup, confs *StatsdConfig) string {
 		case 1300:
 			if sys := cutout(cont, " syscall="); sys == "" {
 				return ""
+			} else if confs.syscallNames && msg.SyscallName != "" {
+				df.syscall = msg.SyscallName
 			} else {
 				df.syscall = sys
 			}
@@ -192,3 +202,19 @@ func newStatsdClient(addr string) (*statsdClient, error) {
 	client := &statsdClient{conn: conn}
 	return client, nil
 }
+
+// Sends a single datagram if statsd or dogstatsd is configured
+func sendStatsd(sc *StatsdConfig, datagram string) error {
+	if sc.kind != "statsd" && sc.kind != "dogstatsd" {
+		return nil
+	}
+
+	udp_cl, err := newStatsdClient(sc.ip + ":" + sc.port)
+	if err != nil {
+		return err
+	}
+	defer udp_cl.conn.Close()
+
+	_, err = udp_cl.conn.Write([]byte(datagram))
+	return err
+}
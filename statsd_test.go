@@ -95,6 +95,12 @@ func Test_formatDatagram(t *testing.T) {
 		{&AuditMessageGroup{Msgs: []*AuditMessage{&AuditMessage{Type: uint16(1300), Data: " hi there tag=waldo syscall=test success=yes exit=0 hi"}}}, &StatsdConfig{kind: "dogstatsd", tokens: map[uint16]map[string]string{uint16(1300): {"success": "worked", "tag": "nope", "exit": ""}}}, "goaudit.syscall.test.count:1|c|#exit:0,worked:yes"},
 		// test dogstatsd events with multiple tags
 		{&AuditMessageGroup{Msgs: []*AuditMessage{&AuditMessage{Type: uint16(1300), Data: " hi there tag=waldo syscall=test comm=foo key=event,bar hi"}}}, &StatsdConfig{kind: "dogstatsd", tokens: map[uint16]map[string]string{uint16(1300): {"key": "rule_group", "tag": "whereis", "comm": ""}}}, "_e{58,60}:Go-Audit Syscall test ocurred and matched on Key Group bar|  hi there tag=waldo syscall=test comm=foo key=event,bar hi |s:goaudit|#comm:foo,rule_group:bar,whereis:waldo"},
+		// syscall names replace numbers when asked for
+		{&AuditMessageGroup{SyscallName: "execve", Msgs: []*AuditMessage{&AuditMessage{Type: uint16(1300), Data: " hi there syscall=59 hi"}}}, &StatsdConfig{kind: "statsd"}, "goaudit.syscall.59.count:1|c"},
+		{&AuditMessageGroup{SyscallName: "execve", Msgs: []*AuditMessage{&AuditMessage{Type: uint16(1300), Data: " hi there syscall=59 hi"}}}, &StatsdConfig{kind: "statsd", syscallNames: true}, "goaudit.syscall.execve.count:1|c"},
+		{&AuditMessageGroup{Msgs: []*AuditMessage{&AuditMessage{Type: uint16(1300), Data: " hi there syscall=59 hi"}}}, &StatsdConfig{kind: "statsd", syscallNames: true}, "goaudit.syscall.59.count:1|c"},
+		{&AuditMessageGroup{SyscallName: "execve", Msgs: []*AuditMessage{&AuditMessage{Type: uint16(1300), Data: " hi there syscall=59 success=yes hi"}}}, &StatsdConfig{kind: "dogstatsd", syscallNames: true, tokens: map[uint16]map[string]string{uint16(1300): {"syscall": "sc", "success": ""}}}, "goaudit.syscall.execve.count:1|c|#success:yes"},
+		{&AuditMessageGroup{SyscallName: "execve", Msgs: []*AuditMessage{&AuditMessage{Type: uint16(1300), Data: " hi there syscall=59 key=event hi"}}}, &StatsdConfig{kind: "dogstatsd", syscallNames: true, tokens: map[uint16]map[string]string{uint16(1300): {"syscall": "sc"}}}, "_e{31,35}:Go-Audit Syscall execve ocurred|  hi there syscall=59 key=event hi |s:goaudit|#sc:execve"},
 	}
 	// todo
 	c := 0
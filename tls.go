@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Builds the client side of a mutually authenticated TLS connection
+// The CA bundle replaces the system roots, the certificate and key are only needed if the collector asks for one
+// An empty server name is filled in from the address that is dialed
+func newTLSConfig(ca, cert, key, serverName string) (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the CA bundle. Error: %s", err)
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in the CA bundle %s", ca)
+		}
+	}
+
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("Both a client certificate and key are needed")
+		}
+
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load the client certificate. Error: %s", err)
+		}
+
+		c.Certificates = []tls.Certificate{pair}
+	}
+
+	return c, nil
+}
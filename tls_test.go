@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newTLSConfig(t *testing.T) {
+	c, err := newTLSConfig("", "", "", "collector")
+	assert.Nil(t, err)
+	assert.Equal(t, "collector", c.ServerName)
+	assert.Nil(t, c.RootCAs, "The system roots should be used without a CA bundle")
+
+	_, err = newTLSConfig("/do/not/exist", "", "", "")
+	assert.EqualError(t, err, "Failed to read the CA bundle. Error: open /do/not/exist: no such file or directory")
+
+	empty := createTempFile(t, "ca.pem", "")
+	defer os.Remove(empty)
+	_, err = newTLSConfig(empty, "", "", "")
+	assert.EqualError(t, err, "No certificates found in the CA bundle "+empty)
+
+	_, err = newTLSConfig("", "cert.pem", "", "")
+	assert.EqualError(t, err, "Both a client certificate and key are needed")
+
+	_, err = newTLSConfig("", "/do/not/exist", "/do/not/exist", "")
+	assert.EqualError(t, err, "Failed to load the client certificate. Error: open /do/not/exist: no such file or directory")
+}
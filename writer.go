@@ -3,6 +3,10 @@ package main
 import (
 	"encoding/json"
 	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,16 +24,32 @@ func NewAuditWriter(w io.Writer, attempts int) *AuditWriter {
 	}
 }
 
-func (a *AuditWriter) Write(msg *AuditMessageGroup) (err error) {
+func (a *AuditWriter) Write(msg *AuditMessageGroup) error {
+	return a.try(func() error {
+		return a.e.Encode(msg)
+	})
+}
+
+// Writes a message group that was already encoded, like one read back from a spool, with the same attempts as Write
+func (a *AuditWriter) WriteLine(line []byte) error {
+	return a.try(func() error {
+		_, err := a.w.Write(line)
+		return err
+	})
+}
+
+func (a *AuditWriter) try(write func() error) (err error) {
 	for i := 0; i < a.attempts; i++ {
-		err = a.e.Encode(msg)
+		err = write()
 		if err == nil {
 			break
 		}
 
-		if i != a.attempts {
-			// We have to reset the encoder because write errors are kept internally and can not be retried
-			a.e = json.NewEncoder(a.w)
+		// We have to reset the encoder because write errors are kept internally and can not be retried
+		// This is also needed after the last attempt so a writer that recovers can be used again, like by a spool
+		a.e = json.NewEncoder(a.w)
+
+		if i != a.attempts-1 {
 			el.Println("Failed to write message, retrying in 1 second. Error:", err)
 			time.Sleep(time.Second * 1)
 		}
@@ -37,3 +57,135 @@ func (a *AuditWriter) Write(msg *AuditMessageGroup) (err error) {
 
 	return err
 }
+
+// AuditOutput is one of the configured destinations for message groups
+// Each output has its own writer and can drop message groups the others still receive
+type AuditOutput struct {
+	name    string
+	writer  *AuditWriter
+	filters map[string]map[uint16][]*AuditFilter // { syscall: { mtype: [filter, ...] } }
+	done    chan struct{}                        // Closed when the output is closed so helpers like log rotation can stop
+	close   sync.Once
+	spool   *spool // Keeps message groups on disk while the writer is failing, nil if spooling is disabled
+
+	queue    chan *AuditMessageGroup // Groups waiting to be written by the output's own goroutine, nil while there is none
+	written  chan struct{}           // Closed once the goroutine has written everything queued
+	failing  int32                   // 1 if the last queued write failed, updated atomically
+	dropped  uint64                  // Groups dropped because queue was full, updated atomically
+	reported uint64                  // Only touched by report
+}
+
+func NewAuditOutput(name string, w *AuditWriter, filters []AuditFilter) *AuditOutput {
+	return &AuditOutput{
+		name:    name,
+		writer:  w,
+		filters: newFilterMap(filters),
+		done:    make(chan struct{}),
+	}
+}
+
+// Write sends the message group to the output unless one of the outputs filters matches it
+func (o *AuditOutput) Write(msg *AuditMessageGroup) error {
+	if filtersMatch(o.filters, msg) {
+		return nil
+	}
+
+	if o.spool != nil {
+		return o.spool.write(o.writer, msg)
+	}
+
+	return o.writer.Write(msg)
+}
+
+// Starts writing queued groups on a goroutine of its own, failed is called after each write that fails
+func (o *AuditOutput) startQueue(size int, failed func(*AuditOutput)) {
+	o.queue = make(chan *AuditMessageGroup, size)
+	o.written = make(chan struct{})
+
+	go func(queue <-chan *AuditMessageGroup) {
+		for msg := range queue {
+			if err := o.Write(msg); err != nil {
+				el.Printf("Failed to write message to the %s output. Error: %s\n", o.name, err)
+				atomic.StoreInt32(&o.failing, 1)
+				failed(o)
+				continue
+			}
+
+			atomic.StoreInt32(&o.failing, 0)
+		}
+
+		close(o.written)
+	}(o.queue)
+}
+
+// Queues a group for the output's goroutine, it is dropped and counted if the queue is full
+func (o *AuditOutput) enqueue(msg *AuditMessageGroup) {
+	select {
+	case o.queue <- msg:
+	default:
+		atomic.AddUint64(&o.dropped, 1)
+	}
+}
+
+// Waits for everything queued to be written and stops the goroutine, does nothing if there is no queue
+func (o *AuditOutput) stopQueue() {
+	if o.queue == nil {
+		return
+	}
+
+	close(o.queue)
+	<-o.written
+	o.queue = nil
+}
+
+func (o *AuditOutput) isFailing() bool {
+	return atomic.LoadInt32(&o.failing) == 1
+}
+
+// Logs anything dropped since the last report and sends the queue depth and drops to statsd
+func (o *AuditOutput) report(sc *StatsdConfig) {
+	dropped := atomic.LoadUint64(&o.dropped)
+	n := dropped - o.reported
+	o.reported = dropped
+
+	if n > 0 {
+		el.Printf("The %s output's queue is full, dropped %d events\n", o.name, n)
+	}
+
+	prefix := "goaudit.output." + o.name + ".queue."
+	datagrams := []string{
+		prefix + "depth:" + strconv.Itoa(len(o.queue)) + "|g",
+		prefix + "dropped:" + strconv.FormatUint(n, 10) + "|c",
+	}
+
+	for _, d := range datagrams {
+		if err := sendStatsd(sc, d); err != nil {
+			el.Println("Failed to send statsd datagram. Error:", err)
+		}
+	}
+}
+
+// Close writes anything still queued and closes the underlying writer if it can be closed
+// Closing more than once does nothing
+func (o *AuditOutput) Close() error {
+	var err error
+	o.close.Do(func() {
+		o.stopQueue()
+		close(o.done)
+
+		if o.spool != nil {
+			o.spool.release(o.writer)
+		}
+
+		// Stdout outlives any one output, a reloaded config may still be using it
+		if o.writer.w == os.Stdout {
+			return
+		}
+
+		if c, ok := o.writer.w.(io.Closer); ok {
+			err = c.Close()
+		}
+	})
+
+	return err
+}